@@ -0,0 +1,509 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ===== Backup =====
+
+// backupOptions selects how a new backup is dumped and compressed.
+type backupOptions struct {
+	Custom   bool       // pg_dump -Fc instead of a plain SQL script
+	Compress dumpFormat // formatZstd, formatGzip, format7z or formatPlain (none)
+}
+
+// backupFileName names a backup the way listBackups and the catalog expect,
+// e.g. mk1_2025-01-01_03-00.sql.zst
+func backupFileName(database string, ts time.Time, opts backupOptions) string {
+	base := fmt.Sprintf("%s_%s", database, ts.Format("2006-01-02_15-04"))
+	if opts.Custom {
+		return base + ".dump"
+	}
+	switch opts.Compress {
+	case format7z:
+		return base + ".sql.7z"
+	case formatGzip:
+		return base + ".sql.gz"
+	case formatZstd:
+		return base + ".sql.zst"
+	}
+	return base + ".sql"
+}
+
+// parseCompression maps a --compress value to a format
+func parseCompression(s string) (dumpFormat, error) {
+	switch s {
+	case "zstd", "zst":
+		return formatZstd, nil
+	case "gzip", "gz":
+		return formatGzip, nil
+	case "7z":
+		return format7z, nil
+	case "none":
+		return formatPlain, nil
+	}
+	return "", fmt.Errorf("unknown compression %q (expected zstd, gzip, 7z or none)", s)
+}
+
+// pgDumpCommand builds the pg_dump command for cfg.PGDatabase
+func pgDumpCommand(cfg *RestoreConfig, custom bool) *exec.Cmd {
+	args := []string{
+		"-h", cfg.PGHost,
+		"-p", cfg.PGPort,
+		"-U", cfg.PGUser,
+		"-d", cfg.PGDatabase,
+	}
+	if custom {
+		args = append(args, "-Fc")
+	}
+
+	cmd := exec.Command("pg_dump", args...)
+	cmd.Env = os.Environ()
+	if cfg.PGPassword != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+cfg.PGPassword)
+	}
+	return cmd
+}
+
+// serverVersion returns the PostgreSQL server version for the manifest
+func serverVersion(ctx context.Context, cfg *RestoreConfig) (string, error) {
+	conn, err := connectDB(ctx, cfg, cfg.PGDatabase)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close(ctx)
+
+	var v string
+	if err := conn.QueryRow(ctx, "SHOW server_version").Scan(&v); err != nil {
+		return "", fmt.Errorf("failed to query server version: %w", err)
+	}
+	return v, nil
+}
+
+// hashingWriter hashes and counts bytes on their way to w
+type hashingWriter struct {
+	w io.Writer
+	h hash.Hash
+	n int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, h: sha256.New()}
+}
+
+func (hw *hashingWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	hw.n += int64(n)
+	return n, err
+}
+
+func (hw *hashingWriter) sum() string {
+	return hex.EncodeToString(hw.h.Sum(nil))
+}
+
+// uploadDumpStream pipes pg_dump through the compressor straight into storage,
+// returning the uploaded size and sha256
+func uploadDumpStream(ctx context.Context, cfg *RestoreConfig, store Storage, name string, opts backupOptions) (int64, string, error) {
+	pr, pw := io.Pipe()
+	hw := newHashingWriter(pw)
+
+	dumpErr := make(chan error, 1)
+	go func() {
+		err := runPGDump(cfg, opts, hw)
+		pw.CloseWithError(err)
+		dumpErr <- err
+	}()
+
+	// A failed dump closes the pipe with an error, so Put aborts the upload
+	putErr := store.Put(ctx, name, pr, -1)
+	pr.CloseWithError(putErr)
+	if err := <-dumpErr; err != nil {
+		return 0, "", err
+	}
+	if putErr != nil {
+		return 0, "", putErr
+	}
+	return hw.n, hw.sum(), nil
+}
+
+// runPGDump writes pg_dump's output to w, compressed with opts.Compress
+func runPGDump(cfg *RestoreConfig, opts backupOptions, w io.Writer) error {
+	out := io.WriteCloser(nopWriteCloser{w})
+	if !opts.Custom && (opts.Compress == formatGzip || opts.Compress == formatZstd) {
+		cw, err := compress(opts.Compress, w)
+		if err != nil {
+			return err
+		}
+		out = cw
+	}
+
+	var stderr bytes.Buffer
+	cmd := pgDumpCommand(cfg, opts.Custom)
+	cmd.Stdout = out
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_dump failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to compress dump: %w", err)
+	}
+	return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// upload7z builds a 7z archive in WorkDir (7z needs a seekable output), then
+// uploads it, returning the uploaded size and sha256
+func upload7z(ctx context.Context, cfg *RestoreConfig, store Storage, name string) (int64, string, error) {
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
+		return 0, "", fmt.Errorf("failed to create work directory: %w", err)
+	}
+	archivePath := filepath.Join(cfg.WorkDir, name)
+	defer cleanup(archivePath)
+
+	var err error
+	if cfg.BackupPassword == "" {
+		err = dumpTo7z(cfg, archivePath, strings.TrimSuffix(name, ".7z"))
+	} else {
+		err = dumpToEncrypted7z(cfg, archivePath, strings.TrimSuffix(name, ".7z"))
+	}
+	if err != nil {
+		return 0, "", err
+	}
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, "", err
+	}
+
+	hw := newHashingWriter(io.Discard)
+	if err := store.Put(ctx, name, io.TeeReader(f, hw), info.Size()); err != nil {
+		return 0, "", err
+	}
+	return hw.n, hw.sum(), nil
+}
+
+// dumpTo7z pipes pg_dump into 7z, which stores it as entry
+func dumpTo7z(cfg *RestoreConfig, archivePath, entry string) error {
+	dump := pgDumpCommand(cfg, false)
+	var dumpStderr bytes.Buffer
+	dump.Stderr = io.MultiWriter(os.Stderr, &dumpStderr)
+	sz := exec.Command("7z", "a", "-t7z", "-si"+entry, archivePath)
+	stdout, err := dump.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	sz.Stdin = stdout
+	var szOutput bytes.Buffer
+	sz.Stdout = &szOutput
+	sz.Stderr = &szOutput
+
+	if err := sz.Start(); err != nil {
+		return fmt.Errorf("failed to start 7z: %w", err)
+	}
+	if err := dump.Run(); err != nil {
+		sz.Wait()
+		return fmt.Errorf("pg_dump failed: %w: %s", err, strings.TrimSpace(dumpStderr.String()))
+	}
+	if err := sz.Wait(); err != nil {
+		return fmt.Errorf("7z failed: %w: %s", err, strings.TrimSpace(szOutput.String()))
+	}
+	return nil
+}
+
+// dumpToEncrypted7z dumps into a file next to the archive and has 7z encrypt it
+// with cfg.BackupPassword. A password given as -p<password> would be visible
+// to every local user in ps, so -p is left empty and 7z reads the password
+// from stdin; the dump cannot share stdin and goes through the file.
+func dumpToEncrypted7z(cfg *RestoreConfig, archivePath, entry string) error {
+	dumpPath := filepath.Join(filepath.Dir(archivePath), entry)
+	defer cleanup(dumpPath)
+
+	f, err := os.OpenFile(dumpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", dumpPath, err)
+	}
+	dump := pgDumpCommand(cfg, false)
+	var dumpStderr bytes.Buffer
+	dump.Stdout = f
+	dump.Stderr = io.MultiWriter(os.Stderr, &dumpStderr)
+	err = dump.Run()
+	if closeErr := f.Close(); err == nil && closeErr != nil {
+		return fmt.Errorf("failed to write %s: %w", dumpPath, closeErr)
+	}
+	if err != nil {
+		return fmt.Errorf("pg_dump failed: %w: %s", err, strings.TrimSpace(dumpStderr.String()))
+	}
+
+	// 7z asks again to confirm a new password
+	sz := exec.Command("7z", "a", "-t7z", "-p", "-mhe=on", archivePath, dumpPath)
+	detachTerminal(sz)
+	sz.Stdin = strings.NewReader(cfg.BackupPassword + "\n" + cfg.BackupPassword + "\n")
+	var szOutput bytes.Buffer
+	sz.Stdout = &szOutput
+	sz.Stderr = &szOutput
+	if err := sz.Run(); err != nil {
+		return fmt.Errorf("7z failed: %w: %s", err, strings.TrimSpace(szOutput.String()))
+	}
+	return nil
+}
+
+// runBackup dumps cfg.PGDatabase into storage as name, then uploads its manifest
+func runBackup(ctx context.Context, cfg *RestoreConfig, store Storage, name string, opts backupOptions) (*backupManifest, error) {
+	createdAt := time.Now()
+
+	pgVersion, err := serverVersion(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("Dumping %s (PostgreSQL %s) to %s...\n", cfg.PGDatabase, pgVersion, name)
+	var size int64
+	var sum string
+	if !opts.Custom && opts.Compress == format7z {
+		size, sum, err = upload7z(ctx, cfg, store, name)
+	} else {
+		size, sum, err = uploadDumpStream(ctx, cfg, store, name, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("Uploaded: %s (%s, sha256 %s)\n", name, formatBytes(size), sum)
+
+	return uploadManifest(ctx, store, &backupManifest{
+		File:      name,
+		Size:      size,
+		SHA256:    sum,
+		PGVersion: pgVersion,
+		CreatedAt: createdAt,
+	})
+}
+
+// uploadManifest stores the manifest next to its backup. It goes last: its
+// presence marks the backup as complete.
+func uploadManifest(ctx context.Context, store Storage, manifest *backupManifest) (*backupManifest, error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	manifestName := sidecarName(manifest.File, ".manifest.json")
+	if err := store.Put(ctx, manifestName, bytes.NewReader(data), int64(len(data))); err != nil {
+		return nil, fmt.Errorf("failed to upload manifest: %w", err)
+	}
+	manifest.Source = manifestName
+	fmt.Printf("Uploaded: %s\n", manifestName)
+	return manifest, nil
+}
+
+func cmdBackup(args []string) int {
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var (
+		opts         = backupOptions{Compress: formatZstd}
+		runVerify    bool
+		passwordFile string
+		base         bool
+	)
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-s", "--storage":
+			if i+1 < len(args) {
+				cfg.StorageType = args[i+1]
+				i++
+			}
+		case "-d", "--database":
+			if i+1 < len(args) {
+				cfg.PGDatabase = args[i+1]
+				i++
+			}
+		case "--compress":
+			if i+1 < len(args) {
+				c, err := parseCompression(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				opts.Compress = c
+				i++
+			}
+		case "--custom":
+			opts.Custom = true
+		case "--password-file":
+			if i+1 < len(args) {
+				passwordFile = args[i+1]
+				password, err := readSecretFile(passwordFile)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				cfg.BackupPassword = password
+				i++
+			}
+		case "--verify":
+			runVerify = true
+		case "--base":
+			base = true
+		case "--dry-run":
+			cfg.DryRun = true
+		case "-h", "--help":
+			printBackupUsage()
+			return 0
+		}
+	}
+
+	// Only 7z archives are encrypted; anything else would go up in plaintext
+	// although a password was given
+	is7z := !opts.Custom && opts.Compress == format7z
+	if base {
+		if cfg.BackupPassword != "" {
+			fmt.Fprintln(os.Stderr, "Warning: base backups are not encrypted; the backup password is not used")
+		}
+		return cmdBaseBackup(cfg, runVerify)
+	}
+	if cfg.BackupPassword != "" && !is7z {
+		fmt.Fprintln(os.Stderr, "Error: a backup password is set (--password-file or BACKUP_PASSWORD) but only --compress 7z without --custom encrypts")
+		fmt.Fprintln(os.Stderr, "       use --compress 7z, or unset the password to upload an unencrypted backup")
+		return 1
+	}
+
+	name := backupFileName(cfg.PGDatabase, time.Now(), opts)
+
+	// Check required tools
+	tools := []string{"pg_dump"}
+	if is7z {
+		tools = append(tools, "7z")
+	}
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: required tool '%s' not found in PATH\n", tool)
+			return 1
+		}
+	}
+
+	if cfg.DryRun {
+		kind := "plain"
+		if opts.Custom {
+			kind = "custom"
+		}
+		fmt.Println("[DRY RUN] Would execute:")
+		fmt.Printf("  1. Dump: %s@%s:%s/%s (%s)\n", cfg.PGUser, cfg.PGHost, cfg.PGPort, cfg.PGDatabase, kind)
+		fmt.Printf("  2. Upload: %s to %s\n", name, cfg.StorageType)
+		fmt.Printf("  3. Upload: %s\n", sidecarName(name, ".manifest.json"))
+		return 0
+	}
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	if _, err := runBackup(context.Background(), cfg, store, name, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Println("\n✅ Backup completed successfully!")
+
+	if runVerify {
+		fmt.Println()
+		verifyArgs := []string{"--storage", cfg.StorageType, "--file", name}
+		if passwordFile != "" {
+			verifyArgs = append(verifyArgs, "--password-file", passwordFile)
+		}
+		return cmdVerify(verifyArgs)
+	}
+	return 0
+}
+
+func printBackupUsage() {
+	fmt.Println("Usage: yamisskey-doctor backup [options]")
+	fmt.Println("")
+	fmt.Println("Dump the database with pg_dump, compress it and upload it with a checksum manifest.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	fmt.Println("  -s, --storage    Storage (same values as restore, default: r2)")
+	fmt.Println("  -d, --database   Database to dump (default: POSTGRES_DB)")
+	fmt.Println("  --compress       zstd, gzip, 7z or none (default: zstd)")
+	fmt.Println("  --custom         Dump in pg_dump custom format (.dump, compressed by pg_dump)")
+	fmt.Println("  --password-file  Encrypt 7z archives with this password (or BACKUP_PASSWORD);")
+	fmt.Println("                   a password with any other format is an error")
+	fmt.Println("  --verify         Verify the new backup right after uploading it")
+	fmt.Println("  --base           Take a base backup of the whole cluster for restore --target-time")
+	fmt.Println("  --dry-run        Show what would be done without executing")
+	fmt.Println("")
+	fmt.Println("Backups are named <database>_YYYY-MM-DD_HH-MM.<ext> and uploaded with a")
+	fmt.Println("<name>.manifest.json holding their size, sha256 and PostgreSQL version.")
+	fmt.Println("")
+	fmt.Println("Base backups (--base) are pg_basebackup tars of the cluster without WAL,")
+	fmt.Println("stored as basebackups/base_YYYY-MM-DD_HH-MM.tar.zst. They need a user with the")
+	fmt.Println("REPLICATION attribute and WAL archiving with wal-push (see wal-push --help).")
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Println("  yamisskey-doctor backup")
+	fmt.Println("  yamisskey-doctor backup --compress 7z --password-file /config/backup-password")
+	fmt.Println("  yamisskey-doctor backup --custom --storage linode --verify")
+	fmt.Println("  yamisskey-doctor backup --base")
+}
+
+// cmdBaseBackup takes a base backup for point-in-time recovery
+func cmdBaseBackup(cfg *RestoreConfig, runVerify bool) int {
+	if runVerify {
+		fmt.Fprintln(os.Stderr, "Error: --verify does not support base backups")
+		return 1
+	}
+	if _, err := exec.LookPath("pg_basebackup"); err != nil {
+		fmt.Fprintln(os.Stderr, "Error: required tool 'pg_basebackup' not found in PATH")
+		return 1
+	}
+
+	name := baseBackupName(time.Now())
+	if cfg.DryRun {
+		fmt.Println("[DRY RUN] Would execute:")
+		fmt.Printf("  1. Base backup: %s@%s:%s (pg_basebackup, WAL from the archive)\n", cfg.PGUser, cfg.PGHost, cfg.PGPort)
+		fmt.Printf("  2. Upload: %s to %s\n", name, cfg.StorageType)
+		fmt.Printf("  3. Upload: %s\n", sidecarName(name, ".manifest.json"))
+		return 0
+	}
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	if _, err := runBaseBackup(context.Background(), cfg, store, name); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	fmt.Println("\n✅ Base backup completed successfully!")
+	return 0
+}
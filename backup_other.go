@@ -0,0 +1,8 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os/exec"
+
+// detachTerminal leaves cmd as it is on this platform
+func detachTerminal(cmd *exec.Cmd) {}
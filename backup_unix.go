@@ -0,0 +1,14 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// detachTerminal starts cmd in a new session without a controlling terminal,
+// so that a password prompt of 7z reads stdin instead of /dev/tty
+func detachTerminal(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Backups =====
+
+func cmdBackups(args []string) int {
+	if len(args) == 0 {
+		printBackupsUsage()
+		return 2
+	}
+	switch args[0] {
+	case "status":
+		return cmdBackupsStatus(args[1:])
+	case "-h", "--help", "help":
+		printBackupsUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown backups command: %s\n", args[0])
+		printBackupsUsage()
+		return 2
+	}
+}
+
+func printBackupsUsage() {
+	fmt.Println("Usage: yamisskey-doctor backups <command> [options]")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	fmt.Println("  status   Report backup freshness, missed schedule slots and size anomalies")
+}
+
+// ===== Backup status =====
+
+// BackupStatus is the health of the backups in storage.
+type BackupStatus struct {
+	Status   string   `json:"status"` // healthy, degraded or unhealthy
+	Storage  string   `json:"storage"`
+	Database string   `json:"database,omitempty"`
+	Count    int      `json:"count"`
+	Problems []string `json:"problems,omitempty"`
+
+	Newest     *Backup `json:"newest,omitempty"`
+	AgeSeconds int64   `json:"ageSeconds"`
+	RPOSeconds int64   `json:"rpoSeconds"`
+	RPOOK      bool    `json:"rpoOk"`
+
+	Schedule     []string    `json:"schedule,omitempty"`
+	MissingSlots []time.Time `json:"missingSlots,omitempty"`
+
+	Size *SizeCheck `json:"size,omitempty"`
+}
+
+// SizeCheck compares the newest backup's size with the previous ones.
+type SizeCheck struct {
+	OK       bool    `json:"ok"`
+	Size     int64   `json:"size"`
+	Average  int64   `json:"average"`  // mean size of the compared backups
+	Compared int     `json:"compared"` // number of previous backups compared
+	Change   float64 `json:"change"`   // percent change versus the average
+}
+
+// statusOptions are the thresholds of a backup status check
+type statusOptions struct {
+	RPO        time.Duration // maximum age of the newest backup
+	Schedule   []time.Duration
+	Grace      time.Duration // allowed offset between a slot and its backup
+	Window     time.Duration // how far back to look for missed slots
+	SizeWindow int           // previous backups to compare the size with
+	SizeDrop   float64       // percent drop considered an anomaly
+}
+
+// parseSchedule parses backup times of day such as "03:00,15:00"
+func parseSchedule(s string) ([]time.Duration, error) {
+	var slots []time.Duration
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		t, err := time.Parse("15:04", part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule time %q (expected HH:MM)", part)
+		}
+		slots = append(slots, time.Duration(t.Hour())*time.Hour+time.Duration(t.Minute())*time.Minute)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	return slots, nil
+}
+
+// checkBackupStatus evaluates backups (newest first) at now
+func checkBackupStatus(backups []Backup, opts statusOptions, now time.Time) *BackupStatus {
+	st := &BackupStatus{
+		Count:      len(backups),
+		RPOSeconds: int64(opts.RPO.Seconds()),
+	}
+	for _, slot := range opts.Schedule {
+		st.Schedule = append(st.Schedule, fmt.Sprintf("%02d:%02d", int(slot.Hours()), int(slot.Minutes())%60))
+	}
+
+	if len(backups) == 0 {
+		st.Status = "unhealthy"
+		st.Problems = append(st.Problems, "no backups found")
+		return st
+	}
+
+	// Freshness of the newest backup
+	newest := backups[0]
+	st.Newest = &newest
+	age := now.Sub(newest.Timestamp)
+	st.AgeSeconds = int64(age.Seconds())
+	st.RPOOK = age <= opts.RPO
+	if !st.RPOOK {
+		st.Problems = append(st.Problems, fmt.Sprintf("newest backup is %s old (RPO %s)", humanizeAge(age), opts.RPO))
+	}
+
+	// Schedule slots without a backup, from the oldest backup on
+	oldest := backups[len(backups)-1].Timestamp
+	from := now.Add(-opts.Window)
+	if from.Before(oldest.Add(-opts.Grace)) {
+		from = oldest.Add(-opts.Grace)
+	}
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, now.Location()); !day.After(now); day = day.AddDate(0, 0, 1) {
+		for _, offset := range opts.Schedule {
+			slot := day.Add(offset)
+			if slot.Before(from) || slot.Add(opts.Grace).After(now) {
+				continue
+			}
+			if !hasBackupNear(backups, slot, opts.Grace) {
+				st.MissingSlots = append(st.MissingSlots, slot)
+			}
+		}
+	}
+	if len(st.MissingSlots) > 0 {
+		st.Problems = append(st.Problems, fmt.Sprintf("%d scheduled backups missing", len(st.MissingSlots)))
+	}
+
+	// Size of the newest backup versus previous backups of the same kind
+	var total int64
+	var compared int
+	for _, b := range backups[1:] {
+		if compared == opts.SizeWindow {
+			break
+		}
+		if b.Format == newest.Format && b.Database == newest.Database {
+			total += b.Size
+			compared++
+		}
+	}
+	if compared > 0 {
+		avg := total / int64(compared)
+		st.Size = &SizeCheck{OK: true, Size: newest.Size, Average: avg, Compared: compared}
+		if avg > 0 {
+			st.Size.Change = (float64(newest.Size) - float64(avg)) / float64(avg) * 100
+			if st.Size.Change <= -opts.SizeDrop {
+				st.Size.OK = false
+				st.Problems = append(st.Problems, fmt.Sprintf("newest backup is %.0f%% smaller than the previous %d", -st.Size.Change, compared))
+			}
+		}
+	}
+
+	switch {
+	case !st.RPOOK:
+		st.Status = "unhealthy"
+	case len(st.Problems) > 0:
+		st.Status = "degraded"
+	default:
+		st.Status = "healthy"
+	}
+	return st
+}
+
+// hasBackupNear reports whether a backup was taken within grace of slot
+func hasBackupNear(backups []Backup, slot time.Time, grace time.Duration) bool {
+	for _, b := range backups {
+		d := b.Timestamp.Sub(slot)
+		if d >= -grace && d <= grace {
+			return true
+		}
+	}
+	return false
+}
+
+func printBackupStatusText(st *BackupStatus) {
+	okStatus := func(ok bool, warn string) string {
+		if ok {
+			return "OK  "
+		}
+		return warn
+	}
+
+	if st.Newest == nil {
+		fmt.Printf("Newest      FAIL  no backups in %s\n", st.Storage)
+	} else {
+		age := time.Duration(st.AgeSeconds) * time.Second
+		fmt.Printf("Newest      %s  %s (%s, %s ago)\n", okStatus(st.RPOOK, "FAIL"),
+			st.Newest.Name, formatBytes(st.Newest.Size), humanizeAge(age))
+		fmt.Printf("RPO         %s  %s old, limit %s\n", okStatus(st.RPOOK, "FAIL"),
+			humanizeAge(age), time.Duration(st.RPOSeconds)*time.Second)
+	}
+
+	if len(st.Schedule) > 0 && st.Newest != nil {
+		fmt.Printf("Schedule    %s  %s, %d missing\n", okStatus(len(st.MissingSlots) == 0, "WARN"),
+			strings.Join(st.Schedule, "/"), len(st.MissingSlots))
+		for _, slot := range st.MissingSlots {
+			fmt.Printf("              missing %s\n", slot.Format("2006-01-02 15:04"))
+		}
+	}
+
+	if st.Size != nil {
+		fmt.Printf("Size        %s  %s (%+.0f%% vs average %s of previous %d)\n", okStatus(st.Size.OK, "WARN"),
+			formatBytes(st.Size.Size), st.Size.Change, formatBytes(st.Size.Average), st.Size.Compared)
+	}
+
+	fmt.Printf("Backups     %d\n", st.Count)
+	fmt.Printf("Status      %s\n", st.Status)
+}
+
+func cmdBackupsStatus(args []string) int {
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var (
+		format   string
+		quiet    bool
+		database string
+		schedule = getEnvOrDefault("BACKUP_SCHEDULE", "03:00,15:00")
+	)
+	opts := statusOptions{
+		RPO:        13 * time.Hour,
+		Grace:      time.Hour,
+		Window:     7 * 24 * time.Hour,
+		SizeWindow: 5,
+		SizeDrop:   50,
+	}
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-s", "--storage":
+			if i+1 < len(args) {
+				cfg.StorageType = args[i+1]
+				i++
+			}
+		case "--db":
+			if i+1 < len(args) {
+				database = args[i+1]
+				i++
+			}
+		case "--rpo", "--grace", "--window":
+			if i+1 < len(args) {
+				d, err := parseDurationArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %s: %v\n", args[i], err)
+					return 2
+				}
+				switch args[i] {
+				case "--rpo":
+					opts.RPO = d
+				case "--grace":
+					opts.Grace = d
+				default:
+					opts.Window = d
+				}
+				i++
+			}
+		case "--schedule":
+			if i+1 < len(args) {
+				schedule = args[i+1]
+				i++
+			}
+		case "--size-window":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &opts.SizeWindow)
+				i++
+			}
+		case "--size-drop":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%g", &opts.SizeDrop)
+				i++
+			}
+		case "--format":
+			if i+1 < len(args) {
+				format = args[i+1]
+				i++
+			}
+		case "-q", "--quiet":
+			quiet = true
+		case "-h", "--help":
+			printBackupsStatusUsage()
+			return 0
+		}
+	}
+
+	slots, err := parseSchedule(schedule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	opts.Schedule = slots
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	defer store.Close()
+
+	backups, err := listBackups(context.Background(), store)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	backups = backupFilter{Database: database}.apply(backups)
+
+	st := checkBackupStatus(backups, opts, time.Now())
+	st.Storage = cfg.StorageType
+	st.Database = database
+
+	if !quiet {
+		switch format {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.Encode(st)
+		default:
+			printBackupStatusText(st)
+		}
+	}
+
+	switch st.Status {
+	case "healthy":
+		return 0
+	case "degraded":
+		return 1
+	default:
+		return 2
+	}
+}
+
+// parseDurationArg parses a duration, also accepting days such as 7d
+func parseDurationArg(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q (expected e.g. 13h or 7d)", s)
+	}
+	return d, nil
+}
+
+func printBackupsStatusUsage() {
+	fmt.Println("Usage: yamisskey-doctor backups status [options]")
+	fmt.Println("")
+	fmt.Println("Report whether backups are still being uploaded on schedule.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	fmt.Println("  -s, --storage    Storage (same values as restore, default: r2)")
+	fmt.Println("  --db             Only consider backups of this database")
+	fmt.Println("  --rpo            Maximum age of the newest backup (default: 13h)")
+	fmt.Println("  --schedule       Expected backup times of day (default: BACKUP_SCHEDULE or 03:00,15:00)")
+	fmt.Println("  --grace          Allowed offset between a scheduled time and its backup (default: 1h)")
+	fmt.Println("  --window         How far back to look for missed backups (default: 7d)")
+	fmt.Println("  --size-window    Previous backups to compare the newest size with (default: 5)")
+	fmt.Println("  --size-drop      Percent size drop reported as an anomaly (default: 50)")
+	fmt.Println("  --format         Output format: text or json (default: text)")
+	fmt.Println("  -q, --quiet      Only set the exit code")
+	fmt.Println("")
+	fmt.Println("Exit codes:")
+	fmt.Println("  0  healthy")
+	fmt.Println("  1  degraded (missed schedule slots or size anomaly)")
+	fmt.Println("  2  unhealthy (newest backup older than the RPO, or no backups)")
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Println("  yamisskey-doctor backups status")
+	fmt.Println("  yamisskey-doctor backups status --storage linode --rpo 25h --schedule 03:00")
+	fmt.Println("  yamisskey-doctor backups status --format json")
+}
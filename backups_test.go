@@ -0,0 +1,163 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []time.Duration
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"03:00", []time.Duration{3 * time.Hour}, false},
+		{"15:30, 03:00,", []time.Duration{3 * time.Hour, 15*time.Hour + 30*time.Minute}, false},
+		{"3am", nil, true},
+		{"25:00", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseSchedule(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSchedule(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseSchedule(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCheckBackupStatus(t *testing.T) {
+	opts := statusOptions{
+		RPO:        26 * time.Hour,
+		Schedule:   []time.Duration{3 * time.Hour},
+		Grace:      time.Hour,
+		Window:     72 * time.Hour,
+		SizeWindow: 3,
+		SizeDrop:   50,
+	}
+	daily := []string{"2025-01-05 03:00", "2025-01-04 03:00", "2025-01-03 03:00", "2025-01-02 03:00"}
+
+	tests := []struct {
+		name     string
+		backups  []string
+		sizes    []int64 // per backup, 100 if nil
+		formats  []dumpFormat
+		now      string
+		status   string
+		missing  []string
+		sizeOK   string // "ok", "drop" or "" for no size check
+		problems int
+	}{
+		{
+			name:   "empty catalog",
+			now:    "2025-01-05 12:00",
+			status: "unhealthy", problems: 1,
+		},
+		{
+			name:    "healthy",
+			backups: daily,
+			now:     "2025-01-05 12:00",
+			status:  "healthy", sizeOK: "ok",
+		},
+		{
+			name:    "slot within the grace period is not missing yet",
+			backups: daily[1:],
+			now:     "2025-01-05 03:30",
+			status:  "healthy", sizeOK: "ok",
+		},
+		{
+			name:    "missing slot",
+			backups: []string{"2025-01-05 03:00", "2025-01-03 03:00", "2025-01-02 03:00"},
+			now:     "2025-01-05 12:00",
+			status:  "degraded", missing: []string{"2025-01-04 03:00"}, sizeOK: "ok", problems: 1,
+		},
+		{
+			name:    "backup outside the grace period does not fill a slot",
+			backups: []string{"2025-01-05 03:00", "2025-01-04 05:00", "2025-01-03 03:00", "2025-01-02 03:00"},
+			now:     "2025-01-05 12:00",
+			status:  "degraded", missing: []string{"2025-01-04 03:00"}, sizeOK: "ok", problems: 1,
+		},
+		{
+			name:    "slots before the oldest backup are not missing",
+			backups: []string{"2025-01-05 03:00"},
+			now:     "2025-01-05 12:00",
+			status:  "healthy",
+		},
+		{
+			name:    "stale",
+			backups: daily,
+			now:     "2025-01-06 12:00",
+			status:  "unhealthy", missing: []string{"2025-01-06 03:00"}, sizeOK: "ok", problems: 2,
+		},
+		{
+			name:    "size drop",
+			backups: daily,
+			sizes:   []int64{40, 100, 100, 100},
+			now:     "2025-01-05 12:00",
+			status:  "degraded", sizeOK: "drop", problems: 1,
+		},
+		{
+			name:    "size drop within the threshold",
+			backups: daily,
+			sizes:   []int64{60, 100, 100, 100},
+			now:     "2025-01-05 12:00",
+			status:  "healthy", sizeOK: "ok",
+		},
+		{
+			name:    "other formats are not compared",
+			backups: daily,
+			sizes:   []int64{40, 100, 100, 100},
+			formats: []dumpFormat{formatCustom, formatZstd, formatZstd, formatZstd},
+			now:     "2025-01-05 12:00",
+			status:  "healthy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backups := backupsAt(t, tt.backups...)
+			for i := range backups {
+				backups[i].Size = 100
+				if tt.sizes != nil {
+					backups[i].Size = tt.sizes[i]
+				}
+				backups[i].Format = formatZstd
+				if tt.formats != nil {
+					backups[i].Format = tt.formats[i]
+				}
+			}
+			now, err := time.Parse("2006-01-02 15:04", tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			st := checkBackupStatus(backups, opts, now)
+			if st.Status != tt.status {
+				t.Errorf("status = %s, want %s (problems %q)", st.Status, tt.status, st.Problems)
+			}
+			var missing []string
+			for _, slot := range st.MissingSlots {
+				missing = append(missing, slot.Format("2006-01-02 15:04"))
+			}
+			if !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("missing slots = %q, want %q", missing, tt.missing)
+			}
+			sizeOK := ""
+			if st.Size != nil {
+				sizeOK = "drop"
+				if st.Size.OK {
+					sizeOK = "ok"
+				}
+			}
+			if sizeOK != tt.sizeOK {
+				t.Errorf("size check = %q (%+v), want %q", sizeOK, st.Size, tt.sizeOK)
+			}
+			if len(st.Problems) != tt.problems {
+				t.Errorf("problems = %q, want %d", st.Problems, tt.problems)
+			}
+		})
+	}
+}
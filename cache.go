@@ -0,0 +1,233 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Download cache =====
+
+// cacheEntry is a backup kept in WORK_DIR/cache/<key>/ between runs. The key
+// covers the name, size and expected hash, so a re-uploaded backup with the
+// same name gets a new entry.
+type cacheEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	SHA256   string    `json:"sha256,omitempty"` // set once the download is complete
+	LastUsed time.Time `json:"lastUsed"`
+
+	dir string
+}
+
+const cacheEntryFile = "entry.json"
+
+func cacheDir(cfg *RestoreConfig) string {
+	return filepath.Join(cfg.WorkDir, "cache")
+}
+
+// cacheKey identifies the content of obj: the manifest hash if there is one,
+// otherwise its modification time in storage
+func cacheKey(obj BackupObject, manifest *backupManifest) string {
+	id := fmt.Sprintf("%s\x00%d\x00", obj.Name, obj.Size)
+	if manifest != nil {
+		id += manifest.SHA256
+	} else {
+		id += obj.ModTime.UTC().Format(time.RFC3339Nano)
+	}
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
+
+// path is the downloaded file of the entry
+func (e *cacheEntry) path() string {
+	return filepath.Join(e.dir, filepath.Base(e.Name))
+}
+
+// diskSize is what the entry occupies, including a partial download
+func (e *cacheEntry) diskSize() int64 {
+	var n int64
+	for _, p := range []string{e.path(), e.path() + ".part"} {
+		if info, err := os.Stat(p); err == nil {
+			n += info.Size()
+		}
+	}
+	return n
+}
+
+func (e *cacheEntry) save() error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(e.dir, cacheEntryFile), data, 0644)
+}
+
+// openCacheEntry returns the entry for obj, creating its directory if needed
+func openCacheEntry(cfg *RestoreConfig, obj BackupObject, manifest *backupManifest) (*cacheEntry, error) {
+	dir := filepath.Join(cacheDir(cfg), cacheKey(obj, manifest))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	e := &cacheEntry{Name: obj.Name, Size: obj.Size, dir: dir}
+	if data, err := os.ReadFile(filepath.Join(dir, cacheEntryFile)); err == nil {
+		json.Unmarshal(data, e)
+	}
+	e.LastUsed = time.Now()
+	if err := e.save(); err != nil {
+		return nil, fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return e, nil
+}
+
+// cached reports whether the entry holds the complete download
+func (e *cacheEntry) cached() bool {
+	if e.SHA256 == "" {
+		return false
+	}
+	info, err := os.Stat(e.path())
+	return err == nil && info.Size() == e.Size
+}
+
+// listCache returns the cache entries, least recently used first
+func listCache(cfg *RestoreConfig) []*cacheEntry {
+	dirs, _ := os.ReadDir(cacheDir(cfg))
+	var entries []*cacheEntry
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		e := &cacheEntry{dir: filepath.Join(cacheDir(cfg), d.Name())}
+		data, err := os.ReadFile(filepath.Join(e.dir, cacheEntryFile))
+		if err != nil || json.Unmarshal(data, e) != nil {
+			// Left behind by an interrupted run; evict it first
+			e.Name = d.Name()
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].LastUsed.Before(entries[j].LastUsed)
+	})
+	return entries
+}
+
+// evictCache removes least recently used entries other than keep until
+// enough returns true for the bytes freed so far. It returns the bytes freed.
+func evictCache(cfg *RestoreConfig, keep string, enough func(freed int64) bool) int64 {
+	var freed int64
+	for _, e := range listCache(cfg) {
+		if enough(freed) {
+			break
+		}
+		if e.dir == keep {
+			continue
+		}
+		size := e.diskSize()
+		if err := os.RemoveAll(e.dir); err != nil {
+			progress.printf("Warning: failed to evict %s from cache: %v", e.Name, err)
+			continue
+		}
+		progress.printf("Evicted %s from cache (%s)", e.Name, formatBytes(size))
+		freed += size
+	}
+	return freed
+}
+
+// trimCache evicts entries until the cache fits in cfg.CacheMaxSize
+func trimCache(cfg *RestoreConfig, keep string) {
+	if cfg.CacheMaxSize <= 0 {
+		return
+	}
+	var total int64
+	for _, e := range listCache(cfg) {
+		total += e.diskSize()
+	}
+	evictCache(cfg, keep, func(freed int64) bool {
+		return total-freed <= cfg.CacheMaxSize
+	})
+}
+
+// discardDownload releases a downloaded backup once it has been restored.
+// Cached files stay for the next run unless --no-cache was given; anything
+// else (pg_dump directories) is removed.
+func discardDownload(cfg *RestoreConfig, p string) {
+	dir := filepath.Dir(p)
+	if filepath.Dir(dir) != cacheDir(cfg) {
+		cleanup(p)
+		return
+	}
+	if cfg.NoCache {
+		cleanup(dir)
+		return
+	}
+	trimCache(cfg, dir)
+}
+
+// ===== Disk space preflight =====
+
+// spaceNeeded estimates the space a restore of filename takes in WORK_DIR
+// besides the download itself: a decrypted copy of encrypted backups and the
+// dump extracted from a 7z archive, which is cfg.DumpExpansion times larger.
+// gzip and zstd are decompressed on the fly and need nothing extra.
+func spaceNeeded(cfg *RestoreConfig, filename string, size int64) int64 {
+	var need int64
+	name := filename
+	if f := formatFromName(name); f == formatAge || f == formatGPG {
+		need += size
+		name = stripEncryptionSuffix(name)
+	}
+	if formatFromName(name) == format7z {
+		need += int64(float64(size) * cfg.DumpExpansion)
+	}
+	return need
+}
+
+// checkDiskSpace makes sure WORK_DIR has need bytes free, evicting cached
+// backups other than keep if that helps
+func checkDiskSpace(cfg *RestoreConfig, need int64, keep string) error {
+	if cfg.NoSpaceCheck || need <= 0 {
+		return nil
+	}
+	free, err := freeSpace(cfg.WorkDir)
+	if err != nil {
+		progress.printf("Warning: could not check free space in %s: %v", cfg.WorkDir, err)
+		return nil
+	}
+	if free < need {
+		free += evictCache(cfg, keep, func(freed int64) bool {
+			return free+freed >= need
+		})
+	}
+	if free < need {
+		return fmt.Errorf("not enough space in %s: need about %s, %s free (use --stream, a larger WORK_DIR, or --no-space-check)",
+			cfg.WorkDir, formatBytes(need), formatBytes(free))
+	}
+	progress.printf("Disk space OK: need about %s, %s free", formatBytes(need), formatBytes(free))
+	return nil
+}
+
+// parseSize parses a byte count such as 500M, 20G or 1T (binary units)
+func parseSize(arg string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(arg)), "B")
+	s = strings.TrimSuffix(s, "I")
+	mult := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			mult = int64(1) << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 500M or 20G)", arg)
+	}
+	return int64(n * float64(mult)), nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ===== Backup catalog =====
+
+// Backup is a backup in storage: a single file or a pg_dump directory.
+type Backup struct {
+	Name      string     `json:"name"`
+	Size      int64      `json:"size"`      // total bytes, summed over a directory's files
+	ModTime   time.Time  `json:"modTime"`   // last modification in storage
+	Timestamp time.Time  `json:"timestamp"` // from the file name, or ModTime if it has none
+	Database  string     `json:"database,omitempty"`
+	Format    dumpFormat `json:"format"`
+	Verified  bool       `json:"verified"` // a successful verify was recorded in storage
+	Sidecars  []string   `json:"sidecars,omitempty"`
+}
+
+// verifiedSuffix names the marker verify leaves next to a backup that passed
+const verifiedSuffix = ".verified.json"
+
+// sidecarSuffixes lists files stored next to a backup that belong to it
+var sidecarSuffixes = append([]string{verifiedSuffix}, manifestSuffixes...)
+
+// sidecarName returns the name of a sidecar of backup
+func sidecarName(backup, suffix string) string {
+	return strings.TrimSuffix(backup, "/") + suffix
+}
+
+// backupNamePattern matches names like mk1_2025-01-01_03-00.sql.7z or
+// mk1-20250101T030000.dump: a database name followed by a date and time.
+var backupNamePattern = regexp.MustCompile(
+	`^(.*?)[_-]?(\d{4})-?(\d{2})-?(\d{2})[_T-]?(\d{2})[-:]?(\d{2})(?:[-:]?(\d{2}))?`)
+
+// parseBackupName extracts the database name and timestamp from a backup name.
+// Timestamps are read in local time, matching the backup jobs' TZ.
+func parseBackupName(name string) (database string, ts time.Time, ok bool) {
+	m := backupNamePattern.FindStringSubmatch(path.Base(strings.TrimSuffix(name, "/")))
+	if m == nil {
+		return "", time.Time{}, false
+	}
+	var n [6]int
+	for i, s := range m[2:] {
+		if s != "" {
+			n[i], _ = strconv.Atoi(s)
+		}
+	}
+	ts = time.Date(n[0], time.Month(n[1]), n[2], n[3], n[4], n[5], 0, time.Local)
+	// Reject impossible dates that time.Date would normalise
+	if ts.Month() != time.Month(n[1]) || ts.Day() != n[2] || ts.Hour() != n[3] || ts.Minute() != n[4] {
+		return "", time.Time{}, false
+	}
+	return m[1], ts, true
+}
+
+// newCatalog groups storage objects into backups, newest first
+func newCatalog(objects []BackupObject) []Backup {
+	byName := make(map[string]*Backup)
+	var backups []*Backup
+	var rest []BackupObject
+	for _, obj := range objects {
+		name := backupNameFromObject(obj.Name)
+		if name == "" {
+			rest = append(rest, obj)
+			continue
+		}
+		b, ok := byName[name]
+		if !ok {
+			b = &Backup{Name: name, Format: formatFromName(name)}
+			byName[name] = b
+			backups = append(backups, b)
+		}
+		b.add(obj)
+	}
+	// Sidecars and the remaining files of pg_dump directories
+	for _, obj := range rest {
+		if b, suffix := sidecarOwner(byName, obj.Name); b != nil {
+			b.Sidecars = append(b.Sidecars, obj.Name)
+			if suffix == verifiedSuffix {
+				b.Verified = true
+			}
+			continue
+		}
+		for _, b := range backups {
+			if b.Format == formatDirectory && strings.HasPrefix(obj.Name, b.Name) {
+				b.add(obj)
+			}
+		}
+	}
+
+	catalog := make([]Backup, 0, len(backups))
+	for _, b := range backups {
+		if db, ts, ok := parseBackupName(b.Name); ok {
+			b.Database, b.Timestamp = db, ts
+		} else {
+			b.Timestamp = b.ModTime
+		}
+		catalog = append(catalog, *b)
+	}
+
+	sort.SliceStable(catalog, func(i, j int) bool {
+		if !catalog[i].Timestamp.Equal(catalog[j].Timestamp) {
+			return catalog[i].Timestamp.After(catalog[j].Timestamp)
+		}
+		return catalog[i].Name > catalog[j].Name
+	})
+	return catalog
+}
+
+// sidecarOwner returns the backup a sidecar object belongs to, if any
+func sidecarOwner(byName map[string]*Backup, name string) (*Backup, string) {
+	for _, suffix := range sidecarSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		base := strings.TrimSuffix(name, suffix)
+		if b, ok := byName[base]; ok {
+			return b, suffix
+		}
+		if b, ok := byName[base+"/"]; ok {
+			return b, suffix
+		}
+	}
+	return nil, ""
+}
+
+func (b *Backup) add(obj BackupObject) {
+	b.Size += obj.Size
+	if obj.ModTime.After(b.ModTime) {
+		b.ModTime = obj.ModTime
+	}
+}
+
+// backupFilter narrows the catalog by time and database
+type backupFilter struct {
+	Since    time.Time // keep backups taken at or after
+	Before   time.Time // keep backups taken before
+	Database string
+}
+
+func (f backupFilter) apply(backups []Backup) []Backup {
+	var out []Backup
+	for _, b := range backups {
+		if !f.Since.IsZero() && b.Timestamp.Before(f.Since) {
+			continue
+		}
+		if !f.Before.IsZero() && !b.Timestamp.Before(f.Before) {
+			continue
+		}
+		if f.Database != "" && b.Database != f.Database {
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// backupAt returns the newest backup taken at or before at, or nil
+func backupAt(backups []Backup, at time.Time) *Backup {
+	for i := range backups {
+		if !backups[i].Timestamp.After(at) {
+			return &backups[i]
+		}
+	}
+	return nil
+}
+
+// parseTimeArg parses a --since/--before/--at value: an RFC 3339 time, a local
+// date or date and time, or a duration ago such as 36h or 7d.
+func parseTimeArg(s string) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil {
+			return time.Now().AddDate(0, 0, -days), nil
+		}
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q (expected e.g. 2025-01-01, \"2025-01-01 03:00\", RFC 3339, 36h or 7d)", s)
+}
+
+// printBackupList prints the catalog as a numbered table or as JSON
+func printBackupList(backups []Backup, format string) {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if backups == nil {
+			backups = []Backup{}
+		}
+		enc.Encode(backups)
+		return
+	}
+
+	if len(backups) == 0 {
+		fmt.Println("No backups found.")
+		return
+	}
+	fmt.Println("\nAvailable backups:")
+	now := time.Now()
+	for i, b := range backups {
+		verified := ""
+		if b.Verified {
+			verified = "  verified"
+		}
+		fmt.Printf("  [%d] %-40s %10s  %-16s  %s ago%s\n", i+1, b.Name, formatBytes(b.Size),
+			b.Timestamp.Format("2006-01-02 15:04"), humanizeAge(now.Sub(b.Timestamp)), verified)
+	}
+}
+
+// humanizeAge renders a duration as a short age such as 45m, 6h or 3d
+func humanizeAge(d time.Duration) string {
+	switch {
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseBackupName(t *testing.T) {
+	local := func(y int, mo time.Month, d, h, mi, s int) time.Time {
+		return time.Date(y, mo, d, h, mi, s, 0, time.Local)
+	}
+	tests := []struct {
+		name     string
+		database string
+		ts       time.Time
+		ok       bool
+	}{
+		{"mk1_2025-01-01_03-00.sql.7z", "mk1", local(2025, 1, 1, 3, 0, 0), true},
+		{"mk1-20250101T030000.dump", "mk1", local(2025, 1, 1, 3, 0, 0), true},
+		{"mk1-20250101T030045.dump", "mk1", local(2025, 1, 1, 3, 0, 45), true},
+		{"backups/mk1_2025-12-31_23-59.sql.gz", "mk1", local(2025, 12, 31, 23, 59, 0), true},
+		{"mk1_2025-01-02_03-00/", "mk1", local(2025, 1, 2, 3, 0, 0), true},
+		{"my_db_2024-02-29_05-06.sql", "my_db", local(2024, 2, 29, 5, 6, 0), true},
+		{"2025-01-01_03-00.sql", "", local(2025, 1, 1, 3, 0, 0), true},
+
+		// Impossible dates are not normalised into valid ones
+		{"mk1_2025-02-29_03-00.sql", "", time.Time{}, false},
+		{"mk1_2025-02-30_03-00.sql", "", time.Time{}, false},
+		{"mk1_2025-13-01_03-00.sql", "", time.Time{}, false},
+		{"mk1_2025-00-10_03-00.sql", "", time.Time{}, false},
+		{"mk1_2025-04-31_03-00.sql", "", time.Time{}, false},
+		{"mk1_2025-01-01_24-00.sql", "", time.Time{}, false},
+		{"mk1_2025-01-01_03-60.sql", "", time.Time{}, false},
+		{"mk1-20250101T030060.dump", "", time.Time{}, false},
+
+		{"mk1.sql.gz", "", time.Time{}, false},
+		{"latest.dump", "", time.Time{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database, ts, ok := parseBackupName(tt.name)
+			if ok != tt.ok || database != tt.database || !ts.Equal(tt.ts) {
+				t.Errorf("parseBackupName(%q) = %q, %v, %v; want %q, %v, %v",
+					tt.name, database, ts, ok, tt.database, tt.ts, tt.ok)
+			}
+		})
+	}
+}
+
+func TestNewCatalog(t *testing.T) {
+	mod := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	objects := []BackupObject{
+		{Name: "mk1_2025-01-01_03-00.sql.7z", Size: 100, ModTime: mod},
+		{Name: "mk1_2025-01-01_03-00.sql.7z.manifest.json", Size: 1, ModTime: mod},
+		{Name: "mk1_2025-01-01_03-00.sql.7z.verified.json", Size: 1, ModTime: mod},
+		{Name: "mk1_2025-01-03_03-00.sql.zst", Size: 200, ModTime: mod},
+		{Name: "mk1_2025-01-02_03-00/toc.dat", Size: 10, ModTime: mod},
+		{Name: "mk1_2025-01-02_03-00/3001.dat.gz", Size: 20, ModTime: mod.Add(time.Hour)},
+		{Name: "mk1_2025-01-02_03-00.sha256", Size: 1, ModTime: mod},
+		{Name: "nightly.sql.gz", Size: 50, ModTime: mod.Add(2 * time.Hour)},
+		{Name: "README.txt", Size: 5, ModTime: mod},
+		{Name: "orphan.sql.gz.manifest.json", Size: 1, ModTime: mod},
+	}
+
+	catalog := newCatalog(objects)
+
+	type summary struct {
+		Name     string
+		Size     int64
+		Database string
+		Format   dumpFormat
+		Verified bool
+		Sidecars []string
+	}
+	var got []summary
+	for _, b := range catalog {
+		got = append(got, summary{b.Name, b.Size, b.Database, b.Format, b.Verified, b.Sidecars})
+	}
+	want := []summary{
+		// No date in the name: placed by its modification time
+		{"nightly.sql.gz", 50, "", formatGzip, false, nil},
+		{"mk1_2025-01-03_03-00.sql.zst", 200, "mk1", formatZstd, false, nil},
+		{"mk1_2025-01-02_03-00/", 30, "mk1", formatDirectory, false, []string{"mk1_2025-01-02_03-00.sha256"}},
+		{"mk1_2025-01-01_03-00.sql.7z", 100, "mk1", format7z, true,
+			[]string{"mk1_2025-01-01_03-00.sql.7z.manifest.json", "mk1_2025-01-01_03-00.sql.7z.verified.json"}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("newCatalog:\n got %+v\nwant %+v", got, want)
+	}
+
+	dir := catalog[2]
+	if !dir.ModTime.Equal(mod.Add(time.Hour)) {
+		t.Errorf("directory ModTime = %v, want its newest file's %v", dir.ModTime, mod.Add(time.Hour))
+	}
+	if nightly := catalog[0]; !nightly.Timestamp.Equal(nightly.ModTime) {
+		t.Errorf("undated backup Timestamp = %v, want ModTime %v", nightly.Timestamp, nightly.ModTime)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ===== Database =====
+
+// connectDB opens a connection to database using the PostgreSQL settings from cfg.
+// Unset fields fall back to the usual libpq environment (PGSSLMODE, ~/.pgpass, ...).
+func connectDB(ctx context.Context, cfg *RestoreConfig, database string) (*pgx.Conn, error) {
+	connCfg, err := pgx.ParseConfig("")
+	if err != nil {
+		return nil, fmt.Errorf("invalid connection settings: %w", err)
+	}
+
+	if cfg.PGHost != "" {
+		connCfg.Host = cfg.PGHost
+	}
+	if cfg.PGPort != "" {
+		port, err := strconv.ParseUint(cfg.PGPort, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q: %w", cfg.PGPort, err)
+		}
+		connCfg.Port = uint16(port)
+	}
+	if cfg.PGUser != "" {
+		connCfg.User = cfg.PGUser
+	}
+	if cfg.PGPassword != "" {
+		connCfg.Password = cfg.PGPassword
+	}
+	connCfg.Database = database
+
+	conn, err := pgx.ConnectConfig(ctx, connCfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s@%s:%d/%s: %w",
+			connCfg.User, connCfg.Host, connCfg.Port, database, err)
+	}
+	return conn, nil
+}
+
+// queryCount runs a query returning a single integer (typically COUNT(*)).
+func queryCount(ctx context.Context, conn *pgx.Conn, sql string, args ...any) (int, error) {
+	var n int
+	if err := conn.QueryRow(ctx, sql, args...).Scan(&n); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// tableExists reports whether a table exists in the public schema.
+func tableExists(ctx context.Context, conn *pgx.Conn, table string) (bool, error) {
+	var exists bool
+	err := conn.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM information_schema.tables WHERE table_schema = 'public' AND table_name = $1)`,
+		table,
+	).Scan(&exists)
+	return exists, err
+}
+
+// quoteIdent quotes an identifier (database, table, role) for use in SQL text.
+func quoteIdent(name string) string {
+	return pgx.Identifier{name}.Sanitize()
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+// ===== Decryption =====
+
+var (
+	errWrongKey      = errors.New("wrong password or key")
+	errCorruptBackup = errors.New("backup is corrupt")
+)
+
+const (
+	formatAge dumpFormat = "age"
+	formatGPG dumpFormat = "gpg"
+)
+
+var (
+	magicAge        = []byte("age-encryption.org/v1\n")
+	magicAgeArmor   = []byte(armor.Header)
+	magicPGPArmor   = []byte("-----BEGIN PGP MESSAGE-----")
+	pgpPacketStarts = []byte{0x84, 0x85, 0x8C, 0x8D, 0xC1, 0xC3} // (SK)ESK packet tags
+)
+
+// encryptedFormat reports which encryption format, if any, header starts with.
+func encryptedFormat(header []byte) dumpFormat {
+	switch {
+	case bytes.HasPrefix(header, magicAge), bytes.HasPrefix(header, magicAgeArmor):
+		return formatAge
+	case bytes.HasPrefix(header, magicPGPArmor):
+		return formatGPG
+	case len(header) > 0 && bytes.IndexByte(pgpPacketStarts, header[0]) >= 0:
+		return formatGPG
+	}
+	return ""
+}
+
+// stripEncryptionSuffix returns name without its .age/.gpg/.pgp/.asc suffix.
+func stripEncryptionSuffix(name string) string {
+	for _, ext := range []string{".age", ".gpg", ".pgp", ".asc"} {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// readSecret returns the value of env, or the trimmed content of the file
+// named by env_FILE.
+func readSecret(env string) (string, error) {
+	if v := os.Getenv(env); v != "" {
+		return v, nil
+	}
+	if p := os.Getenv(env + "_FILE"); p != "" {
+		v, err := readSecretFile(p)
+		if err != nil {
+			return "", fmt.Errorf("%s_FILE: %w", env, err)
+		}
+		return v, nil
+	}
+	return "", nil
+}
+
+// readSecretFile returns the trimmed content of a password file. A file that
+// cannot be read is an error rather than an empty password.
+func readSecretFile(p string) (string, error) {
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password file: %w", err)
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// decrypt wraps r in a decrypting reader for an age or GPG encrypted stream.
+// Errors distinguish a wrong key (errWrongKey) from damaged data (errCorruptBackup).
+func decrypt(cfg *RestoreConfig, format dumpFormat, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case formatAge:
+		return decryptAge(cfg, r)
+	case formatGPG:
+		return decryptGPG(cfg, r)
+	}
+	return nil, fmt.Errorf("%s is not an encryption format", format)
+}
+
+func decryptAge(cfg *RestoreConfig, r io.Reader) (io.ReadCloser, error) {
+	var identities []age.Identity
+	if cfg.AgeIdentityFile != "" {
+		f, err := os.Open(cfg.AgeIdentityFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read age identity: %w", err)
+		}
+		ids, err := age.ParseIdentities(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse age identity %s: %w", cfg.AgeIdentityFile, err)
+		}
+		identities = append(identities, ids...)
+	}
+	if cfg.AgeIdentity != "" {
+		ids, err := age.ParseIdentities(strings.NewReader(cfg.AgeIdentity))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse AGE_IDENTITY: %w", err)
+		}
+		identities = append(identities, ids...)
+	}
+	if cfg.BackupPassword != "" {
+		id, err := age.NewScryptIdentity(cfg.BackupPassword)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, id)
+	}
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("backup is age-encrypted; set AGE_IDENTITY_FILE, AGE_IDENTITY or BACKUP_PASSWORD")
+	}
+
+	br := bufio.NewReader(r)
+	if header, _ := br.Peek(len(magicAgeArmor)); bytes.Equal(header, magicAgeArmor) {
+		r = armor.NewReader(br)
+	} else {
+		r = br
+	}
+
+	dec, err := age.Decrypt(r, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("%w: no age identity matches this backup", errWrongKey)
+		}
+		return nil, fmt.Errorf("%w: invalid age header: %v", errCorruptBackup, err)
+	}
+	// The header was unwrapped with our key, so any later failure is damaged data
+	return io.NopCloser(&corruptOnError{r: dec}), nil
+}
+
+// corruptOnError marks read errors other than EOF as corruption.
+type corruptOnError struct {
+	r io.Reader
+}
+
+func (c *corruptOnError) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", errCorruptBackup, err)
+	}
+	return n, err
+}
+
+// gpgReader streams gpg's stdout and reports its exit status at EOF.
+type gpgReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	home   string
+	done   bool
+	err    error
+}
+
+func decryptGPG(cfg *RestoreConfig, r io.Reader) (io.ReadCloser, error) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		return nil, fmt.Errorf("required tool 'gpg' not found in PATH")
+	}
+
+	g := &gpgReader{}
+	args := []string{"--batch", "--yes", "--quiet", "--no-tty"}
+
+	// Use a private keyring when a key file is given
+	if cfg.GPGKeyFile != "" {
+		home, err := os.MkdirTemp("", "yamisskey-gnupg-")
+		if err != nil {
+			return nil, err
+		}
+		g.home = home
+		imp := exec.Command("gpg", "--batch", "--homedir", home, "--import", cfg.GPGKeyFile)
+		if output, err := imp.CombinedOutput(); err != nil {
+			os.RemoveAll(home)
+			return nil, fmt.Errorf("failed to import GPG key %s: %s", cfg.GPGKeyFile, strings.TrimSpace(string(output)))
+		}
+		args = append(args, "--homedir", home)
+	}
+
+	passphrase := cfg.GPGPassphrase
+	if passphrase == "" {
+		passphrase = cfg.BackupPassword
+	}
+
+	var passR *os.File
+	if passphrase != "" {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			g.cleanup()
+			return nil, err
+		}
+		go func() {
+			pw.WriteString(passphrase)
+			pw.Close()
+		}()
+		passR = pr
+		args = append(args, "--pinentry-mode", "loopback", "--passphrase-fd", "3")
+	}
+	args = append(args, "--decrypt")
+
+	g.cmd = exec.Command("gpg", args...)
+	g.cmd.Stdin = r
+	g.cmd.Stderr = &g.stderr
+	if passR != nil {
+		g.cmd.ExtraFiles = []*os.File{passR}
+	}
+
+	stdout, err := g.cmd.StdoutPipe()
+	if err != nil {
+		g.cleanup()
+		return nil, err
+	}
+	g.stdout = stdout
+	if err := g.cmd.Start(); err != nil {
+		g.cleanup()
+		return nil, fmt.Errorf("failed to start gpg: %w", err)
+	}
+	if passR != nil {
+		passR.Close()
+	}
+	return g, nil
+}
+
+func (g *gpgReader) Read(p []byte) (int, error) {
+	if g.done {
+		if g.err != nil {
+			return 0, g.err
+		}
+		return 0, io.EOF
+	}
+	n, err := g.stdout.Read(p)
+	if err == io.EOF {
+		if werr := g.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (g *gpgReader) Close() error {
+	g.stdout.Close()
+	g.wait()
+	g.cleanup()
+	return nil
+}
+
+func (g *gpgReader) wait() error {
+	if !g.done {
+		g.done = true
+		if err := g.cmd.Wait(); err != nil {
+			g.err = classifyGPGError(g.stderr.String())
+		}
+	}
+	return g.err
+}
+
+func (g *gpgReader) cleanup() {
+	if g.home != "" {
+		os.RemoveAll(g.home)
+	}
+}
+
+// classifyGPGError maps gpg's diagnostics to a wrong key or a damaged file.
+func classifyGPGError(stderr string) error {
+	msg := strings.TrimSpace(stderr)
+	lower := strings.ToLower(msg)
+	for _, s := range []string{"no secret key", "bad session key", "bad passphrase", "no passphrase given"} {
+		if strings.Contains(lower, s) {
+			return fmt.Errorf("%w: %s", errWrongKey, msg)
+		}
+	}
+	return fmt.Errorf("%w: %s", errCorruptBackup, msg)
+}
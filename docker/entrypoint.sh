@@ -12,6 +12,10 @@ case "${MODE:-}" in
         # Run check command
         exec yamisskey-doctor check ${CHECK_URL:-} ${CHECK_ARGS:-}
         ;;
+    backup)
+        # Run backup command once
+        exec yamisskey-doctor backup ${BACKUP_ARGS:-}
+        ;;
     verify)
         # Run verify command once
         exec yamisskey-doctor verify --latest ${VERIFY_ARGS:-}
@@ -24,6 +28,10 @@ case "${MODE:-}" in
         # Run repair command
         exec yamisskey-doctor repair ${REPAIR_ARGS:-}
         ;;
+    status)
+        # Run backup status check
+        exec yamisskey-doctor backups status ${STATUS_ARGS:-}
+        ;;
     cron)
         # Setup cron for scheduled verify
         echo "Setting up cron for scheduled verify..."
@@ -49,12 +57,14 @@ case "${MODE:-}" in
             echo ""
             echo "Commands:"
             echo "  check    - Check Misskey API/Streaming health"
+            echo "  backup   - Dump and upload the database"
             echo "  verify   - Verify backup can be restored"
             echo "  restore  - Restore database from backup"
             echo "  repair   - Repair database inconsistencies"
+            echo "  backups  - Monitor backups in storage"
             echo ""
             echo "Environment variables:"
-            echo "  MODE=check|verify|restore|repair|cron"
+            echo "  MODE=check|backup|verify|restore|repair|status|cron"
             echo "  CHECK_URL=https://example.com"
             echo "  MISSKEY_TOKEN=xxx"
             echo ""
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ===== Dump completeness =====
+
+// DumpCheck describes the structure of a plain SQL dump. A dump cut off
+// mid-upload can load without a single ERROR, silently missing every table
+// after the cut; pg_dump's header, "dump complete" trailer and the \. ending
+// each COPY block tell a complete dump from a truncated one.
+type DumpCheck struct {
+	OK            bool   `json:"ok"`
+	Header        bool   `json:"header"`  // "-- PostgreSQL database dump" before any statement
+	Trailer       bool   `json:"trailer"` // "-- PostgreSQL database dump complete" after the last statement
+	CopyBlocks    int    `json:"copyBlocks"`
+	CopyRows      int64  `json:"copyRows"`
+	OpenCopy      string `json:"openCopy,omitempty"` // table whose COPY data has no \. terminator
+	DumpVersion   string `json:"pgDumpVersion,omitempty"`
+	ServerVersion string `json:"serverVersion,omitempty"`
+	Bytes         int64  `json:"bytes"`
+	Detail        string `json:"detail,omitempty"`
+
+	// COPY rows of every table the dump creates, keyed by name ("user", or
+	// "schema.table" outside public)
+	TableRows map[string]int64 `json:"tableRows,omitempty"`
+}
+
+func (c *DumpCheck) String() string {
+	facts := []string{fmt.Sprintf("%d COPY blocks, %d rows", c.CopyBlocks, c.CopyRows)}
+	// Only the version number, not the distribution build
+	if v := strings.Fields(c.DumpVersion); len(v) > 0 {
+		facts = append(facts, "pg_dump "+v[0])
+	}
+	if v := strings.Fields(c.ServerVersion); len(v) > 0 {
+		facts = append(facts, "server "+v[0])
+	}
+	line := fmt.Sprintf("%s  %s", boolToStatus(c.OK), strings.Join(facts, ", "))
+	if c.Detail != "" {
+		line += "; " + c.Detail
+	}
+	return line
+}
+
+// dumpScanLine bounds how much of each line the scanner keeps; statements it
+// looks at are far shorter, COPY rows need not be kept at all
+const dumpScanLine = 64 << 10
+
+// dumpScanner checks a plain SQL dump written to it
+type dumpScanner struct {
+	check     DumpCheck
+	line      []byte
+	long      bool   // the current line was longer than dumpScanLine
+	started   bool   // a statement was seen
+	copyTable string // inside the data of this COPY
+	copyRows  int64  // rows of the current COPY so far
+}
+
+func newDumpScanner() *dumpScanner {
+	return &dumpScanner{
+		line:  make([]byte, 0, 4096),
+		check: DumpCheck{TableRows: map[string]int64{}},
+	}
+}
+
+func (s *dumpScanner) Write(p []byte) (int, error) {
+	n := len(p)
+	s.check.Bytes += int64(n)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			s.buffer(p)
+			break
+		}
+		s.buffer(p[:i])
+		s.endLine()
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+func (s *dumpScanner) buffer(p []byte) {
+	if room := dumpScanLine - len(s.line); len(p) > room {
+		p = p[:room]
+		s.long = true
+	}
+	s.line = append(s.line, p...)
+}
+
+func (s *dumpScanner) endLine() {
+	line := string(s.line)
+	long := s.long
+	s.line = s.line[:0]
+	s.long = false
+
+	if s.copyTable != "" {
+		if line == `\.` && !long {
+			s.endCopy()
+			s.check.CopyBlocks++
+		} else {
+			s.copyRows++
+			s.check.CopyRows++
+		}
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(line, "-- "):
+		s.comment(strings.TrimSpace(line[3:]))
+	case line == "--", strings.TrimSpace(line) == "":
+	case strings.HasPrefix(line, `\`):
+		// psql meta-commands such as pg_dump's \restrict and \connect
+	default:
+		s.started = true
+		s.check.Trailer = false
+		if table, ok := copyFromStdin(line, long); ok {
+			s.copyTable = table
+		} else if table, ok := createTable(line); ok {
+			s.check.TableRows[table] += 0
+		}
+	}
+}
+
+// endCopy adds the rows of the current COPY to its table
+func (s *dumpScanner) endCopy() {
+	s.check.TableRows[s.copyTable] += s.copyRows
+	s.copyTable = ""
+	s.copyRows = 0
+}
+
+// comment picks the header, trailer and versions out of pg_dump's comments
+func (s *dumpScanner) comment(text string) {
+	switch {
+	case text == "PostgreSQL database dump", text == "PostgreSQL database cluster dump":
+		if !s.started {
+			s.check.Header = true
+		}
+	case text == "PostgreSQL database dump complete", text == "PostgreSQL database cluster dump complete":
+		s.check.Trailer = true
+	case strings.HasPrefix(text, "Dumped from database version "):
+		if s.check.ServerVersion == "" {
+			s.check.ServerVersion = strings.TrimPrefix(text, "Dumped from database version ")
+		}
+	case strings.HasPrefix(text, "Dumped by pg_dump version "), strings.HasPrefix(text, "Dumped by pg_dumpall version "):
+		if s.check.DumpVersion == "" {
+			s.check.DumpVersion = text[strings.Index(text, "version ")+len("version "):]
+		}
+	}
+}
+
+// copyFromStdin returns the table of a "COPY <table> (...) FROM stdin;" line.
+// A line cut at dumpScanLine is taken as one if it starts like one.
+func copyFromStdin(line string, long bool) (string, bool) {
+	if !strings.HasPrefix(line, "COPY ") || !(long || strings.HasSuffix(line, " FROM stdin;")) {
+		return "", false
+	}
+	return tableName(strings.TrimPrefix(line, "COPY "))
+}
+
+// createTable returns the table of a "CREATE [UNLOGGED] TABLE <table> ..." line
+func createTable(line string) (string, bool) {
+	for _, prefix := range []string{"CREATE TABLE ", "CREATE UNLOGGED TABLE "} {
+		if strings.HasPrefix(line, prefix) {
+			return tableName(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return "", false
+}
+
+// tableName reads the possibly quoted, schema-qualified table name at the
+// start of s, as pg_dump writes it (public."user"), and returns it unquoted,
+// without the public schema
+func tableName(s string) (string, bool) {
+	var parts []string
+	for {
+		var part string
+		if strings.HasPrefix(s, `"`) {
+			// "" inside a quoted identifier is a literal quote
+			var b strings.Builder
+			i := 1
+			for ; i < len(s); i++ {
+				if s[i] == '"' {
+					if i+1 < len(s) && s[i+1] == '"' {
+						b.WriteByte('"')
+						i++
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[i])
+			}
+			if i >= len(s) {
+				return "", false
+			}
+			part, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexAny(s, ". (")
+			if end < 0 {
+				end = len(s)
+			}
+			part, s = s[:end], s[end:]
+		}
+		if part == "" {
+			return "", false
+		}
+		parts = append(parts, part)
+		if !strings.HasPrefix(s, ".") {
+			break
+		}
+		s = s[1:]
+	}
+	if len(parts) == 2 && parts[0] == "public" {
+		parts = parts[1:]
+	}
+	return strings.Join(parts, "."), true
+}
+
+// finish returns the result once the whole dump has been written
+func (s *dumpScanner) finish() *DumpCheck {
+	if len(s.line) > 0 {
+		s.endLine()
+	}
+	var problems []string
+	if s.copyTable != "" {
+		s.check.OpenCopy = s.copyTable
+		problems = append(problems, fmt.Sprintf(`COPY data of %s has no \. terminator`, s.copyTable))
+		s.endCopy()
+	}
+	c := s.check
+	if !c.Header {
+		problems = append([]string{"no pg_dump header"}, problems...)
+	}
+	if !c.Trailer {
+		problems = append(problems, `no "dump complete" trailer (truncated?)`)
+	}
+	dumpMajor, ok1 := pgMajorVersion(c.DumpVersion)
+	serverMajor, ok2 := pgMajorVersion(c.ServerVersion)
+	if ok1 && ok2 && dumpMajor < serverMajor {
+		problems = append(problems, fmt.Sprintf("pg_dump %s cannot have dumped server %s", c.DumpVersion, c.ServerVersion))
+	}
+
+	c.OK = len(problems) == 0
+	if !c.OK {
+		c.Detail = strings.Join(problems, ", ")
+	}
+	return &c
+}
+
+// pgMajorVersion returns the major version of "16.4 (Debian ...)" as 16, or
+// of "9.6.24" as 9.6
+func pgMajorVersion(v string) (float64, bool) {
+	fields := strings.FieldsFunc(v, func(r rune) bool { return r == '.' || r == ' ' })
+	if len(fields) == 0 {
+		return 0, false
+	}
+	major, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return 0, false
+	}
+	if major < 10 && len(fields) > 1 {
+		minor, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, false
+		}
+		return float64(major) + float64(minor)/10, true
+	}
+	return float64(major), true
+}
+
+// scanDumpFile checks a plain SQL dump on disk
+func scanDumpFile(p string) (*DumpCheck, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s := newDumpScanner()
+	if _, err := io.Copy(s, f); err != nil {
+		return nil, fmt.Errorf("failed to scan %s: %w", p, err)
+	}
+	return s.finish(), nil
+}
+
+// scanDump reads a whole dump through the scanner without loading it: a SQL
+// script as it is, a pg_dump archive as the script pg_restore -f - makes of it
+func scanDump(cfg *RestoreConfig, dump *dumpSource) (*DumpCheck, error) {
+	var r io.Reader
+	switch {
+	case dump.Format != formatPlain:
+		script, err := archiveScript(cfg, dump)
+		if err != nil {
+			return nil, err
+		}
+		defer script.Close()
+		r = script
+	case dump.Path != "":
+		return scanDumpFile(dump.Path)
+	default:
+		r = dump.Reader
+	}
+
+	s := newDumpScanner()
+	if _, err := io.Copy(s, r); err != nil {
+		return nil, fmt.Errorf("failed to read dump: %w", err)
+	}
+	return s.finish(), nil
+}
+
+// loadChecked hands dump to load after checking that a plain SQL dump is
+// complete. A script on disk is scanned before load runs and not loaded if it
+// is truncated; a streamed one is scanned as load reads it. The check is nil
+// for pg_dump archives, which pg_restore checks itself, and when load fails.
+func loadChecked(dump *dumpSource, load func(*dumpSource) error) (*DumpCheck, error) {
+	if dump.Format != formatPlain {
+		return nil, load(dump)
+	}
+
+	if dump.Path != "" {
+		progress.printf("Checking %s is a complete dump...", dump.Path)
+		check, err := scanDumpFile(dump.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !check.OK {
+			return check, fmt.Errorf("%w: %s", errCorruptBackup, check.Detail)
+		}
+		return check, load(dump)
+	}
+
+	s := newDumpScanner()
+	streamed := &dumpSource{Format: dump.Format, Reader: io.TeeReader(dump.Reader, s)}
+	if err := load(streamed); err != nil {
+		return nil, err
+	}
+	check := s.finish()
+	if !check.OK {
+		return check, fmt.Errorf("%w: %s", errCorruptBackup, check.Detail)
+	}
+	return check, nil
+}
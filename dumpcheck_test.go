@@ -0,0 +1,274 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testDump builds a plain SQL dump the way pg_dump writes it
+func testDump(body ...string) string {
+	return strings.Join(append([]string{
+		"--",
+		"-- PostgreSQL database dump",
+		"--",
+		"",
+		`\restrict abc123`,
+		"",
+		"-- Dumped from database version 16.4 (Debian 16.4-1.pgdg120+1)",
+		"-- Dumped by pg_dump version 16.6 (Debian 16.6-1.pgdg120+1)",
+		"",
+		"SET statement_timeout = 0;",
+	}, body...), "\n") + "\n"
+}
+
+var dumpTrailer = []string{
+	"",
+	`\unrestrict abc123`,
+	"",
+	"--",
+	"-- PostgreSQL database dump complete",
+	"--",
+}
+
+func scanString(s string) *DumpCheck {
+	sc := newDumpScanner()
+	sc.Write([]byte(s))
+	return sc.finish()
+}
+
+func TestDumpScanner(t *testing.T) {
+	schema := []string{
+		`CREATE TABLE public."user" (`,
+		`    id character varying(32) NOT NULL`,
+		`);`,
+		`CREATE UNLOGGED TABLE public.note (`,
+		`    id character varying(32) NOT NULL`,
+		`);`,
+		`CREATE TABLE public.meta (`,
+		`    id character varying(32) NOT NULL`,
+		`);`,
+	}
+	copyUser := []string{
+		`COPY public."user" (id, username) FROM stdin;`,
+		"a1\talice",
+		"a2\tbob",
+		`\.`,
+	}
+	copyNote := []string{
+		`COPY public.note (id, "userId", text) FROM stdin;`,
+		"n1\ta1\thello",
+		"n2\ta1\t\\\\. is not the end",
+		"n3\ta2\t\\N",
+		`\.`,
+	}
+	lines := func(parts ...[]string) []string {
+		var all []string
+		for _, p := range parts {
+			all = append(all, p...)
+		}
+		return all
+	}
+
+	tests := []struct {
+		name   string
+		dump   string
+		ok     bool
+		detail string // substring of Detail
+		check  func(t *testing.T, c *DumpCheck)
+	}{
+		{
+			name: "complete",
+			dump: testDump(lines(schema, copyUser, copyNote, dumpTrailer)...),
+			ok:   true,
+			check: func(t *testing.T, c *DumpCheck) {
+				if !c.Header || !c.Trailer || c.CopyBlocks != 2 || c.CopyRows != 5 || c.OpenCopy != "" {
+					t.Errorf("got %+v", c)
+				}
+				want := map[string]int64{"user": 2, "note": 3, "meta": 0}
+				if !reflect.DeepEqual(c.TableRows, want) {
+					t.Errorf("TableRows = %v, want %v", c.TableRows, want)
+				}
+				if c.DumpVersion != "16.6 (Debian 16.6-1.pgdg120+1)" || c.ServerVersion != "16.4 (Debian 16.4-1.pgdg120+1)" {
+					t.Errorf("versions = %q, %q", c.DumpVersion, c.ServerVersion)
+				}
+				if got := c.String(); got != "OK  2 COPY blocks, 5 rows, pg_dump 16.6, server 16.4" {
+					t.Errorf("String() = %q", got)
+				}
+			},
+		},
+		{
+			name: "no final newline",
+			dump: strings.TrimSuffix(testDump(lines(schema, copyUser, dumpTrailer)...), "\n"),
+			ok:   true,
+		},
+		{
+			name:   "missing trailer",
+			dump:   testDump(lines(schema, copyUser, copyNote)...),
+			detail: `no "dump complete" trailer (truncated?)`,
+		},
+		{
+			name:   "statement after the trailer",
+			dump:   testDump(lines(schema, copyUser, dumpTrailer, []string{"DROP TABLE public.note;"})...),
+			detail: `no "dump complete" trailer`,
+		},
+		{
+			name:   "truncated inside COPY data",
+			dump:   testDump(lines(schema, copyUser, copyNote[:3])...),
+			detail: `COPY data of note has no \. terminator`,
+			check: func(t *testing.T, c *DumpCheck) {
+				if c.OpenCopy != "note" || c.CopyBlocks != 1 || c.CopyRows != 4 {
+					t.Errorf("got %+v", c)
+				}
+				// Rows read before the cut still count
+				if c.TableRows["note"] != 2 {
+					t.Errorf("TableRows[note] = %d, want 2", c.TableRows["note"])
+				}
+				if !strings.Contains(c.Detail, "no \"dump complete\" trailer") {
+					t.Errorf("Detail = %q", c.Detail)
+				}
+			},
+		},
+		{
+			name:   "truncated mid-line",
+			dump:   strings.TrimSuffix(testDump(lines(schema, copyUser, copyNote[:2])...), "\n") + "\tpartial",
+			detail: `COPY data of note has no \. terminator`,
+		},
+		{
+			name:   "unterminated COPY followed by a trailer comment",
+			dump:   testDump(lines(schema, copyUser[:3], dumpTrailer)...),
+			detail: `COPY data of user has no \. terminator`,
+		},
+		{
+			name:   "no header",
+			dump:   strings.Join(lines(schema, copyUser, dumpTrailer), "\n") + "\n",
+			detail: "no pg_dump header",
+		},
+		{
+			name:   "header after a statement",
+			dump:   "SET x = 1;\n" + testDump(lines(copyUser, dumpTrailer)...),
+			detail: "no pg_dump header",
+		},
+		{
+			name:   "empty",
+			dump:   "",
+			detail: "no pg_dump header",
+		},
+		{
+			name: "pg_dump older than the server",
+			dump: strings.Replace(testDump(lines(copyUser, dumpTrailer)...),
+				"Dumped by pg_dump version 16.6", "Dumped by pg_dump version 15.8", 1),
+			detail: "pg_dump 15.8",
+		},
+		{
+			name: "pg_dumpall cluster dump",
+			dump: strings.Join([]string{
+				"--",
+				"-- PostgreSQL database cluster dump",
+				"--",
+				"CREATE ROLE misskey;",
+				"--",
+				"-- PostgreSQL database cluster dump complete",
+				"--",
+			}, "\n") + "\n",
+			ok: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := scanString(tt.dump)
+			if c.OK != tt.ok {
+				t.Errorf("OK = %v, want %v (detail %q)", c.OK, tt.ok, c.Detail)
+			}
+			if !strings.Contains(c.Detail, tt.detail) {
+				t.Errorf("Detail = %q, want it to contain %q", c.Detail, tt.detail)
+			}
+			if c.Bytes != int64(len(tt.dump)) {
+				t.Errorf("Bytes = %d, want %d", c.Bytes, len(tt.dump))
+			}
+			if tt.check != nil {
+				tt.check(t, c)
+			}
+		})
+	}
+}
+
+// The scan must not depend on how the stream is cut into writes
+func TestDumpScannerSplitWrites(t *testing.T) {
+	dump := testDump(append([]string{
+		`COPY public."user" (id) FROM stdin;`,
+		"a1",
+		strings.Repeat("x", dumpScanLine+10), // longer than what the scanner keeps
+		`\.`,
+		"COPY " + strings.Repeat("y", dumpScanLine) + " (id) FROM stdin;",
+		`\.`,
+	}, dumpTrailer...)...)
+	want := scanString(dump)
+	if !want.OK || want.CopyRows != 2 || want.CopyBlocks != 2 {
+		t.Fatalf("whole write: %+v", want)
+	}
+
+	for _, size := range []int{1, 2, 7, 4096} {
+		sc := newDumpScanner()
+		for i := 0; i < len(dump); i += size {
+			end := min(i+size, len(dump))
+			sc.Write([]byte(dump[i:end]))
+		}
+		if got := sc.finish(); !reflect.DeepEqual(got, want) {
+			t.Errorf("writes of %d bytes:\n got %+v\nwant %+v", size, got, want)
+		}
+	}
+}
+
+func TestTableName(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{`public.note (id, "userId") FROM stdin;`, "note", true},
+		{`public."user" (id) FROM stdin;`, "user", true},
+		{`"user" (`, "user", true},
+		{`note`, "note", true},
+		{`misskey.note (id) FROM stdin;`, "misskey.note", true},
+		{`"Misskey"."Note" (`, "Misskey.Note", true},
+		{`public."say ""hi""" (`, `say "hi"`, true},
+		{`public."a.b" (`, "a.b", true},
+		{`public."with space" (`, "with space", true},
+		{`"unterminated (`, "", false},
+		{`public. (`, "", false},
+		{` (id)`, "", false},
+		{``, "", false},
+	}
+	for _, tt := range tests {
+		got, ok := tableName(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("tableName(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestPGMajorVersion(t *testing.T) {
+	tests := []struct {
+		in   string
+		want float64
+		ok   bool
+	}{
+		{"16.4 (Debian 16.4-1.pgdg120+1)", 16, true},
+		{"17.2", 17, true},
+		{"10.23", 10, true},
+		{"9.6.24", 9.6, true},
+		{"9.4", 9.4, true},
+		{"15", 15, true},
+		{"", 0, false},
+		{"devel", 0, false},
+		{"9.x", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := pgMajorVersion(tt.in)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("pgMajorVersion(%q) = %v, %v; want %v, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ===== Ephemeral verification cluster =====
+
+// ephemeralStartTimeout bounds how long pg_ctl waits for the cluster to accept
+// connections
+const ephemeralStartTimeout = 60
+
+// ephemeralPort only names the socket file: the cluster does not listen on TCP
+const ephemeralPort = 5432
+
+// maxSocketPath is the longest path a unix socket can have (sun_path)
+const maxSocketPath = 103
+
+// pgBinGlobs are where distributions install the server binaries that are not
+// in PATH (initdb and pg_ctl on Debian and RHEL)
+var pgBinGlobs = []string{
+	"/usr/lib/postgresql/*/bin",
+	"/usr/pgsql-*/bin",
+	"/opt/homebrew/opt/postgresql@*/bin",
+	"/usr/local/opt/postgresql@*/bin",
+}
+
+// ephemeralCluster is a private PostgreSQL cluster in a temporary directory.
+// It trusts local connections but listens only on a unix socket in a 0700
+// directory, so no other local user can reach the copy of production it
+// holds, and runs without fsync: its data is thrown away.
+type ephemeralCluster struct {
+	dir       string // removed by stop
+	socketDir string // dir, or a shorter directory if its socket path is too long
+	binDir    string
+	version   string
+	asOwner   func(*exec.Cmd) // runs a command as the cluster owner
+}
+
+// findPGBinDir returns the directory with initdb and pg_ctl: dir if given,
+// then PATH, then the newest of pgBinGlobs
+func findPGBinDir(dir string) (string, error) {
+	has := func(d string) bool {
+		for _, tool := range []string{"initdb", "pg_ctl"} {
+			if _, err := os.Stat(filepath.Join(d, tool)); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	if dir != "" {
+		if !has(dir) {
+			return "", fmt.Errorf("initdb and pg_ctl not found in PG_BIN_DIR %s", dir)
+		}
+		return dir, nil
+	}
+	if p, err := exec.LookPath("initdb"); err == nil && has(filepath.Dir(p)) {
+		return filepath.Dir(p), nil
+	}
+
+	var found []string
+	for _, pattern := range pgBinGlobs {
+		matches, _ := filepath.Glob(pattern)
+		for _, m := range matches {
+			if has(m) {
+				found = append(found, m)
+			}
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("initdb and pg_ctl not found in PATH or %s (install the PostgreSQL server package or set PG_BIN_DIR)",
+			strings.Join(pgBinGlobs, ", "))
+	}
+	// Newest major version: /usr/lib/postgresql/16/bin before .../9.6/bin
+	sort.Slice(found, func(i, j int) bool {
+		return binDirVersion(found[i]) > binDirVersion(found[j])
+	})
+	return found[0], nil
+}
+
+// binDirVersion reads the major version out of an install path such as
+// /usr/lib/postgresql/16/bin or /usr/pgsql-16/bin
+func binDirVersion(dir string) float64 {
+	for _, part := range strings.FieldsFunc(dir, func(r rune) bool { return r == '/' || r == '-' || r == '@' }) {
+		if v, err := strconv.ParseFloat(part, 64); err == nil {
+			return v
+		}
+	}
+	return 0
+}
+
+// useEphemeralCluster starts a cluster and points cfg at it if cfg.Ephemeral.
+// Call the returned function once verification is done.
+func useEphemeralCluster(cfg *RestoreConfig) (func(), error) {
+	if !cfg.Ephemeral {
+		return func() {}, nil
+	}
+	c, err := startEphemeralCluster(cfg)
+	if err != nil {
+		return nil, err
+	}
+	c.use(cfg)
+	return c.stop, nil
+}
+
+// startEphemeralCluster initdbs a cluster under cfg.WorkDir with cfg.PGUser as
+// its superuser, so that dumps owned by it load as they are, and starts it
+func startEphemeralCluster(cfg *RestoreConfig) (*ephemeralCluster, error) {
+	binDir, err := findPGBinDir(cfg.PGBinDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(cfg.WorkDir, "verify-cluster-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster directory: %w", err)
+	}
+	c := &ephemeralCluster{dir: dir, socketDir: dir, binDir: binDir}
+	fail := func(err error) (*ephemeralCluster, error) {
+		c.stop()
+		return nil, err
+	}
+	if len(socketPath(dir)) > maxSocketPath {
+		if c.socketDir, err = os.MkdirTemp("", "yd-pg-"); err != nil {
+			return fail(fmt.Errorf("failed to create socket directory: %w", err))
+		}
+	}
+	if c.asOwner, err = clusterOwner(dir, c.socketDir); err != nil {
+		return fail(err)
+	}
+
+	if out, err := exec.Command(filepath.Join(binDir, "pg_ctl"), "--version").Output(); err == nil {
+		c.version = strings.TrimSpace(string(out))
+	}
+	progress.printf("Creating ephemeral cluster with %s in %s...", c.version, dir)
+
+	data := c.dataDir()
+	initdb := c.command("initdb",
+		"-D", data,
+		"-U", cfg.PGUser,
+		"--auth=trust",
+		"--encoding=UTF8",
+		"--locale=C",
+		"--no-sync",
+	)
+	if out, err := initdb.CombinedOutput(); err != nil {
+		return fail(fmt.Errorf("initdb failed: %v: %s", err, strings.TrimSpace(string(out))))
+	}
+
+	// No TCP: with trust authentication any local user could connect through
+	// it. The socket directory is private to the cluster owner (and root).
+	settings := fmt.Sprintf(`
+# yamisskey-doctor verify --ephemeral: throwaway cluster
+port = %d
+listen_addresses = ''
+unix_socket_directories = %s
+unix_socket_permissions = 0700
+fsync = off
+synchronous_commit = off
+full_page_writes = off
+max_wal_size = '4GB'
+`, ephemeralPort, quoteLiteral(c.socketDir))
+	if err := appendFile(filepath.Join(data, "postgresql.conf"), settings); err != nil {
+		return fail(fmt.Errorf("failed to configure cluster: %w", err))
+	}
+
+	start := c.command("pg_ctl",
+		"-D", data,
+		"-l", c.logFile(),
+		"-w", "-t", strconv.Itoa(ephemeralStartTimeout),
+		"start",
+	)
+	if out, err := start.CombinedOutput(); err != nil {
+		return fail(fmt.Errorf("failed to start cluster: %v: %s%s", err, strings.TrimSpace(string(out)), c.logTail()))
+	}
+	progress.printf("Ephemeral cluster listening on %s", socketPath(c.socketDir))
+	return c, nil
+}
+
+// command prepares a server binary of the cluster to run as its owner
+func (c *ephemeralCluster) command(tool string, args ...string) *exec.Cmd {
+	cmd := exec.Command(filepath.Join(c.binDir, tool), args...)
+	if c.asOwner != nil {
+		c.asOwner(cmd)
+	}
+	return cmd
+}
+
+func (c *ephemeralCluster) dataDir() string { return filepath.Join(c.dir, "data") }
+func (c *ephemeralCluster) logFile() string { return filepath.Join(c.dir, "postgres.log") }
+
+// logTail returns the end of the server log for error messages
+func (c *ephemeralCluster) logTail() string {
+	data, err := os.ReadFile(c.logFile())
+	if err != nil || len(data) == 0 {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) > 10 {
+		lines = lines[len(lines)-10:]
+	}
+	return "\n" + strings.Join(lines, "\n")
+}
+
+// use points cfg at the cluster: verification connects to its socket instead
+// of POSTGRES_HOST
+func (c *ephemeralCluster) use(cfg *RestoreConfig) {
+	cfg.PGHost = c.socketDir
+	cfg.PGPort = strconv.Itoa(ephemeralPort)
+	cfg.PGPassword = ""
+}
+
+// socketPath returns the path of the cluster's socket in dir
+func socketPath(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf(".s.PGSQL.%d", ephemeralPort))
+}
+
+// stop shuts the cluster down without a checkpoint and removes its directory
+func (c *ephemeralCluster) stop() {
+	if _, err := os.Stat(filepath.Join(c.dataDir(), "postmaster.pid")); err == nil {
+		progress.printf("Stopping ephemeral cluster...")
+		stop := c.command("pg_ctl",
+			"-D", c.dataDir(),
+			"-m", "immediate",
+			"-w", "-t", strconv.Itoa(ephemeralStartTimeout),
+			"stop",
+		)
+		if out, err := stop.CombinedOutput(); err != nil {
+			progress.printf("Warning: failed to stop ephemeral cluster: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+	cleanup(c.dir, c.socketDir)
+}
+
+// appendFile appends text to the file at p
+func appendFile(p, text string) error {
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
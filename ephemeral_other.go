@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "os/exec"
+
+// clusterOwner runs initdb and pg_ctl as the current user on this platform
+func clusterOwner(dir, socketDir string) (func(*exec.Cmd), error) {
+	return func(*exec.Cmd) {}, nil
+}
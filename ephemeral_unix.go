@@ -0,0 +1,47 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// clusterOwner returns how to run initdb and pg_ctl, which refuse to run as
+// root: as root, commands run as the postgres user the server package creates
+// and dir and socketDir are handed to it
+func clusterOwner(dir, socketDir string) (func(*exec.Cmd), error) {
+	if os.Geteuid() != 0 {
+		return func(*exec.Cmd) {}, nil
+	}
+	u, err := user.Lookup("postgres")
+	if err != nil {
+		return nil, fmt.Errorf("initdb cannot run as root and there is no postgres user to run it as: %w", err)
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	for _, d := range []string{dir, socketDir} {
+		err = filepath.Walk(d, func(p string, _ os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Chown(p, uid, gid)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to hand %s to the postgres user: %w", d, err)
+		}
+	}
+	return func(cmd *exec.Cmd) {
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)},
+		}
+		// initdb changes into HOME; root's is not readable to postgres
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "HOME="+dir)
+	}, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// ===== Dump formats =====
+
+type dumpFormat string
+
+const (
+	format7z        dumpFormat = "7z"
+	formatGzip      dumpFormat = "gzip"
+	formatZstd      dumpFormat = "zstd"
+	formatPlain     dumpFormat = "plain"     // pg_dump -Fp (SQL script)
+	formatCustom    dumpFormat = "custom"    // pg_dump -Fc
+	formatDirectory dumpFormat = "directory" // pg_dump -Fd
+)
+
+var (
+	magic7z     = []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}
+	magicGzip   = []byte{0x1F, 0x8B}
+	magicZstd   = []byte{0x28, 0xB5, 0x2F, 0xFD}
+	magicCustom = []byte("PGDMP")
+)
+
+// formatFromName guesses the dump format from a backup name, or returns "" if
+// the name does not look like a backup. Directory dumps are named with a
+// trailing slash.
+func formatFromName(name string) dumpFormat {
+	switch {
+	case strings.HasSuffix(name, ".age"):
+		return formatAge
+	case strings.HasSuffix(name, ".gpg"), strings.HasSuffix(name, ".pgp"), strings.HasSuffix(name, ".asc"):
+		return formatGPG
+	case strings.HasSuffix(name, "/"):
+		return formatDirectory
+	case strings.HasSuffix(name, ".7z"):
+		return format7z
+	case strings.HasSuffix(name, ".sql.gz"):
+		return formatGzip
+	case strings.HasSuffix(name, ".sql.zst"):
+		return formatZstd
+	case strings.HasSuffix(name, ".sql"):
+		return formatPlain
+	case strings.HasSuffix(name, ".dump"):
+		return formatCustom
+	}
+	return ""
+}
+
+// sniffFormat identifies a dump from its first bytes. Anything unrecognised is
+// treated as a plain SQL script.
+func sniffFormat(header []byte) dumpFormat {
+	switch {
+	case bytes.HasPrefix(header, magic7z):
+		return format7z
+	case bytes.HasPrefix(header, magicGzip):
+		return formatGzip
+	case bytes.HasPrefix(header, magicZstd):
+		return formatZstd
+	case bytes.HasPrefix(header, magicCustom):
+		return formatCustom
+	}
+	if format := encryptedFormat(header); format != "" {
+		return format
+	}
+	return formatPlain
+}
+
+// sniffLen is how many leading bytes sniffFormat needs to tell formats apart.
+const sniffLen = 64
+
+// detectFileFormat identifies a local dump file or pg_dump directory.
+func detectFileFormat(p string) (dumpFormat, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		if _, err := os.Stat(filepath.Join(p, "toc.dat")); err != nil {
+			return "", fmt.Errorf("%s is not a pg_dump directory (no toc.dat)", p)
+		}
+		return formatDirectory, nil
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return sniffFormat(header[:n]), nil
+}
+
+// backupNameFromObject maps a storage object to the backup it belongs to, or ""
+// if it is not part of a backup. Files of a pg_dump directory collapse into the
+// directory name.
+func backupNameFromObject(name string) string {
+	if path.Base(name) == "toc.dat" {
+		return path.Dir(name) + "/"
+	}
+	if formatFromName(name) == "" || strings.HasSuffix(name, "/") {
+		return ""
+	}
+	return name
+}
+
+// decompress wraps r in a decompressor for a gzip or zstd stream.
+func decompress(format dumpFormat, r io.Reader) (io.ReadCloser, error) {
+	switch format {
+	case formatGzip:
+		return gzip.NewReader(r)
+	case formatZstd:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("%s is not a compression format", format)
+}
+
+// compress wraps w in a gzip or zstd compressor
+func compress(format dumpFormat, w io.Writer) (io.WriteCloser, error) {
+	switch format {
+	case formatGzip:
+		return gzip.NewWriter(w), nil
+	case formatZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("%s is not a compression format", format)
+}
+
+// ===== Dump loading =====
+
+// dumpSource is a dump ready to load: a plain SQL script or pg_dump archive,
+// either on disk (Path) or as a stream (Reader).
+type dumpSource struct {
+	Format dumpFormat // formatPlain, formatCustom or formatDirectory
+	Path   string
+	Reader io.Reader
+
+	closers   []io.Closer
+	tempPaths []string
+}
+
+// Close releases open readers and removes files extracted for this dump.
+func (d *dumpSource) Close() error {
+	var firstErr error
+	for i := len(d.closers) - 1; i >= 0; i-- {
+		if err := d.closers[i].Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	cleanup(d.tempPaths...)
+	return firstErr
+}
+
+// openDumpStream peels encryption and compression layers off a sequential
+// stream until a SQL script or pg_dump custom archive remains. closers are
+// released when the returned dump is closed, or immediately on error.
+func openDumpStream(cfg *RestoreConfig, r io.Reader, closers ...io.Closer) (*dumpSource, error) {
+	fail := func(err error) (*dumpSource, error) {
+		(&dumpSource{closers: closers}).Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return fail(err)
+	}
+
+	switch format := sniffFormat(header); format {
+	case formatGzip, formatZstd:
+		rc, err := decompress(format, br)
+		if err != nil {
+			return fail(fmt.Errorf("%w: %s: %v", errCorruptBackup, format, err))
+		}
+		return openDumpStream(cfg, rc, append(closers, rc)...)
+
+	case formatAge, formatGPG:
+		rc, err := decrypt(cfg, format, br)
+		if err != nil {
+			return fail(err)
+		}
+		return openDumpStream(cfg, rc, append(closers, rc)...)
+
+	case format7z:
+		return fail(fmt.Errorf("nested 7z archives need random access and cannot be streamed"))
+
+	case formatCustom:
+		return &dumpSource{Format: formatCustom, Reader: br, closers: closers}, nil
+	}
+
+	return &dumpSource{Format: formatPlain, Reader: br, closers: closers}, nil
+}
+
+// prepareDump turns a local backup (archive, encrypted or compressed script,
+// pg_dump file or directory) into something loadable. 7z archives are extracted
+// and encrypted files decrypted next to the original; gzip and zstd are
+// decompressed on the fly.
+func prepareDump(cfg *RestoreConfig, p string) (*dumpSource, error) {
+	format, err := detectFileFormat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	switch format {
+	case formatPlain, formatCustom, formatDirectory:
+		return &dumpSource{Format: format, Path: p}, nil
+
+	case format7z:
+		extracted, err := extractBackup(cfg, p)
+		if err != nil {
+			return nil, err
+		}
+		dump, err := prepareDump(cfg, extracted)
+		if err != nil {
+			cleanup(extracted)
+			return nil, err
+		}
+		dump.tempPaths = append(dump.tempPaths, extracted)
+		return dump, nil
+
+	case formatGzip, formatZstd:
+		f, err := os.Open(p)
+		if err != nil {
+			return nil, err
+		}
+		return openDumpStream(cfg, f, f)
+
+	case formatAge, formatGPG:
+		decrypted, err := decryptFile(cfg, format, p)
+		if err != nil {
+			return nil, err
+		}
+		dump, err := prepareDump(cfg, decrypted)
+		if err != nil {
+			cleanup(filepath.Dir(decrypted))
+			return nil, err
+		}
+		dump.tempPaths = append(dump.tempPaths, filepath.Dir(decrypted))
+		return dump, nil
+	}
+
+	return nil, fmt.Errorf("unsupported dump format: %s", format)
+}
+
+// dumpLoadCommand builds the command loading dump into database: psql for SQL
+// scripts and pg_restore for pg_dump archives. Parallel jobs are only possible
+// when pg_restore can seek, i.e. the archive is on disk.
+func dumpLoadCommand(cfg *RestoreConfig, database string, dump *dumpSource, stopOnError bool) (*exec.Cmd, error) {
+	tool := "psql"
+	if dump.Format != formatPlain {
+		tool = "pg_restore"
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("required tool '%s' not found in PATH", tool)
+	}
+
+	args := []string{
+		"-h", cfg.PGHost,
+		"-p", cfg.PGPort,
+		"-U", cfg.PGUser,
+		"-d", database,
+	}
+
+	switch dump.Format {
+	case formatPlain:
+		if stopOnError {
+			args = append(args, "-v", "ON_ERROR_STOP=1")
+		}
+		if dump.Path != "" {
+			args = append(args, "-f", dump.Path)
+		}
+	case formatCustom, formatDirectory:
+		if stopOnError {
+			args = append(args, "--exit-on-error")
+		}
+		if cfg.NoOwner {
+			args = append(args, "--no-owner", "--no-privileges")
+		}
+		if dump.Format == formatDirectory {
+			args = append(args, "-Fd")
+		}
+		if dump.Path != "" && cfg.Jobs > 1 {
+			args = append(args, "-j", strconv.Itoa(cfg.Jobs))
+		}
+		if dump.Path != "" {
+			args = append(args, dump.Path)
+		}
+	default:
+		return nil, fmt.Errorf("cannot load %s dump", dump.Format)
+	}
+
+	cmd := exec.Command(tool, args...)
+	cmd.Env = os.Environ()
+	if cfg.PGPassword != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+cfg.PGPassword)
+	}
+	if dump.Path == "" {
+		cmd.Stdin = dump.Reader
+	}
+	return cmd, nil
+}
+
+// decryptFile decrypts p into a temporary directory next to it so that formats
+// needing random access (7z) still work, returning the decrypted path. The
+// caller removes the directory.
+func decryptFile(cfg *RestoreConfig, format dumpFormat, p string) (string, error) {
+	name := stripEncryptionSuffix(filepath.Base(p))
+	if name == filepath.Base(p) {
+		name += ".decrypted"
+	}
+
+	in, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	progress.printf("Decrypting %s...", filepath.Base(p))
+	dec, err := decrypt(cfg, format, in)
+	if err != nil {
+		return "", err
+	}
+	defer dec.Close()
+
+	dir, err := os.MkdirTemp(filepath.Dir(p), ".decrypt-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create decryption directory: %w", err)
+	}
+	out := filepath.Join(dir, name)
+	f, err := os.Create(out)
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	_, err = io.Copy(f, dec)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to decrypt %s: %w", filepath.Base(p), err)
+	}
+	return out, nil
+}
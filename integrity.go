@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ===== Misskey integrity rules =====
+
+// Severities of integrity checks
+const (
+	severityError   = "error"   // fails IntegrityOK, and a restore before the swap
+	severityWarning = "warning" // reported only
+)
+
+// integrityRule is one check of restored Misskey data. Query counts the rows
+// that matter to the rule; the check passes if the count is Want.
+type integrityRule struct {
+	Name     string
+	Severity string
+	Tables   []string // the rule is not run if one of them is missing
+	Query    string
+	Want     int
+	Detail   string // describes the count
+}
+
+// misskeyRules are run on every verified or restored database. Foreign keys
+// cover replies, renotes and followings in a healthy database, so dangling
+// ones mean the load went wrong; Misskey itself leaves deleted files in
+// note.fileIds and notes of deleted users behind, so those only warn.
+var misskeyRules = []integrityRule{
+	{
+		Name:     "meta_row",
+		Severity: severityError,
+		Tables:   []string{"meta"},
+		Query:    `SELECT COUNT(*) FROM meta`,
+		Want:     1,
+		Detail:   "%d meta rows (expected exactly 1)",
+	},
+	{
+		Name:     "user_profile",
+		Severity: severityError,
+		Tables:   []string{"user", "user_profile"},
+		Query: `SELECT COUNT(*) FROM "user" u WHERE u.host IS NULL
+			AND NOT EXISTS (SELECT 1 FROM user_profile p WHERE p."userId" = u.id)`,
+		Detail: "%d local users without a user_profile row",
+	},
+	{
+		Name:     "user_keypair",
+		Severity: severityError,
+		Tables:   []string{"user", "user_keypair"},
+		Query: `SELECT COUNT(*) FROM "user" u WHERE u.host IS NULL
+			AND NOT EXISTS (SELECT 1 FROM user_keypair k WHERE k."userId" = u.id)`,
+		Detail: "%d local users without a user_keypair row",
+	},
+	{
+		Name:     "note_reply",
+		Severity: severityError,
+		Tables:   []string{"note"},
+		Query: `SELECT COUNT(*) FROM note n WHERE n."replyId" IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM note r WHERE r.id = n."replyId")`,
+		Detail: "%d notes replying to a missing note",
+	},
+	{
+		Name:     "note_renote",
+		Severity: severityError,
+		Tables:   []string{"note"},
+		Query: `SELECT COUNT(*) FROM note n WHERE n."renoteId" IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM note r WHERE r.id = n."renoteId")`,
+		Detail: "%d notes renoting a missing note",
+	},
+	{
+		Name:     "orphan_notes",
+		Severity: severityWarning,
+		Tables:   []string{"note", "user"},
+		Query:    `SELECT COUNT(*) FROM note WHERE "userId" NOT IN (SELECT id FROM "user")`,
+		Detail:   "%d orphan notes",
+	},
+	{
+		Name:     "note_files",
+		Severity: severityWarning,
+		Tables:   []string{"note", "drive_file"},
+		Query: `SELECT COUNT(*) FROM (SELECT DISTINCT unnest(n."fileIds") AS id FROM note n) f
+			WHERE NOT EXISTS (SELECT 1 FROM drive_file d WHERE d.id = f.id)`,
+		Detail: "%d files attached to notes missing from drive_file",
+	},
+	{
+		Name:     "following_users",
+		Severity: severityError,
+		Tables:   []string{"following", "user"},
+		Query: `SELECT COUNT(*) FROM following f
+			WHERE NOT EXISTS (SELECT 1 FROM "user" u WHERE u.id = f."followerId")
+			OR NOT EXISTS (SELECT 1 FROM "user" u WHERE u.id = f."followeeId")`,
+		Detail: "%d followings of or by a missing user",
+	},
+}
+
+// runIntegrityRules runs rules on conn. A rule whose tables are missing or
+// whose query fails fails with its severity: a check that could not run is
+// never taken as passed.
+func runIntegrityRules(ctx context.Context, conn *pgx.Conn, rules []integrityRule) []VerifyCheck {
+	exists := map[string]bool{}
+	var checks []VerifyCheck
+	for _, rule := range rules {
+		missing := ""
+		for _, table := range rule.Tables {
+			ok, seen := exists[table]
+			if !seen {
+				var err error
+				if ok, err = tableExists(ctx, conn, table); err != nil {
+					ok = false
+				}
+				exists[table] = ok
+			}
+			if !ok {
+				missing = table
+				break
+			}
+		}
+		if missing != "" {
+			checks = append(checks, VerifyCheck{
+				Name:     rule.Name,
+				Severity: rule.Severity,
+				Detail:   fmt.Sprintf("not run: table '%s' missing", missing),
+			})
+			continue
+		}
+
+		n, err := queryCount(ctx, conn, rule.Query)
+		if err != nil {
+			check := failedCheck(rule.Name, err)
+			check.Severity = rule.Severity
+			checks = append(checks, check)
+			continue
+		}
+		checks = append(checks, VerifyCheck{
+			Name:     rule.Name,
+			Severity: rule.Severity,
+			OK:       n == rule.Want,
+			Detail:   fmt.Sprintf(rule.Detail, n),
+		})
+	}
+	return checks
+}
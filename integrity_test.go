@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCheckStatus(t *testing.T) {
+	tests := []struct {
+		check VerifyCheck
+		want  string
+	}{
+		{VerifyCheck{OK: true, Severity: severityError}, "OK"},
+		{VerifyCheck{OK: true}, "OK"},
+		{VerifyCheck{Severity: severityError}, "FAIL"},
+		{VerifyCheck{Severity: severityWarning}, "WARN"},
+		{VerifyCheck{}, "WARN"},
+	}
+	for _, tt := range tests {
+		if got := tt.check.status(); got != tt.want {
+			t.Errorf("%+v.status() = %s, want %s", tt.check, got, tt.want)
+		}
+	}
+}
+
+func TestIntegrityOK(t *testing.T) {
+	ok := VerifyCheck{Name: "table_count", OK: true, Severity: severityError}
+	tests := []struct {
+		name   string
+		checks []VerifyCheck
+		want   bool
+	}{
+		{"no checks", nil, true},
+		{"all passed", []VerifyCheck{ok, {Name: "user_count", OK: true}}, true},
+		{"warning failed", []VerifyCheck{ok, {Name: "orphan_notes", Severity: severityWarning}}, true},
+		{"error failed", []VerifyCheck{ok, {Name: "meta_row", Severity: severityError}}, false},
+		{"count query failed", []VerifyCheck{ok, func() VerifyCheck {
+			check := failedCheck("user_count", fmt.Errorf("relation does not exist"))
+			check.Severity = severityError
+			return check
+		}()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := integrityOK(tt.checks); got != tt.want {
+				t.Errorf("integrityOK() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Every rule has a severity, the tables it needs and one count in its detail
+func TestMisskeyRules(t *testing.T) {
+	names := map[string]bool{}
+	for _, rule := range misskeyRules {
+		if names[rule.Name] {
+			t.Errorf("duplicate rule %s", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Severity != severityError && rule.Severity != severityWarning {
+			t.Errorf("%s: severity %q", rule.Name, rule.Severity)
+		}
+		if len(rule.Tables) == 0 {
+			t.Errorf("%s: no tables", rule.Name)
+		}
+		if strings.Count(rule.Detail, "%d") != 1 || strings.Count(rule.Detail, "%") != 1 {
+			t.Errorf("%s: detail %q needs exactly one %%d", rule.Name, rule.Detail)
+		}
+	}
+}
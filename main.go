@@ -3,18 +3,24 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"sort"
+	"runtime"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/bodgit/sevenzip"
 	"github.com/gorilla/websocket"
+	"github.com/jackc/pgx/v5"
 )
 
 var version = "dev"
@@ -411,10 +417,25 @@ func cmdCheck(args []string) int {
 
 type RestoreConfig struct {
 	// Storage settings
-	StorageType   string // "r2" or "linode"
-	R2Prefix      string
-	LinodeBucket  string
-	LinodePrefix  string
+	StorageType     string // "r2", "linode", "local:/path", "sftp://..." or "s3://bucket/prefix"
+	R2AccountID     string
+	R2Endpoint      string
+	R2Bucket        string
+	R2Prefix        string
+	R2AccessKey     string
+	R2SecretKey     string
+	LinodeEndpoint  string
+	LinodeBucket    string
+	LinodePrefix    string
+	LinodeAccessKey string
+	LinodeSecretKey string
+	S3Endpoint      string
+	S3Region        string
+	S3AccessKey     string
+	S3SecretKey     string
+	SFTPKeyFile     string
+	SFTPPassword    string
+	SFTPKnownHosts  string
 
 	// PostgreSQL settings
 	PGHost     string
@@ -428,22 +449,102 @@ type RestoreConfig struct {
 	WorkDir    string // working directory for downloads
 	DryRun     bool
 	Force      bool
+	Stream     bool // pipe storage → decompress → psql without files in WorkDir
+	Jobs       int  // pg_restore parallel jobs for custom/directory dumps
+
+	// Download cache and disk space preflight
+	NoCache       bool    // remove downloads after use instead of keeping them in WORK_DIR/cache
+	CacheMaxSize  int64   // bytes; least recently used downloads are evicted beyond this
+	NoSpaceCheck  bool    // skip the free space check before downloading
+	DumpExpansion float64 // expected size of an extracted 7z dump relative to the archive
+
+	// Decryption keys
+	BackupPassword  string // 7z archive password, age passphrase or GPG symmetric passphrase
+	AgeIdentityFile string
+	AgeIdentity     string
+	GPGKeyFile      string
+	GPGPassphrase   string
+
+	// Misskey service orchestration around restore
+	StopMisskey       bool   // stop the Misskey containers through the Docker API
+	DockerSocket      string // Docker Engine API unix socket
+	MisskeyContainers string // comma-separated container names
+	ComposeProject    string // or: compose project whose ComposeServices are stopped
+	ComposeServices   string
+	PreRestoreHook    string // shell commands run before / after the restore
+	PostRestoreHook   string
+
+	// Ownership of restored objects
+	NoOwner bool              // strip owners and grants; objects belong to PGUser
+	RoleMap map[string]string // or: rename roles in owners and grants
+
+	// Private cluster verify restores into instead of POSTGRES_HOST
+	Ephemeral bool
+	PGBinDir  string // initdb and pg_ctl; PATH and the usual install locations if empty
+
+	// Misskey the restored migrations are compared against
+	MisskeyURL           string // /api/meta is asked for the version
+	MisskeyVersion       string // or: the version itself
+	MisskeyVersionSource string // set by resolveMisskeyVersion
 }
 
-func loadRestoreConfigFromEnv() *RestoreConfig {
+func loadRestoreConfigFromEnv() (*RestoreConfig, error) {
 	cfg := &RestoreConfig{
-		StorageType:  getEnvOrDefault("STORAGE_TYPE", "r2"),
-		R2Prefix:     getEnvOrDefault("R2_PREFIX", "backups"),
-		LinodeBucket: getEnvOrDefault("LINODE_BUCKET", "yamisskey-backup"),
-		LinodePrefix: getEnvOrDefault("LINODE_PREFIX", "backups"),
-		PGHost:       getEnvOrDefault("POSTGRES_HOST", "localhost"),
-		PGPort:       getEnvOrDefault("POSTGRES_PORT", "5432"),
-		PGUser:       getEnvOrDefault("POSTGRES_USER", "misskey"),
-		PGPassword:   os.Getenv("PGPASSWORD"),
-		PGDatabase:   getEnvOrDefault("POSTGRES_DB", "mk1"),
-		WorkDir:      getEnvOrDefault("WORK_DIR", "/tmp/yamisskey-restore"),
+		StorageType:     getEnvOrDefault("STORAGE_TYPE", "r2"),
+		R2AccountID:     os.Getenv("R2_ACCOUNT_ID"),
+		R2Endpoint:      os.Getenv("R2_ENDPOINT"),
+		R2Bucket:        os.Getenv("R2_BUCKET"),
+		R2Prefix:        getEnvOrDefault("R2_PREFIX", "backups"),
+		R2AccessKey:     os.Getenv("R2_ACCESS_KEY_ID"),
+		R2SecretKey:     os.Getenv("R2_SECRET_ACCESS_KEY"),
+		LinodeEndpoint:  os.Getenv("LINODE_ENDPOINT"),
+		LinodeBucket:    getEnvOrDefault("LINODE_BUCKET", "yamisskey-backup"),
+		LinodePrefix:    getEnvOrDefault("LINODE_PREFIX", "backups"),
+		LinodeAccessKey: os.Getenv("LINODE_ACCESS_KEY_ID"),
+		LinodeSecretKey: os.Getenv("LINODE_SECRET_ACCESS_KEY"),
+		S3Endpoint:      os.Getenv("S3_ENDPOINT"),
+		S3Region:        os.Getenv("S3_REGION"),
+		S3AccessKey:     os.Getenv("S3_ACCESS_KEY_ID"),
+		S3SecretKey:     os.Getenv("S3_SECRET_ACCESS_KEY"),
+		SFTPKeyFile:     os.Getenv("SFTP_KEY_FILE"),
+		SFTPPassword:    os.Getenv("SFTP_PASSWORD"),
+		SFTPKnownHosts:  getEnvOrDefault("SFTP_KNOWN_HOSTS", filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")),
+		PGHost:          getEnvOrDefault("POSTGRES_HOST", "localhost"),
+		PGPort:          getEnvOrDefault("POSTGRES_PORT", "5432"),
+		PGUser:          getEnvOrDefault("POSTGRES_USER", "misskey"),
+		PGPassword:      os.Getenv("PGPASSWORD"),
+		PGDatabase:      getEnvOrDefault("POSTGRES_DB", "mk1"),
+		WorkDir:         getEnvOrDefault("WORK_DIR", "/tmp/yamisskey-restore"),
+		Jobs:            runtime.NumCPU(),
+		CacheMaxSize:    envSize("CACHE_MAX_SIZE", 20<<30),
+		DumpExpansion:   envFloat("DUMP_EXPANSION", 8),
+		AgeIdentityFile: os.Getenv("AGE_IDENTITY_FILE"),
+		GPGKeyFile:      os.Getenv("GPG_KEY_FILE"),
+
+		DockerSocket:      getEnvOrDefault("DOCKER_SOCKET", "/var/run/docker.sock"),
+		MisskeyContainers: os.Getenv("MISSKEY_CONTAINERS"),
+		ComposeProject:    os.Getenv("MISSKEY_COMPOSE_PROJECT"),
+		ComposeServices:   getEnvOrDefault("MISSKEY_COMPOSE_SERVICES", "web,worker"),
+		PreRestoreHook:    os.Getenv("PRE_RESTORE_HOOK"),
+		PostRestoreHook:   os.Getenv("POST_RESTORE_HOOK"),
+
+		PGBinDir: os.Getenv("PG_BIN_DIR"),
+
+		MisskeyURL:     os.Getenv("MISSKEY_URL"),
+		MisskeyVersion: os.Getenv("MISSKEY_VERSION"),
+	}
+
+	var err error
+	if cfg.BackupPassword, err = readSecret("BACKUP_PASSWORD"); err != nil {
+		return nil, err
+	}
+	if cfg.AgeIdentity, err = readSecret("AGE_IDENTITY"); err != nil {
+		return nil, err
 	}
-	return cfg
+	if cfg.GPGPassphrase, err = readSecret("GPG_PASSPHRASE"); err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 func getEnvOrDefault(key, defaultVal string) string {
@@ -453,147 +554,439 @@ func getEnvOrDefault(key, defaultVal string) string {
 	return defaultVal
 }
 
-// listBackups lists available backups from storage
-func listBackups(cfg *RestoreConfig) ([]string, error) {
-	var remote string
-	if cfg.StorageType == "linode" {
-		remote = fmt.Sprintf("linode:%s/%s", cfg.LinodeBucket, cfg.LinodePrefix)
-	} else {
-		remote = fmt.Sprintf("r2:%s", cfg.R2Prefix)
+// envSize reads a byte count such as 20G from the environment
+func envSize(key string, defaultVal int64) int64 {
+	if v := os.Getenv(key); v != "" {
+		if n, err := parseSize(v); err == nil {
+			return n
+		}
+		fmt.Fprintf(os.Stderr, "Warning: ignoring invalid %s=%q\n", key, v)
 	}
+	return defaultVal
+}
 
-	cmd := exec.Command("rclone", "ls", remote)
-	output, err := cmd.Output()
+// envFloat reads a number from the environment
+func envFloat(key string, defaultVal float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil && f >= 0 {
+			return f
+		}
+		fmt.Fprintf(os.Stderr, "Warning: ignoring invalid %s=%q\n", key, v)
+	}
+	return defaultVal
+}
+
+// listBackups lists available backups from storage, newest first
+func listBackups(ctx context.Context, store Storage) ([]Backup, error) {
+	objects, err := store.List(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list backups: %w", err)
 	}
+	return newCatalog(objects), nil
+}
 
-	var backups []string
-	lines := strings.Split(string(output), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
-			continue
+// downloadBackup downloads a backup file (or pg_dump directory) from storage.
+// Files are kept in the download cache (WORK_DIR/cache), hashed while
+// downloading and checked against their sidecar manifest, if any; on a
+// mismatch the digest is returned along with the error. Release the returned
+// path with discardDownload.
+func downloadBackup(ctx context.Context, cfg *RestoreConfig, store Storage, filename string) (string, *backupDigest, error) {
+	// Create work directory
+	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
+		return "", nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+
+	if formatFromName(filename) == formatDirectory {
+		localPath := filepath.Join(cfg.WorkDir, filepath.Base(filename))
+		if err := downloadDirectory(ctx, cfg, store, filename, localPath); err != nil {
+			cleanup(localPath)
+			return "", nil, err
 		}
-		// rclone ls format: "  12345 filename.sql.7z"
-		parts := strings.Fields(line)
-		if len(parts) >= 2 {
-			filename := parts[len(parts)-1]
-			if strings.HasSuffix(filename, ".sql.7z") {
-				backups = append(backups, filename)
-			}
+		progress.printf("Downloaded: %s", localPath)
+		return localPath, nil, nil
+	}
+
+	info, err := store.Stat(ctx, filename)
+	if err != nil {
+		return "", nil, fmt.Errorf("backup not found: %w", err)
+	}
+	manifest, err := loadStoredManifest(ctx, store, filename)
+	if err != nil {
+		return "", nil, err
+	}
+
+	entry, err := openCacheEntry(cfg, *info, manifest)
+	if err != nil {
+		return "", nil, err
+	}
+	localPath := entry.path()
+
+	var sum string
+	if entry.cached() {
+		progress.printf("Using cached %s", localPath)
+		digest, err := hashLocalFile(localPath)
+		if err == nil && digest.SHA256 != entry.SHA256 {
+			err = fmt.Errorf("cached file changed on disk")
+		}
+		if err != nil {
+			progress.printf("Warning: discarding cached %s: %v", filename, err)
+			cleanup(localPath)
+		} else {
+			sum = digest.SHA256
 		}
 	}
 
-	// Sort by name (which includes date) descending
-	sort.Sort(sort.Reverse(sort.StringSlice(backups)))
+	if sum == "" {
+		need := info.Size + spaceNeeded(cfg, filename, info.Size)
+		if part, err := os.Stat(localPath + ".part"); err == nil {
+			need -= part.Size()
+		}
+		if err := checkDiskSpace(cfg, need, entry.dir); err != nil {
+			return "", nil, err
+		}
 
-	return backups, nil
-}
+		progress.printf("Downloading %s (%s)...", filename, formatBytes(info.Size))
+		sum, err = downloadFile(ctx, store, *info, localPath)
+		if err != nil {
+			return "", nil, err
+		}
+		progress.printf("Downloaded: %s (sha256 %s)", localPath, sum)
 
-// downloadBackup downloads a backup file from storage
-func downloadBackup(cfg *RestoreConfig, filename string) (string, error) {
-	// Create work directory
-	if err := os.MkdirAll(cfg.WorkDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create work directory: %w", err)
+		entry.SHA256 = sum
+		if err := entry.save(); err != nil {
+			progress.printf("Warning: failed to update cache entry: %v", err)
+		}
+	} else if err := checkDiskSpace(cfg, spaceNeeded(cfg, filename, info.Size), entry.dir); err != nil {
+		return "", nil, err
 	}
 
-	var remote string
-	if cfg.StorageType == "linode" {
-		remote = fmt.Sprintf("linode:%s/%s/%s", cfg.LinodeBucket, cfg.LinodePrefix, filename)
-	} else {
-		remote = fmt.Sprintf("r2:%s/%s", cfg.R2Prefix, filename)
+	digest := &backupDigest{Size: info.Size, SHA256: sum, Manifest: manifest}
+	if manifest == nil {
+		progress.printf("No checksum manifest found; skipping checksum verification")
+		return localPath, digest, nil
+	}
+	if err := manifest.check(info.Size, sum); err != nil {
+		cleanup(entry.dir)
+		return "", digest, err
 	}
+	progress.printf("Checksum OK: %s", manifest.describe())
+	return localPath, digest, nil
+}
 
-	localPath := filepath.Join(cfg.WorkDir, filename)
+// downloadFile downloads a single object to localPath, checking its size, and
+// returns its sha256. The data goes to localPath.part first; if that is left
+// over from an interrupted download, the download resumes where it stopped.
+func downloadFile(ctx context.Context, store Storage, obj BackupObject, localPath string) (string, error) {
+	part := localPath + ".part"
+	f, err := os.OpenFile(part, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s: %w", part, err)
+	}
 
-	fmt.Printf("Downloading %s...\n", filename)
-	cmd := exec.Command("rclone", "copy", "--progress", remote, cfg.WorkDir)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	// Hash what is already there; this leaves the file offset at its end
+	h := sha256.New()
+	offset, err := io.Copy(h, f)
+	if err == nil && offset > obj.Size {
+		h.Reset()
+		offset = 0
+		if err = f.Truncate(0); err == nil {
+			_, err = f.Seek(0, io.SeekStart)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return "", fmt.Errorf("failed to read %s: %w", part, err)
+	}
+	if offset > 0 && offset < obj.Size {
+		progress.printf("Resuming %s at %s", obj.Name, formatBytes(offset))
+	}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to download backup: %w", err)
+	// A complete partial file only lacks the rename; a ranged read at its
+	// end would be refused
+	var n int64
+	if offset < obj.Size {
+		pw := &progressWriter{label: "downloaded", total: obj.Size, done: offset}
+		n, err = downloadRange(ctx, store, obj.Name, offset, io.MultiWriter(f, h, pw))
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Keep the partial file so that the next run can resume
+		return "", fmt.Errorf("failed to download backup (run again to resume): %w", err)
 	}
 
-	// Verify file exists
-	if _, err := os.Stat(localPath); err != nil {
-		return "", fmt.Errorf("downloaded file not found: %w", err)
+	// Verify size matches storage
+	if offset+n != obj.Size {
+		os.Remove(part)
+		return "", fmt.Errorf("downloaded %d bytes of %s, expected %d", offset+n, obj.Name, obj.Size)
 	}
+	if err := os.Rename(part, localPath); err != nil {
+		return "", fmt.Errorf("failed to rename %s: %w", part, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// downloadRange writes an object from offset on to w using a ranged read
+func downloadRange(ctx context.Context, store Storage, name string, offset int64, w io.Writer) (int64, error) {
+	if offset == 0 {
+		return store.Download(ctx, name, w)
+	}
+	r, err := store.Open(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
 
-	fmt.Printf("Downloaded: %s\n", localPath)
-	return localPath, nil
+	// All backends seek with a single ranged request; ReadAt may issue one per call
+	if seeker, ok := r.(io.Seeker); ok {
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return 0, err
+		}
+		return io.Copy(w, r)
+	}
+	return io.CopyBuffer(w, io.NewSectionReader(r, offset, 1<<62), make([]byte, 4<<20))
 }
 
-// extractBackup extracts a 7z archive
-func extractBackup(archivePath string) (string, error) {
-	dir := filepath.Dir(archivePath)
+// downloadDirectory downloads every object of a pg_dump directory into localDir
+func downloadDirectory(ctx context.Context, cfg *RestoreConfig, store Storage, dirname, localDir string) error {
+	objects, err := store.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list backup files: %w", err)
+	}
+
+	var files []BackupObject
+	var total int64
+	for _, obj := range objects {
+		if strings.HasPrefix(obj.Name, dirname) {
+			files = append(files, obj)
+			total += obj.Size
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("backup not found: %s", dirname)
+	}
 
-	fmt.Printf("Extracting %s...\n", filepath.Base(archivePath))
-	cmd := exec.Command("7z", "x", "-y", "-o"+dir, archivePath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	if err := checkDiskSpace(cfg, total, ""); err != nil {
+		return err
+	}
 
-	if err := cmd.Run(); err != nil {
-		return "", fmt.Errorf("failed to extract archive: %w", err)
+	progress.printf("Downloading %s (%d files, %s)...", dirname, len(files), formatBytes(total))
+	for _, obj := range files {
+		dst := filepath.Join(localDir, filepath.FromSlash(strings.TrimPrefix(obj.Name, dirname)))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return fmt.Errorf("failed to create directory: %w", err)
+		}
+		if _, err := downloadFile(ctx, store, obj, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractBackup extracts the dump of a 7z archive next to it, using
+// cfg.BackupPassword if it is encrypted. The archive is read in-process, so
+// the password never appears in the arguments of a 7z command.
+func extractBackup(cfg *RestoreConfig, archivePath string) (string, error) {
+	progress.printf("Extracting %s...", filepath.Base(archivePath))
+	archive, err := sevenzip.OpenReaderWithPassword(archivePath, cfg.BackupPassword)
+	if err != nil {
+		return "", fmt.Errorf("failed to extract archive: %w", classify7zReaderError(cfg, err))
 	}
+	defer archive.Close()
 
-	// The SQL file should have the same name without .7z
+	entry := firstArchiveFile(archive.File)
+	if entry == nil {
+		return "", fmt.Errorf("archive %s is empty", archivePath)
+	}
+
+	// The dump gets the same name without .7z
 	sqlPath := strings.TrimSuffix(archivePath, ".7z")
-	if _, err := os.Stat(sqlPath); err != nil {
-		return "", fmt.Errorf("extracted SQL file not found: %w", err)
+	if sqlPath == archivePath {
+		sqlPath += ".extracted"
+	}
+	if err := extractArchiveFile(entry, sqlPath); err != nil {
+		os.Remove(sqlPath)
+		return "", fmt.Errorf("failed to extract archive: %w", classify7zReaderError(cfg, err))
 	}
 
-	fmt.Printf("Extracted: %s\n", sqlPath)
+	progress.printf("Extracted: %s", sqlPath)
 	return sqlPath, nil
 }
 
-// restoreDatabase restores a SQL dump to PostgreSQL
-func restoreDatabase(cfg *RestoreConfig, sqlPath string) error {
-	fmt.Printf("Restoring to database %s@%s:%s/%s...\n",
-		cfg.PGUser, cfg.PGHost, cfg.PGPort, cfg.PGDatabase)
+// extractArchiveFile writes the contents of entry to p
+func extractArchiveFile(entry *sevenzip.File, p string) error {
+	rc, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
 
-	// Set PGPASSWORD environment variable
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
+	f, err := os.Create(p)
+	if err != nil {
+		return err
 	}
+	if _, err := io.Copy(f, rc); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
 
-	// Use psql for SQL text dumps (pg_dump default format)
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-f", sqlPath,
-	)
-	cmd.Env = env
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// restoreDatabase restores a dump to PostgreSQL
+func restoreDatabase(cfg *RestoreConfig, database string, dump *dumpSource) error {
+	progress.printf("Restoring to database %s@%s:%s/%s...",
+		cfg.PGUser, cfg.PGHost, cfg.PGPort, database)
+
+	// psql for SQL text dumps, pg_restore for custom/directory archives
+	cmd, err := dumpLoadCommand(cfg, database, dump, false)
+	if err != nil {
+		return err
+	}
+	out := progress.writer()
+	cmd.Stdout = out
+	cmd.Stderr = out
 
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to restore database: %w", err)
 	}
 
-	fmt.Println("Database restored successfully!")
+	progress.printf("Database restored successfully!")
 	return nil
 }
 
-// cleanup removes temporary files
+// cleanup removes temporary files and directories
 func cleanup(paths ...string) {
 	for _, path := range paths {
 		if path != "" {
-			os.Remove(path)
+			os.RemoveAll(path)
+		}
+	}
+}
+
+// requiredTools lists the external commands needed to restore filename with cfg
+func requiredTools(cfg *RestoreConfig, filename string) []string {
+	switch formatFromName(filename) {
+	case formatGPG:
+		return append([]string{"gpg"}, requiredTools(cfg, stripEncryptionSuffix(filename))...)
+	case formatAge:
+		return requiredTools(cfg, stripEncryptionSuffix(filename))
+	case formatCustom, formatDirectory:
+		if len(cfg.RoleMap) > 0 {
+			// pg_restore writes a script that psql loads after the roles are mapped
+			return []string{"pg_restore", "psql"}
+		}
+		return []string{"pg_restore"}
+	}
+	return []string{"psql"}
+}
+
+// streamRestore feeds the decompressed dump of a stored backup into restore.
+// The stored bytes are hashed as they are read and, once restore succeeded,
+// checked against the backup's manifest; on a mismatch the digest is returned
+// along with the error. Callers restore into a database that is discarded on
+// error, so a mismatch found only at the end changes nothing.
+func streamRestore(ctx context.Context, cfg *RestoreConfig, store Storage, filename string, restore func(*dumpSource) error) (*backupDigest, error) {
+	progress.printf("Streaming %s...", filename)
+	dump, stats, err := openBackupStream(ctx, cfg, store, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer dump.Close()
+
+	manifest, err := loadStoredManifest(ctx, store, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go reportStreamProgress(stats, time.Second, done)
+	err = restore(dump)
+	close(done)
+	if err != nil {
+		return nil, err
+	}
+
+	// The consumer may stop before the end (trailing bytes of an archive)
+	size, sum, err := stats.hashed.finish()
+	if err != nil {
+		return nil, err
+	}
+	progress.printf("Streamed: %s read from storage, %s decompressed (sha256 %s)",
+		formatBytes(stats.Downloaded.Load()), formatBytes(stats.Decompressed.Load()), sum)
+
+	digest := &backupDigest{Size: size, SHA256: sum, Manifest: manifest}
+	if manifest == nil {
+		progress.printf("No checksum manifest found; skipping checksum verification")
+		return digest, nil
+	}
+	if err := manifest.check(size, sum); err != nil {
+		return digest, err
+	}
+	progress.printf("Checksum OK: %s", manifest.describe())
+	return digest, nil
+}
+
+// loadBackup streams or downloads and extracts a stored backup, checking its
+// checksum manifest and that a SQL dump is complete, and hands the dump to
+// restore
+func loadBackup(ctx context.Context, cfg *RestoreConfig, store Storage, filename string, restore func(*dumpSource) error) error {
+	load := func(dump *dumpSource) error {
+		check, err := loadChecked(dump, restore)
+		if check != nil {
+			progress.printf("Dump: %s", check)
 		}
+		return err
+	}
+
+	if cfg.Stream {
+		_, err := streamRestore(ctx, cfg, store, filename, load)
+		return err
+	}
+
+	// 1. Download
+	archivePath, _, err := downloadBackup(ctx, cfg, store, filename)
+	if err != nil {
+		return err
 	}
+	defer discardDownload(cfg, archivePath)
+
+	// 2. Extract
+	dump, err := prepareDump(cfg, archivePath)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	// 3. Restore
+	return load(dump)
 }
 
 func cmdRestore(args []string) int {
-	cfg := loadRestoreConfigFromEnv()
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
 
 	// Parse arguments
-	var listOnly bool
-	var latest bool
+	var (
+		listOnly bool
+		latest   bool
+		format   string
+		at       time.Time
+		filter   backupFilter
+		snapshot = snapshotDump
+		rollback bool
+		clean    bool
+		tables   []string
+		user     string
+
+		// Point-in-time recovery
+		targetTime   time.Time
+		dataDir      = os.Getenv("PGDATA")
+		targetAction = "promote"
+	)
 
 	for i := 0; i < len(args); i++ {
 		switch args[i] {
@@ -601,6 +994,66 @@ func cmdRestore(args []string) int {
 			listOnly = true
 		case "--latest":
 			latest = true
+		case "--since":
+			if i+1 < len(args) {
+				t, err := parseTimeArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --since: %v\n", err)
+					return 1
+				}
+				filter.Since = t
+				i++
+			}
+		case "--before":
+			if i+1 < len(args) {
+				t, err := parseTimeArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --before: %v\n", err)
+					return 1
+				}
+				filter.Before = t
+				i++
+			}
+		case "--at":
+			if i+1 < len(args) {
+				t, err := parseTimeArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --at: %v\n", err)
+					return 1
+				}
+				at = t
+				i++
+			}
+		case "--target-time":
+			if i+1 < len(args) {
+				t, err := parseTimeArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --target-time: %v\n", err)
+					return 1
+				}
+				targetTime = t
+				i++
+			}
+		case "--data-dir":
+			if i+1 < len(args) {
+				dataDir = args[i+1]
+				i++
+			}
+		case "--target-action":
+			if i+1 < len(args) {
+				targetAction = args[i+1]
+				i++
+			}
+		case "--db":
+			if i+1 < len(args) {
+				filter.Database = args[i+1]
+				i++
+			}
+		case "--format":
+			if i+1 < len(args) {
+				format = args[i+1]
+				i++
+			}
 		case "-s", "--storage":
 			if i+1 < len(args) {
 				cfg.StorageType = args[i+1]
@@ -620,39 +1073,155 @@ func cmdRestore(args []string) int {
 			cfg.DryRun = true
 		case "--force":
 			cfg.Force = true
+		case "--stream":
+			cfg.Stream = true
+		case "--snapshot":
+			if i+1 < len(args) {
+				snapshot = args[i+1]
+				i++
+			}
+		case "--no-snapshot":
+			snapshot = snapshotNone
+		case "--rollback":
+			rollback = true
+		case "--clean":
+			clean = true
+		case "--table":
+			if i+1 < len(args) {
+				tables = append(tables, splitList(args[i+1])...)
+				i++
+			}
+		case "--user":
+			if i+1 < len(args) {
+				user = args[i+1]
+				i++
+			}
+		case "--stop-misskey":
+			cfg.StopMisskey = true
+		case "--pre-hook":
+			if i+1 < len(args) {
+				cfg.PreRestoreHook = args[i+1]
+				i++
+			}
+		case "--post-hook":
+			if i+1 < len(args) {
+				cfg.PostRestoreHook = args[i+1]
+				i++
+			}
+		case "--no-owner":
+			cfg.NoOwner = true
+		case "--role-map":
+			if i+1 < len(args) {
+				if cfg.RoleMap == nil {
+					cfg.RoleMap = map[string]string{}
+				}
+				if err := parseRoleMap(args[i+1], cfg.RoleMap); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				i++
+			}
+		case "-j", "--jobs":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &cfg.Jobs)
+				i++
+			}
+		case "--password-file":
+			if i+1 < len(args) {
+				password, err := readSecretFile(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				cfg.BackupPassword = password
+				i++
+			}
+		case "--age-identity":
+			if i+1 < len(args) {
+				cfg.AgeIdentityFile = args[i+1]
+				i++
+			}
+		case "--gpg-key":
+			if i+1 < len(args) {
+				cfg.GPGKeyFile = args[i+1]
+				i++
+			}
+		case "--misskey-url":
+			if i+1 < len(args) {
+				cfg.MisskeyURL = args[i+1]
+				i++
+			}
+		case "--misskey-version":
+			if i+1 < len(args) {
+				cfg.MisskeyVersion = args[i+1]
+				i++
+			}
+		case "--no-cache":
+			cfg.NoCache = true
+		case "--no-space-check":
+			cfg.NoSpaceCheck = true
+		case "--progress":
+			if i+1 < len(args) {
+				if err := setProgressMode(args[i+1]); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				i++
+			}
 		case "-h", "--help":
 			printRestoreUsage()
 			return 0
 		}
 	}
 
-	// Check required tools
-	for _, tool := range []string{"rclone", "7z", "psql"} {
-		if _, err := exec.LookPath(tool); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: required tool '%s' not found in PATH\n", tool)
-			return 1
-		}
+	switch snapshot {
+	case snapshotDump, snapshotCopy, snapshotNone:
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unknown --snapshot %q (expected dump, copy or none)\n", snapshot)
+		return 1
+	}
+	if cfg.NoOwner && len(cfg.RoleMap) > 0 {
+		fmt.Fprintln(os.Stderr, "Error: --no-owner and --role-map cannot be combined")
+		return 1
 	}
 
-	// List backups
-	fmt.Printf("Fetching backup list from %s...\n", cfg.StorageType)
-	backups, err := listBackups(cfg)
+	if rollback {
+		return cmdRollback(cfg)
+	}
+
+	store, err := newStorage(cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		progress.errorf("%v", err)
 		return 1
 	}
+	defer store.Close()
 
-	if len(backups) == 0 {
-		fmt.Println("No backups found.")
-		return 0
+	ctx := context.Background()
+
+	// Base backup + WAL instead of a dump
+	if !targetTime.IsZero() {
+		return cmdRestorePITR(ctx, cfg, store, targetTime, dataDir, targetAction)
 	}
 
+	// List backups
+	if !(listOnly && format == "json") {
+		progress.printf("Fetching backup list from %s...", cfg.StorageType)
+	}
+	backups, err := listBackups(ctx, store)
+	if err != nil {
+		progress.errorf("%v", err)
+		return 1
+	}
+	backups = filter.apply(backups)
+
 	// List only mode
 	if listOnly {
-		fmt.Println("\nAvailable backups:")
-		for i, b := range backups {
-			fmt.Printf("  [%d] %s\n", i+1, b)
-		}
+		printBackupList(backups, format)
+		return 0
+	}
+
+	if len(backups) == 0 {
+		fmt.Println("No backups found.")
 		return 0
 	}
 
@@ -660,15 +1229,20 @@ func cmdRestore(args []string) int {
 	var selectedBackup string
 	if cfg.BackupFile != "" {
 		selectedBackup = cfg.BackupFile
+	} else if !at.IsZero() {
+		b := backupAt(backups, at)
+		if b == nil {
+			progress.errorf("no backup taken at or before %s", at.Format(time.RFC3339))
+			return 1
+		}
+		selectedBackup = b.Name
+		progress.printf("Selected backup at %s: %s", at.Format("2006-01-02 15:04"), selectedBackup)
 	} else if latest {
-		selectedBackup = backups[0]
-		fmt.Printf("Selected latest backup: %s\n", selectedBackup)
+		selectedBackup = backups[0].Name
+		progress.printf("Selected latest backup: %s", selectedBackup)
 	} else {
 		// Interactive selection
-		fmt.Println("\nAvailable backups:")
-		for i, b := range backups {
-			fmt.Printf("  [%d] %s\n", i+1, b)
-		}
+		printBackupList(backups, "text")
 		fmt.Print("\nSelect backup number (or 'q' to quit): ")
 
 		reader := bufio.NewReader(os.Stdin)
@@ -685,7 +1259,47 @@ func cmdRestore(args []string) int {
 			fmt.Fprintf(os.Stderr, "Invalid selection: %s\n", input)
 			return 1
 		}
-		selectedBackup = backups[num-1]
+		selectedBackup = backups[num-1].Name
+	}
+
+	// Check required tools
+	for _, tool := range requiredTools(cfg, selectedBackup) {
+		if _, err := exec.LookPath(tool); err != nil {
+			progress.errorf("required tool '%s' not found in PATH", tool)
+			return 1
+		}
+	}
+
+	// Copy rows into the live database instead of replacing it
+	if len(tables) > 0 || user != "" {
+		return cmdRestoreSelective(ctx, cfg, store, selectedBackup, tables, user, format)
+	}
+
+	// Refuse to replace a populated database without --clean
+	target, err := inspectTarget(ctx, cfg)
+	if err != nil {
+		if !cfg.DryRun {
+			progress.errorf("%v", err)
+			return 1
+		}
+		progress.printf("Warning: could not inspect target database: %v", err)
+	}
+	if target != nil && !target.empty() && !clean {
+		if !cfg.DryRun {
+			progress.errorf("target database %s is not empty", target)
+			progress.printf("Use --clean to replace it (the current database is kept as <db>_old_<timestamp>)")
+			return 1
+		}
+		fmt.Printf("\nTarget database %s is not empty; restore would refuse without --clean\n", target)
+	}
+
+	// Ask Misskey for its version while it is still running
+	resolveMisskeyVersion(ctx, cfg)
+
+	services := newServiceControl(cfg, selectedBackup)
+	var serviceSteps []string
+	if services.enabled() {
+		serviceSteps = services.describe(ctx)
 	}
 
 	// Confirmation
@@ -693,6 +1307,13 @@ func cmdRestore(args []string) int {
 		fmt.Printf("\n⚠️  WARNING: This will restore backup to database '%s'\n", cfg.PGDatabase)
 		fmt.Printf("   Backup: %s\n", selectedBackup)
 		fmt.Printf("   Host: %s:%s\n", cfg.PGHost, cfg.PGPort)
+		fmt.Printf("   Target: %s\n", target)
+		if !target.empty() {
+			fmt.Printf("   The current database will be replaced and kept as %s_old_<timestamp>\n", cfg.PGDatabase)
+		}
+		for _, line := range serviceSteps {
+			fmt.Printf("   %s\n", line)
+		}
 		fmt.Print("\nType 'yes' to continue: ")
 
 		reader := bufio.NewReader(os.Stdin)
@@ -707,34 +1328,99 @@ func cmdRestore(args []string) int {
 
 	if cfg.DryRun {
 		fmt.Println("\n[DRY RUN] Would execute:")
-		fmt.Printf("  1. Download: %s\n", selectedBackup)
-		fmt.Printf("  2. Extract: %s\n", strings.TrimSuffix(selectedBackup, ".7z"))
-		fmt.Printf("  3. Restore to: %s@%s:%s/%s\n", cfg.PGUser, cfg.PGHost, cfg.PGPort, cfg.PGDatabase)
+		if target != nil {
+			fmt.Printf("  Target: %s\n", target)
+		}
+		step := 0
+		do := func(format string, a ...any) {
+			step++
+			fmt.Printf("  %d. "+format+"\n", append([]any{step}, a...)...)
+		}
+		staging := cfg.PGDatabase + "_restore_<timestamp>"
+		for _, line := range serviceSteps {
+			do("%s", line)
+		}
+		if snapshot != snapshotNone {
+			do("Snapshot: %s (%s, if it exists)", cfg.PGDatabase, snapshot)
+		}
+		if target != nil && target.Exists {
+			do("Create staging database: %s (owner %s, %s)", staging, target.Owner, target.Encoding)
+		} else {
+			do("Create staging database: %s", staging)
+		}
+		if cfg.Stream {
+			do("Stream: %s (download → extract → psql, no temporary files)", selectedBackup)
+		} else {
+			do("Download: %s", selectedBackup)
+			do("Extract: %s (%s)", selectedBackup, formatFromName(selectedBackup))
+		}
+		do("Create missing roles and extensions used by the backup")
+		switch {
+		case cfg.NoOwner:
+			do("Strip owners and grants (objects owned by %s)", cfg.PGUser)
+		case len(cfg.RoleMap) > 0:
+			do("Map roles: %s", describeRoleMap(cfg.RoleMap))
+		}
+		do("Restore to: %s@%s:%s/%s", cfg.PGUser, cfg.PGHost, cfg.PGPort, staging)
+		do("Run integrity checks on %s", staging)
+		if cfg.MisskeyVersion != "" {
+			do("Check migrations against Misskey %s", cfg.MisskeyVersion)
+		}
+		do("Swap: %s → %s_old_<timestamp>, %s → %s", cfg.PGDatabase, cfg.PGDatabase, staging, cfg.PGDatabase)
+		if cfg.StopMisskey {
+			do("Start the stopped Misskey containers")
+		}
+		if cfg.PostRestoreHook != "" {
+			do("Run post-restore hook: %s", cfg.PostRestoreHook)
+		}
 		return 0
 	}
 
 	// Execute restore
-	fmt.Println()
 
-	// 1. Download
-	archivePath, err := downloadBackup(cfg, selectedBackup)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	// Stop Misskey first so nothing writes to the target while it is replaced
+	if err := services.stop(ctx); err != nil {
+		progress.errorf("%v", err)
+		if startErr := services.start(ctx, err); startErr != nil {
+			progress.errorf("%v", startErr)
+		}
+		printServiceSteps(services.Steps)
 		return 1
 	}
-	defer cleanup(archivePath)
 
-	// 2. Extract
-	sqlPath, err := extractBackup(archivePath)
+	report, err := beginRestore(ctx, cfg, selectedBackup, snapshot)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		progress.errorf("%v", err)
+		if startErr := services.start(ctx, err); startErr != nil {
+			progress.errorf("%v", startErr)
+		}
+		printServiceSteps(services.Steps)
 		return 1
 	}
-	defer cleanup(sqlPath)
 
-	// 3. Restore
-	if err := restoreDatabase(cfg, sqlPath); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	err = restoreViaStaging(ctx, cfg, report, target, func(database string) error {
+		return loadBackup(ctx, cfg, store, selectedBackup, func(dump *dumpSource) error {
+			setup, dump, err := prepareRoles(ctx, cfg, database, dump)
+			report.Roles = setup
+			if err != nil {
+				return err
+			}
+			defer dump.Close()
+			return restoreDatabase(cfg, database, dump)
+		})
+	})
+
+	// Bring Misskey back whether or not the restore succeeded
+	startErr := services.start(ctx, err)
+	report.Services = services.Steps
+	report.finish(cfg, err)
+	if err != nil {
+		progress.errorf("%v", err)
+	}
+	if startErr != nil {
+		progress.errorf("%v", startErr)
+	}
+	if err != nil || startErr != nil {
 		return 1
 	}
 
@@ -748,29 +1434,154 @@ func printRestoreUsage() {
 	fmt.Println("Options:")
 	fmt.Println("  -l, --list       List available backups")
 	fmt.Println("  --latest         Restore the latest backup")
-	fmt.Println("  -s, --storage    Storage type: r2 or linode (default: r2)")
+	fmt.Println("  --at             Restore the newest backup taken at or before a time")
+	fmt.Println("  --target-time    Point-in-time recovery: prepare --data-dir from a base backup")
+	fmt.Println("                   and archived WAL to recover up to just before this time")
+	fmt.Println("  --data-dir       Empty data directory to recover into (default: PGDATA)")
+	fmt.Println("  --target-action  After reaching the target: promote, pause or shutdown (default: promote)")
+	fmt.Println("  --since, --before")
+	fmt.Println("                   Only consider backups taken in this time range")
+	fmt.Println("  --db             Only consider backups of this database (from the file name)")
+	fmt.Println("  --format         Output format of --list, --table and --user: text or json")
+	fmt.Println("  -s, --storage    Storage: r2, linode, local:/path, sftp://user@host/path,")
+	fmt.Println("                   s3://bucket/prefix (default: r2)")
 	fmt.Println("  -f, --file       Specific backup file to restore")
 	fmt.Println("  -d, --database   Target database name")
 	fmt.Println("  --dry-run        Show what would be done without executing")
 	fmt.Println("  --force          Skip confirmation prompt")
+	fmt.Println("  --stream         Stream download → extract → psql without temporary files")
+	fmt.Println("  -j, --jobs       pg_restore parallel jobs for .dump/directory backups (default: CPUs)")
+	fmt.Println("  --password-file  File containing the 7z/age/GPG password of encrypted backups")
+	fmt.Println("  --age-identity   age identity file for .age backups")
+	fmt.Println("  --gpg-key        GPG private key file for .gpg backups")
+	fmt.Println("  --snapshot       Snapshot the target before restoring: dump (pg_dump into")
+	fmt.Println("                   WORK_DIR/snapshots), copy (a copy database) or none (default: dump)")
+	fmt.Println("  --no-snapshot    Same as --snapshot none")
+	fmt.Println("  --rollback       Reinstate the snapshot taken before the last restore of -d")
+	fmt.Println("  --clean          Replace the target database even if it already has tables")
+	fmt.Println("  --table          Only copy the rows of these tables into the database")
+	fmt.Println("                   (comma-separated or repeated)")
+	fmt.Println("  --user           Only copy one user's rows (user id, username or @user@host)")
+	fmt.Println("  --no-owner       Strip owners and grants; objects are owned by POSTGRES_USER")
+	fmt.Println("  --role-map       Rename a role in owners and grants: old=new (repeatable)")
+	fmt.Println("  --stop-misskey   Stop the Misskey containers during the restore (Docker API)")
+	fmt.Println("  --pre-hook       Shell command run before the restore (PRE_RESTORE_HOOK)")
+	fmt.Println("  --post-hook      Shell command run after the restore (POST_RESTORE_HOOK)")
+	fmt.Println("  --progress       Progress on stderr: text, ndjson or none (default: text)")
+	fmt.Println("  --misskey-url    Misskey whose /api/meta version the migrations are compared with")
+	fmt.Println("  --misskey-version Misskey version the migrations are compared with")
+	fmt.Println("  --no-cache       Delete the download afterwards instead of caching it")
+	fmt.Println("  --no-space-check Skip the free disk space check before downloading")
+	fmt.Println("")
+	fmt.Println("Times: 2025-01-01, \"2025-01-01 03:00\", RFC 3339, or an age such as 36h or 7d")
 	fmt.Println("")
 	fmt.Println("Environment variables:")
-	fmt.Println("  STORAGE_TYPE     Storage type (r2/linode)")
+	fmt.Println("  STORAGE_TYPE     Storage (same values as --storage)")
+	fmt.Println("  R2_ACCOUNT_ID    Cloudflare account ID (or R2_ENDPOINT)")
+	fmt.Println("  R2_BUCKET        R2 bucket name (default: first element of R2_PREFIX)")
 	fmt.Println("  R2_PREFIX        R2 bucket prefix (default: backups)")
+	fmt.Println("  R2_ACCESS_KEY_ID, R2_SECRET_ACCESS_KEY")
+	fmt.Println("                   R2 API token credentials")
+	fmt.Println("  LINODE_ENDPOINT  Linode endpoint (e.g. jp-osa-1.linodeobjects.com)")
 	fmt.Println("  LINODE_BUCKET    Linode bucket name (default: yamisskey-backup)")
 	fmt.Println("  LINODE_PREFIX    Linode prefix (default: backups)")
+	fmt.Println("  LINODE_ACCESS_KEY_ID, LINODE_SECRET_ACCESS_KEY")
+	fmt.Println("                   Linode access key credentials")
+	fmt.Println("  S3_ENDPOINT      Endpoint for s3:// storage (http:// for plain HTTP)")
+	fmt.Println("  S3_REGION        Region for s3:// storage")
+	fmt.Println("  S3_ACCESS_KEY_ID, S3_SECRET_ACCESS_KEY")
+	fmt.Println("                   Credentials for s3:// storage")
+	fmt.Println("  SFTP_KEY_FILE    Private key for sftp:// storage")
+	fmt.Println("  SFTP_PASSWORD    Password for sftp:// storage")
+	fmt.Println("  SFTP_KNOWN_HOSTS known_hosts file (default: ~/.ssh/known_hosts)")
 	fmt.Println("  POSTGRES_HOST    PostgreSQL host (default: localhost)")
 	fmt.Println("  POSTGRES_PORT    PostgreSQL port (default: 5432)")
 	fmt.Println("  POSTGRES_USER    PostgreSQL user (default: misskey)")
 	fmt.Println("  POSTGRES_DB      PostgreSQL database (default: mk1)")
 	fmt.Println("  PGPASSWORD       PostgreSQL password")
 	fmt.Println("  WORK_DIR         Working directory for downloads")
+	fmt.Println("  PG_BIN_DIR       Directory of initdb and pg_ctl for verify --ephemeral")
+	fmt.Println("  MISSKEY_URL      Misskey URL for the migration check (e.g. https://misskey.example)")
+	fmt.Println("  MISSKEY_VERSION  Misskey version for the migration check, instead of MISSKEY_URL")
+	fmt.Println("  CACHE_MAX_SIZE   Size of the download cache in WORK_DIR/cache (default: 20G)")
+	fmt.Println("  DUMP_EXPANSION   Expected extracted size of a 7z dump per archive byte (default: 8)")
+	fmt.Println("  BACKUP_PASSWORD  Password of encrypted backups (or BACKUP_PASSWORD_FILE)")
+	fmt.Println("  AGE_IDENTITY_FILE, AGE_IDENTITY")
+	fmt.Println("                   age identity file / AGE-SECRET-KEY for .age backups")
+	fmt.Println("  GPG_KEY_FILE     GPG private key for .gpg backups (default: gpg keyring)")
+	fmt.Println("  GPG_PASSPHRASE   Passphrase of the GPG key (or GPG_PASSPHRASE_FILE)")
+	fmt.Println("  DOCKER_SOCKET    Docker Engine API socket (default: /var/run/docker.sock)")
+	fmt.Println("  MISSKEY_CONTAINERS")
+	fmt.Println("                   Comma-separated Misskey container names for --stop-misskey")
+	fmt.Println("  MISSKEY_COMPOSE_PROJECT, MISSKEY_COMPOSE_SERVICES")
+	fmt.Println("                   Or: compose project and its services to stop (default: web,worker)")
+	fmt.Println("")
+	fmt.Println("Restore process:")
+	fmt.Println("  The backup is loaded into a new <db>_restore_<timestamp> database and checked")
+	fmt.Println("  with the verify integrity checks. Only if they pass is it renamed to <db>; the")
+	fmt.Println("  previous database is kept as <db>_old_<timestamp>. Restoring over a database")
+	fmt.Println("  that has tables is refused unless --clean is given.")
+	fmt.Println("")
+	fmt.Println("Snapshots:")
+	fmt.Println("  Each restore writes a report to WORK_DIR/reports recording the snapshot.")
+	fmt.Println("  copy needs the target to have no other connections (use --stop-misskey).")
+	fmt.Println("")
+	fmt.Println("Selective restore:")
+	fmt.Println("  --table and --user load the backup into a temporary <db>_selective_<timestamp>")
+	fmt.Println("  database and copy the selected rows into <db> in one transaction. --user")
+	fmt.Println("  copies the user with its keypair, drive folders and files, pages, profile,")
+	fmt.Println("  notes, reactions and followings. Rows that already exist are reported as")
+	fmt.Println("  conflicts and left unchanged; rows referencing deleted rows are skipped.")
+	fmt.Println("")
+	fmt.Println("Services:")
+	fmt.Println("  With --stop-misskey the running Misskey containers are stopped before the")
+	fmt.Println("  snapshot and started again after the restore, even if it failed. Hooks get")
+	fmt.Println("  RESTORE_BACKUP, RESTORE_DATABASE, RESTORE_HOST and (post) RESTORE_OK=1/0.")
+	fmt.Println("")
+	fmt.Println("Point-in-time recovery:")
+	fmt.Println("  --target-time takes the newest base backup (backup --base) finished before the")
+	fmt.Println("  target, extracts it into --data-dir, downloads the archived WAL (wal-push) it")
+	fmt.Println("  needs into <data-dir>/pitr_wal and writes recovery.signal and recovery_target_time.")
+	fmt.Println("  Starting PostgreSQL on the directory then replays WAL up to the target.")
+	fmt.Println("")
+	fmt.Println("Roles:")
+	fmt.Println("  Before loading, roles owning objects in the backup or granted privileges in")
+	fmt.Println("  it that do not exist are created (NOLOGIN), as are the extensions it uses")
+	fmt.Println("  (pg_trgm, pgroonga); a missing extension stops the restore. --no-owner strips")
+	fmt.Println("  owners and grants, --role-map misskey=staging renames the role in them;")
+	fmt.Println("  pg_dump archives are then loaded as a script through psql, without -j. A")
+	fmt.Println("  streamed archive, and the grants of a streamed script, which follow its data,")
+	fmt.Println("  cannot be searched for roles beforehand (a warning says so).")
+	fmt.Println("")
+	fmt.Println("Downloads:")
+	fmt.Println("  Downloads are kept in WORK_DIR/cache, keyed by name, size and hash, and reused")
+	fmt.Println("  by the next restore or verify; the least recently used are evicted beyond")
+	fmt.Println("  CACHE_MAX_SIZE or when space runs out. An interrupted download resumes where")
+	fmt.Println("  it stopped. Before downloading, the free space in WORK_DIR is checked against")
+	fmt.Println("  the archive size plus what extraction needs.")
+	fmt.Println("")
+	fmt.Println("Checksums:")
+	fmt.Println("  If <file>.manifest.json or <file>.sha256 exists next to the backup, the")
+	fmt.Println("  download is checked against it before extraction. With --stream the bytes")
+	fmt.Println("  are hashed as they are read and checked before the restored database is used.")
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  yamisskey-doctor restore --list")
+	fmt.Println("  yamisskey-doctor restore --list --since 7d --format json")
+	fmt.Println("  yamisskey-doctor restore --at \"2025-01-01 12:00\" --db mk1")
 	fmt.Println("  yamisskey-doctor restore --latest")
 	fmt.Println("  yamisskey-doctor restore --storage linode --latest")
+	fmt.Println("  yamisskey-doctor restore --storage local:/mnt/nas/backups --list")
+	fmt.Println("  yamisskey-doctor restore --storage sftp://backup@nas.local/srv/backups --latest")
 	fmt.Println("  yamisskey-doctor restore --file mk1_2025-01-01_03-00.sql.7z")
+	fmt.Println("  yamisskey-doctor restore --file mk1_2025-01-01_03-00.dump --jobs 8")
+	fmt.Println("  yamisskey-doctor restore --latest --stream")
+	fmt.Println("  yamisskey-doctor restore --latest --clean")
+	fmt.Println("  yamisskey-doctor restore --latest --clean --snapshot copy")
+	fmt.Println("  yamisskey-doctor restore --latest --clean --stop-misskey")
+	fmt.Println("  yamisskey-doctor restore --at 2025-01-01 --user alice")
+	fmt.Println("  yamisskey-doctor restore --latest --table emoji")
+	fmt.Println("  yamisskey-doctor restore --rollback")
 }
 
 // ===== Verify =====
@@ -781,171 +1592,180 @@ type VerifyResult struct {
 	DownloadOK  bool          `json:"downloadOk"`
 	ExtractOK   bool          `json:"extractOk"`
 	RestoreOK   bool          `json:"restoreOk"`
+	DumpOK      bool          `json:"dumpOk"` // a SQL dump is complete; archives are checked by pg_restore
 	IntegrityOK bool          `json:"integrityOk"`
 	Tables      int           `json:"tables"`
 	Error       string        `json:"error,omitempty"`
 	Checks      []VerifyCheck `json:"checks,omitempty"`
+
+	// Structure of a plain SQL dump: header, trailer, COPY blocks and versions
+	Dump *DumpCheck `json:"dump,omitempty"`
+
+	// The dump was parsed instead of restored (verify --offline)
+	Offline bool `json:"offline,omitempty"`
+
+	// Applied migrations compared with the Misskey version (a warning only)
+	Migrations *MigrationState `json:"migrations,omitempty"`
+
+	// Hash of the bytes that were verified, and the manifest it was checked against
+	SHA256     string `json:"sha256,omitempty"`
+	Manifest   string `json:"manifest,omitempty"`
+	ChecksumOK bool   `json:"checksumOk"`
+}
+
+// setDigest records the hash of the verified backup
+func (r *VerifyResult) setDigest(d *backupDigest) {
+	if d == nil {
+		return
+	}
+	r.SHA256 = d.SHA256
+	if d.Manifest != nil {
+		r.Manifest = d.Manifest.Source
+		r.ChecksumOK = d.Manifest.check(d.Size, d.SHA256) == nil
+	}
+}
+
+// loadDump loads dump with load, checking first that a SQL dump is complete
+func (r *VerifyResult) loadDump(dump *dumpSource, load func(*dumpSource) error) error {
+	check, err := loadChecked(dump, load)
+	r.Dump = check
+	r.DumpOK = check == nil || check.OK
+	if check != nil {
+		progress.printf("      Dump %s", check)
+	}
+	return err
 }
 
 type VerifyCheck struct {
-	Name   string `json:"name"`
-	OK     bool   `json:"ok"`
-	Detail string `json:"detail,omitempty"`
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Severity string `json:"severity,omitempty"` // error or warning; informational counts have none
+	Detail   string `json:"detail,omitempty"`
 }
 
-// createTempDatabase creates a temporary database for verification
-func createTempDatabase(cfg *RestoreConfig, tempDBName string) error {
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
+// status is OK, FAIL for a failed check of error severity, WARN otherwise
+func (c VerifyCheck) status() string {
+	switch {
+	case c.OK:
+		return "OK"
+	case c.Severity == severityError:
+		return "FAIL"
 	}
+	return "WARN"
+}
 
+// createTempDatabase creates a temporary database for verification
+func createTempDatabase(ctx context.Context, cfg *RestoreConfig, tempDBName string) error {
 	// Connect to 'postgres' database to create new database
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", "postgres",
-		"-c", fmt.Sprintf("CREATE DATABASE %s", tempDBName),
-	)
-	cmd.Env = env
-
-	output, err := cmd.CombinedOutput()
+	conn, err := connectDB(ctx, cfg, "postgres")
 	if err != nil {
-		return fmt.Errorf("failed to create temp database: %s", string(output))
+		return err
+	}
+	defer conn.Close(ctx)
+
+	if _, err := conn.Exec(ctx, "CREATE DATABASE "+quoteIdent(tempDBName)); err != nil {
+		return fmt.Errorf("failed to create temp database: %w", err)
 	}
 	return nil
 }
 
 // dropTempDatabase drops the temporary database
-func dropTempDatabase(cfg *RestoreConfig, tempDBName string) error {
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
+func dropTempDatabase(ctx context.Context, cfg *RestoreConfig, tempDBName string) error {
+	conn, err := connectDB(ctx, cfg, "postgres")
+	if err != nil {
+		return err
 	}
+	defer conn.Close(ctx)
 
 	// Terminate connections first
-	terminateCmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", "postgres",
-		"-c", fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s'", tempDBName),
-	)
-	terminateCmd.Env = env
-	terminateCmd.Run() // Ignore errors
-
-	// Drop database
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", "postgres",
-		"-c", fmt.Sprintf("DROP DATABASE IF EXISTS %s", tempDBName),
+	conn.Exec(ctx, // Ignore errors
+		"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()",
+		tempDBName,
 	)
-	cmd.Env = env
 
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("failed to drop temp database: %s", string(output))
+	if _, err := conn.Exec(ctx, "DROP DATABASE IF EXISTS "+quoteIdent(tempDBName)); err != nil {
+		return fmt.Errorf("failed to drop temp database: %w", err)
 	}
 	return nil
 }
 
-// restoreToTempDatabase restores SQL to temporary database
-func restoreToTempDatabase(cfg *RestoreConfig, tempDBName, sqlPath string) error {
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
+// restoreToTempDatabase restores a dump to temporary database
+func restoreToTempDatabase(cfg *RestoreConfig, tempDBName string, dump *dumpSource) error {
+	// A fresh ephemeral cluster has none of the roles and extensions it needs
+	if cfg.Ephemeral {
+		_, prepared, err := prepareRoles(context.Background(), cfg, tempDBName, dump)
+		if err != nil {
+			return err
+		}
+		defer prepared.Close()
+		dump = prepared
 	}
 
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", tempDBName,
-		"-f", sqlPath,
-		"-v", "ON_ERROR_STOP=1",
-	)
-	cmd.Env = env
+	cmd, err := dumpLoadCommand(cfg, tempDBName, dump, true)
+	if err != nil {
+		return err
+	}
 
+	// Any non-zero exit fails: a killed loader or a broken pipe need not print an error
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		// Check if it's just warnings vs real errors
-		if strings.Contains(string(output), "ERROR:") {
-			return fmt.Errorf("restore failed: %s", string(output))
-		}
+		return fmt.Errorf("restore failed: %w: %s", err, strings.TrimSpace(string(output)))
 	}
 	return nil
 }
 
-// runIntegrityChecks runs basic integrity checks on the database
-func runIntegrityChecks(cfg *RestoreConfig, tempDBName string) ([]VerifyCheck, int, error) {
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
+// criticalTables are the Misskey tables a usable backup must contain
+var criticalTables = []string{"user", "note", "meta", "instance"}
+
+// runIntegrityChecks counts the tables, users and notes of the database, checks
+// the critical tables exist and runs misskeyRules. A query that fails is
+// reported as a failed check rather than a zero count.
+func runIntegrityChecks(ctx context.Context, cfg *RestoreConfig, tempDBName string) ([]VerifyCheck, int, error) {
+	conn, err := connectDB(ctx, cfg, tempDBName)
+	if err != nil {
+		return nil, 0, err
 	}
+	defer conn.Close(ctx)
 
 	var checks []VerifyCheck
-	var tableCount int
 
 	// Check 1: Count tables
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", tempDBName,
-		"-t", "-c",
-		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'public'",
-	)
-	cmd.Env = env
-	output, err := cmd.Output()
+	tableCount, err := queryCount(ctx, conn,
+		"SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'public'")
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to count tables: %w", err)
 	}
-	fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &tableCount)
 	checks = append(checks, VerifyCheck{
-		Name:   "table_count",
-		OK:     tableCount > 0,
-		Detail: fmt.Sprintf("%d tables", tableCount),
+		Name:     "table_count",
+		OK:       tableCount > 0,
+		Severity: severityError,
+		Detail:   fmt.Sprintf("%d tables", tableCount),
 	})
 
 	// Check 2: Verify critical Misskey tables exist
-	criticalTables := []string{"user", "note", "meta", "instance"}
 	for _, table := range criticalTables {
-		cmd := exec.Command("psql",
-			"-h", cfg.PGHost,
-			"-p", cfg.PGPort,
-			"-U", cfg.PGUser,
-			"-d", tempDBName,
-			"-t", "-c",
-			fmt.Sprintf("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = 'public' AND table_name = '%s'", table),
-		)
-		cmd.Env = env
-		output, _ := cmd.Output()
-		count := 0
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &count)
+		exists, err := tableExists(ctx, conn, table)
+		if err != nil {
+			check := failedCheck(fmt.Sprintf("table_%s", table), err)
+			check.Severity = severityError
+			checks = append(checks, check)
+			continue
+		}
 		checks = append(checks, VerifyCheck{
-			Name:   fmt.Sprintf("table_%s", table),
-			OK:     count > 0,
-			Detail: fmt.Sprintf("table '%s' exists: %v", table, count > 0),
+			Name:     fmt.Sprintf("table_%s", table),
+			OK:       exists,
+			Severity: severityError,
+			Detail:   fmt.Sprintf("table '%s' exists: %v", table, exists),
 		})
 	}
 
 	// Check 3: Count users
-	cmd = exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", tempDBName,
-		"-t", "-c",
-		`SELECT COUNT(*) FROM "user"`,
-	)
-	cmd.Env = env
-	output, err = cmd.Output()
-	if err == nil {
-		userCount := 0
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &userCount)
+	userCount, err := queryCount(ctx, conn, `SELECT COUNT(*) FROM "user"`)
+	if err != nil {
+		check := failedCheck("user_count", err)
+		check.Severity = severityError
+		checks = append(checks, check)
+	} else {
 		checks = append(checks, VerifyCheck{
 			Name:   "user_count",
 			OK:     true,
@@ -954,19 +1774,12 @@ func runIntegrityChecks(cfg *RestoreConfig, tempDBName string) ([]VerifyCheck, i
 	}
 
 	// Check 4: Count notes
-	cmd = exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", tempDBName,
-		"-t", "-c",
-		"SELECT COUNT(*) FROM note",
-	)
-	cmd.Env = env
-	output, err = cmd.Output()
-	if err == nil {
-		noteCount := 0
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &noteCount)
+	noteCount, err := queryCount(ctx, conn, "SELECT COUNT(*) FROM note")
+	if err != nil {
+		check := failedCheck("note_count", err)
+		check.Severity = severityError
+		checks = append(checks, check)
+	} else {
 		checks = append(checks, VerifyCheck{
 			Name:   "note_count",
 			OK:     true,
@@ -974,39 +1787,47 @@ func runIntegrityChecks(cfg *RestoreConfig, tempDBName string) ([]VerifyCheck, i
 		})
 	}
 
-	// Check 5: Foreign key integrity (sample check)
-	cmd = exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", tempDBName,
-		"-t", "-c",
-		`SELECT COUNT(*) FROM note WHERE "userId" NOT IN (SELECT id FROM "user")`,
-	)
-	cmd.Env = env
-	output, err = cmd.Output()
-	if err == nil {
-		orphanNotes := 0
-		fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &orphanNotes)
-		checks = append(checks, VerifyCheck{
-			Name:   "orphan_notes",
-			OK:     orphanNotes == 0,
-			Detail: fmt.Sprintf("%d orphan notes", orphanNotes),
-		})
-	}
+	// Check 5: Misskey's own invariants and references
+	checks = append(checks, runIntegrityRules(ctx, conn, misskeyRules)...)
 
 	return checks, tableCount, nil
 }
 
+// integrityOK reports whether no check of error severity failed
+func integrityOK(checks []VerifyCheck) bool {
+	for _, check := range checks {
+		if !check.OK && check.Severity == severityError {
+			return false
+		}
+	}
+	return true
+}
+
+// failedCheck records a check whose query could not be run
+func failedCheck(name string, err error) VerifyCheck {
+	return VerifyCheck{
+		Name:   name,
+		OK:     false,
+		Detail: fmt.Sprintf("query failed: %v", err),
+	}
+}
+
 func cmdVerify(args []string) int {
-	cfg := loadRestoreConfigFromEnv()
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
 
 	// Parse arguments
 	var (
 		listOnly  bool
 		latest    bool
 		format    string
-		localFile string // Local SQL file path (skip download/extract)
+		localFile string // Local dump path (skip download)
+		offline   bool   // Parse the dump instead of restoring it
+		at        time.Time
+		filter    backupFilter
 	)
 
 	for i := 0; i < len(args); i++ {
@@ -1015,6 +1836,41 @@ func cmdVerify(args []string) int {
 			listOnly = true
 		case "--latest":
 			latest = true
+		case "--since":
+			if i+1 < len(args) {
+				t, err := parseTimeArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --since: %v\n", err)
+					return 1
+				}
+				filter.Since = t
+				i++
+			}
+		case "--before":
+			if i+1 < len(args) {
+				t, err := parseTimeArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --before: %v\n", err)
+					return 1
+				}
+				filter.Before = t
+				i++
+			}
+		case "--at":
+			if i+1 < len(args) {
+				t, err := parseTimeArg(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: --at: %v\n", err)
+					return 1
+				}
+				at = t
+				i++
+			}
+		case "--db":
+			if i+1 < len(args) {
+				filter.Database = args[i+1]
+				i++
+			}
 		case "-s", "--storage":
 			if i+1 < len(args) {
 				cfg.StorageType = args[i+1]
@@ -1030,65 +1886,136 @@ func cmdVerify(args []string) int {
 				localFile = args[i+1]
 				i++
 			}
+		case "--offline":
+			offline = true
+		case "--ephemeral":
+			cfg.Ephemeral = true
 		case "--format":
 			if i+1 < len(args) {
 				format = args[i+1]
 				i++
 			}
+		case "--stream":
+			cfg.Stream = true
+		case "-j", "--jobs":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &cfg.Jobs)
+				i++
+			}
+		case "--password-file":
+			if i+1 < len(args) {
+				password, err := readSecretFile(args[i+1])
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				cfg.BackupPassword = password
+				i++
+			}
+		case "--age-identity":
+			if i+1 < len(args) {
+				cfg.AgeIdentityFile = args[i+1]
+				i++
+			}
+		case "--gpg-key":
+			if i+1 < len(args) {
+				cfg.GPGKeyFile = args[i+1]
+				i++
+			}
+		case "--misskey-url":
+			if i+1 < len(args) {
+				cfg.MisskeyURL = args[i+1]
+				i++
+			}
+		case "--misskey-version":
+			if i+1 < len(args) {
+				cfg.MisskeyVersion = args[i+1]
+				i++
+			}
+		case "--no-cache":
+			cfg.NoCache = true
+		case "--no-space-check":
+			cfg.NoSpaceCheck = true
+		case "--progress":
+			if i+1 < len(args) {
+				if err := setProgressMode(args[i+1]); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+					return 1
+				}
+				i++
+			}
 		case "-h", "--help":
 			printVerifyUsage()
 			return 0
 		}
 	}
 
-	// Local file mode - skip rclone/7z requirements
+	if !listOnly && !offline {
+		resolveMisskeyVersion(context.Background(), cfg)
+	}
+
+	// Local file mode - skip storage requirements
 	if localFile != "" {
+		if offline {
+			return cmdVerifyOffline(context.Background(), cfg, nil, localFile, format)
+		}
 		return cmdVerifyLocal(cfg, localFile, format)
 	}
 
-	// Check required tools
-	for _, tool := range []string{"rclone", "7z", "psql"} {
-		if _, err := exec.LookPath(tool); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: required tool '%s' not found in PATH\n", tool)
-			return 1
-		}
+	store, err := newStorage(cfg)
+	if err != nil {
+		progress.errorf("%v", err)
+		return 1
 	}
+	defer store.Close()
+
+	ctx := context.Background()
 
 	// List backups
-	fmt.Printf("Fetching backup list from %s...\n", cfg.StorageType)
-	backups, err := listBackups(cfg)
+	if !(listOnly && format == "json") {
+		progress.printf("Fetching backup list from %s...", cfg.StorageType)
+	}
+	backups, err := listBackups(ctx, store)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		progress.errorf("%v", err)
 		return 1
 	}
+	backups = filter.apply(backups)
 
-	if len(backups) == 0 {
-		fmt.Println("No backups found.")
+	// List only mode
+	if listOnly {
+		printBackupList(backups, format)
 		return 0
 	}
 
-	// List only mode
-	if listOnly {
-		fmt.Println("\nAvailable backups:")
-		for i, b := range backups {
-			fmt.Printf("  [%d] %s\n", i+1, b)
+	// Nothing verified is a failure: a scheduled verify must not pass on an empty bucket
+	if len(backups) == 0 {
+		if format == "json" {
+			printVerifyResult(&VerifyResult{Error: "no backups found"}, format)
+		} else {
+			progress.errorf("no backups found")
 		}
-		return 0
+		return 1
 	}
 
 	// Select backup file
 	var selectedBackup string
 	if cfg.BackupFile != "" {
 		selectedBackup = cfg.BackupFile
+	} else if !at.IsZero() {
+		b := backupAt(backups, at)
+		if b == nil {
+			progress.errorf("no backup taken at or before %s", at.Format(time.RFC3339))
+			return 1
+		}
+		selectedBackup = b.Name
+		progress.printf("Selected backup at %s: %s", at.Format("2006-01-02 15:04"), selectedBackup)
 	} else if latest {
-		selectedBackup = backups[0]
-		fmt.Printf("Selected latest backup: %s\n", selectedBackup)
+		selectedBackup = backups[0].Name
+		progress.printf("Selected latest backup: %s", selectedBackup)
 	} else {
 		// Interactive selection
-		fmt.Println("\nAvailable backups:")
-		for i, b := range backups {
-			fmt.Printf("  [%d] %s\n", i+1, b)
-		}
+		printBackupList(backups, "text")
 		fmt.Print("\nSelect backup number (or 'q' to quit): ")
 
 		reader := bufio.NewReader(os.Stdin)
@@ -1105,9 +2032,29 @@ func cmdVerify(args []string) int {
 			fmt.Fprintf(os.Stderr, "Invalid selection: %s\n", input)
 			return 1
 		}
-		selectedBackup = backups[num-1]
+		selectedBackup = backups[num-1].Name
 	}
 
+	if offline {
+		return cmdVerifyOffline(ctx, cfg, store, selectedBackup, format)
+	}
+
+	// Check required tools
+	for _, tool := range requiredTools(cfg, selectedBackup) {
+		if _, err := exec.LookPath(tool); err != nil {
+			progress.errorf("required tool '%s' not found in PATH", tool)
+			return 1
+		}
+	}
+
+	// Restore into a private cluster instead of POSTGRES_HOST
+	teardown, err := useEphemeralCluster(cfg)
+	if err != nil {
+		progress.errorf("%v", err)
+		return 1
+	}
+	defer teardown()
+
 	// Generate temp database name
 	tempDBName := fmt.Sprintf("yamisskey_verify_%d", time.Now().Unix())
 
@@ -1115,60 +2062,97 @@ func cmdVerify(args []string) int {
 		BackupFile: selectedBackup,
 	}
 
-	fmt.Println()
-	fmt.Printf("Verifying backup: %s\n", selectedBackup)
-	fmt.Printf("Temp database: %s\n", tempDBName)
-	fmt.Println()
+	progress.printf("Verifying backup: %s", selectedBackup)
+	progress.printf("Temp database: %s", tempDBName)
 
 	// Ensure cleanup on exit
 	defer func() {
-		fmt.Printf("Cleaning up temp database %s...\n", tempDBName)
-		dropTempDatabase(cfg, tempDBName)
+		progress.printf("Cleaning up temp database %s...", tempDBName)
+		dropTempDatabase(ctx, cfg, tempDBName)
 	}()
 
-	// Step 1: Download
-	fmt.Println("[1/4] Downloading backup...")
-	archivePath, err := downloadBackup(cfg, selectedBackup)
-	if err != nil {
-		result.Error = fmt.Sprintf("Download failed: %v", err)
-		printVerifyResult(&result, format)
-		return 1
-	}
-	defer cleanup(archivePath)
-	result.DownloadOK = true
-	fmt.Println("      Download OK")
+	integrityStep := 4
+	if cfg.Stream {
+		integrityStep = 3
 
-	// Step 2: Extract
-	fmt.Println("[2/4] Extracting archive...")
-	sqlPath, err := extractBackup(archivePath)
-	if err != nil {
-		result.Error = fmt.Sprintf("Extract failed: %v", err)
-		printVerifyResult(&result, format)
-		return 1
-	}
-	defer cleanup(sqlPath)
-	result.ExtractOK = true
-	fmt.Println("      Extract OK")
+		// Step 1: Create temp DB
+		progress.stepf(1, 3, "create", "Creating temp database...")
+		if err := createTempDatabase(ctx, cfg, tempDBName); err != nil {
+			result.Error = fmt.Sprintf("Create temp DB failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
 
-	// Step 3: Create temp DB and restore
-	fmt.Println("[3/4] Creating temp database and restoring...")
-	if err := createTempDatabase(cfg, tempDBName); err != nil {
-		result.Error = fmt.Sprintf("Create temp DB failed: %v", err)
-		printVerifyResult(&result, format)
-		return 1
-	}
+		// Step 2: Stream download → extract → restore
+		progress.stepf(2, 3, "restore", "Streaming backup into temp database...")
+		digest, err := streamRestore(ctx, cfg, store, selectedBackup, func(dump *dumpSource) error {
+			return result.loadDump(dump, func(dump *dumpSource) error {
+				return restoreToTempDatabase(cfg, tempDBName, dump)
+			})
+		})
+		result.setDigest(digest)
+		if err != nil && digest != nil {
+			result.Error = fmt.Sprintf("Checksum failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
+		if err != nil {
+			result.Error = fmt.Sprintf("Stream restore failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
+		result.DownloadOK = true
+		result.ExtractOK = true
+		result.RestoreOK = true
+		progress.printf("      Restore OK")
+	} else {
+		// Step 1: Download
+		progress.stepf(1, 4, "download", "Downloading backup...")
+		archivePath, digest, err := downloadBackup(ctx, cfg, store, selectedBackup)
+		result.setDigest(digest)
+		if err != nil {
+			result.Error = fmt.Sprintf("Download failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
+		defer discardDownload(cfg, archivePath)
+		result.DownloadOK = true
+		progress.printf("      Download OK")
 
-	if err := restoreToTempDatabase(cfg, tempDBName, sqlPath); err != nil {
-		result.Error = fmt.Sprintf("Restore failed: %v", err)
-		printVerifyResult(&result, format)
-		return 1
+		// Step 2: Extract
+		progress.stepf(2, 4, "extract", "Extracting archive...")
+		dump, err := prepareDump(cfg, archivePath)
+		if err != nil {
+			result.Error = fmt.Sprintf("Extract failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
+		defer dump.Close()
+		result.ExtractOK = true
+		progress.printf("      Extract OK")
+
+		// Step 3: Create temp DB and restore
+		progress.stepf(3, 4, "restore", "Creating temp database and restoring...")
+		if err := createTempDatabase(ctx, cfg, tempDBName); err != nil {
+			result.Error = fmt.Sprintf("Create temp DB failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
+
+		if err := result.loadDump(dump, func(dump *dumpSource) error {
+			return restoreToTempDatabase(cfg, tempDBName, dump)
+		}); err != nil {
+			result.Error = fmt.Sprintf("Restore failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
+		result.RestoreOK = true
+		progress.printf("      Restore OK")
 	}
-	result.RestoreOK = true
-	fmt.Println("      Restore OK")
 
-	// Step 4: Run integrity checks
-	fmt.Println("[4/4] Running integrity checks...")
-	checks, tableCount, err := runIntegrityChecks(cfg, tempDBName)
+	// Run integrity checks
+	progress.stepf(integrityStep, integrityStep, "integrity", "Running integrity checks...")
+	checks, tableCount, err := runIntegrityChecks(ctx, cfg, tempDBName)
 	if err != nil {
 		result.Error = fmt.Sprintf("Integrity check failed: %v", err)
 		printVerifyResult(&result, format)
@@ -1178,17 +2162,19 @@ func cmdVerify(args []string) int {
 	result.Tables = tableCount
 
 	// Determine overall integrity
-	result.IntegrityOK = true
-	for _, check := range checks {
-		if !check.OK && strings.HasPrefix(check.Name, "table_") {
-			result.IntegrityOK = false
-			break
+	result.IntegrityOK = integrityOK(checks)
+
+	result.OK = result.DownloadOK && result.ExtractOK && result.DumpOK && result.RestoreOK && result.IntegrityOK
+	result.Migrations = verifyMigrations(ctx, cfg, tempDBName)
+	progress.printf("      Integrity checks complete")
+
+	// Mark the backup as verified so prune keeps it
+	if result.OK {
+		if err := recordVerification(ctx, store, selectedBackup, &result); err != nil {
+			progress.printf("Warning: failed to record verification: %v", err)
 		}
 	}
 
-	result.OK = result.DownloadOK && result.ExtractOK && result.RestoreOK && result.IntegrityOK
-	fmt.Println("      Integrity checks complete")
-
 	printVerifyResult(&result, format)
 
 	if result.OK {
@@ -1197,58 +2183,80 @@ func cmdVerify(args []string) int {
 	return 1
 }
 
-// cmdVerifyLocal verifies a local SQL file without downloading
-func cmdVerifyLocal(cfg *RestoreConfig, sqlPath string, format string) int {
-	// Check required tools (only psql needed for local mode)
-	if _, err := exec.LookPath("psql"); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: required tool 'psql' not found in PATH\n")
+// cmdVerifyLocal verifies a local dump file or directory without downloading
+func cmdVerifyLocal(cfg *RestoreConfig, dumpPath string, format string) int {
+	// Check if file exists
+	if _, err := os.Stat(dumpPath); err != nil {
+		progress.errorf("file not found: %s", dumpPath)
 		return 1
 	}
 
-	// Check if file exists
-	if _, err := os.Stat(sqlPath); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: file not found: %s\n", sqlPath)
+	ctx := context.Background()
+
+	// Restore into a private cluster instead of POSTGRES_HOST
+	teardown, err := useEphemeralCluster(cfg)
+	if err != nil {
+		progress.errorf("%v", err)
 		return 1
 	}
+	defer teardown()
 
 	// Generate temp database name
 	tempDBName := fmt.Sprintf("yamisskey_verify_%d", time.Now().Unix())
 
 	result := VerifyResult{
-		BackupFile: sqlPath,
+		BackupFile: dumpPath,
 		DownloadOK: true, // N/A for local
-		ExtractOK:  true, // N/A for local
 	}
 
-	fmt.Printf("Verifying local SQL file: %s\n", sqlPath)
-	fmt.Printf("Temp database: %s\n", tempDBName)
-	fmt.Println()
+	progress.printf("Verifying local dump: %s", dumpPath)
+	progress.printf("Temp database: %s", tempDBName)
 
 	// Ensure cleanup on exit
 	defer func() {
-		fmt.Printf("Cleaning up temp database %s...\n", tempDBName)
-		dropTempDatabase(cfg, tempDBName)
+		progress.printf("Cleaning up temp database %s...", tempDBName)
+		dropTempDatabase(ctx, cfg, tempDBName)
 	}()
 
 	// Step 1: Create temp DB and restore
-	fmt.Println("[1/2] Creating temp database and restoring...")
-	if err := createTempDatabase(cfg, tempDBName); err != nil {
+	progress.stepf(1, 2, "restore", "Creating temp database and restoring...")
+	if kind, _ := detectFileFormat(dumpPath); kind != formatDirectory {
+		digest, err := hashLocalFile(dumpPath)
+		result.setDigest(digest)
+		if err != nil {
+			result.Error = fmt.Sprintf("Checksum failed: %v", err)
+			printVerifyResult(&result, format)
+			return 1
+		}
+	}
+	dump, err := prepareDump(cfg, dumpPath)
+	if err != nil {
+		result.Error = fmt.Sprintf("Extract failed: %v", err)
+		printVerifyResult(&result, format)
+		return 1
+	}
+	defer dump.Close()
+	result.ExtractOK = true
+
+	if err := createTempDatabase(ctx, cfg, tempDBName); err != nil {
 		result.Error = fmt.Sprintf("Create temp DB failed: %v", err)
 		printVerifyResult(&result, format)
 		return 1
 	}
 
-	if err := restoreToTempDatabase(cfg, tempDBName, sqlPath); err != nil {
+	if err := result.loadDump(dump, func(dump *dumpSource) error {
+		return restoreToTempDatabase(cfg, tempDBName, dump)
+	}); err != nil {
 		result.Error = fmt.Sprintf("Restore failed: %v", err)
 		printVerifyResult(&result, format)
 		return 1
 	}
 	result.RestoreOK = true
-	fmt.Println("      Restore OK")
+	progress.printf("      Restore OK")
 
 	// Step 2: Run integrity checks
-	fmt.Println("[2/2] Running integrity checks...")
-	checks, tableCount, err := runIntegrityChecks(cfg, tempDBName)
+	progress.stepf(2, 2, "integrity", "Running integrity checks...")
+	checks, tableCount, err := runIntegrityChecks(ctx, cfg, tempDBName)
 	if err != nil {
 		result.Error = fmt.Sprintf("Integrity check failed: %v", err)
 		printVerifyResult(&result, format)
@@ -1258,16 +2266,11 @@ func cmdVerifyLocal(cfg *RestoreConfig, sqlPath string, format string) int {
 	result.Tables = tableCount
 
 	// Determine overall integrity
-	result.IntegrityOK = true
-	for _, check := range checks {
-		if !check.OK && strings.HasPrefix(check.Name, "table_") {
-			result.IntegrityOK = false
-			break
-		}
-	}
+	result.IntegrityOK = integrityOK(checks)
 
-	result.OK = result.RestoreOK && result.IntegrityOK
-	fmt.Println("      Integrity checks complete")
+	result.OK = result.DumpOK && result.RestoreOK && result.IntegrityOK
+	result.Migrations = verifyMigrations(ctx, cfg, tempDBName)
+	progress.printf("      Integrity checks complete")
 
 	printVerifyResult(&result, format)
 
@@ -1278,8 +2281,6 @@ func cmdVerifyLocal(cfg *RestoreConfig, sqlPath string, format string) int {
 }
 
 func printVerifyResult(result *VerifyResult, format string) {
-	fmt.Println()
-
 	if format == "json" {
 		enc := json.NewEncoder(os.Stdout)
 		enc.SetIndent("", "  ")
@@ -1287,6 +2288,8 @@ func printVerifyResult(result *VerifyResult, format string) {
 		return
 	}
 
+	fmt.Println()
+
 	// Text format
 	status := "PASS"
 	if !result.OK {
@@ -1296,9 +2299,28 @@ func printVerifyResult(result *VerifyResult, format string) {
 	fmt.Printf("=== Verification Result: %s ===\n", status)
 	fmt.Printf("Backup:     %s\n", result.BackupFile)
 	fmt.Printf("Download:   %s\n", boolToStatus(result.DownloadOK))
+	switch {
+	case result.Manifest != "":
+		fmt.Printf("Checksum:   %s  (%s)\n", boolToStatus(result.ChecksumOK), result.Manifest)
+	case result.SHA256 != "":
+		fmt.Println("Checksum:   -  (no manifest)")
+	}
+	if result.SHA256 != "" {
+		fmt.Printf("SHA256:     %s\n", result.SHA256)
+	}
 	fmt.Printf("Extract:    %s\n", boolToStatus(result.ExtractOK))
-	fmt.Printf("Restore:    %s\n", boolToStatus(result.RestoreOK))
+	if result.Dump != nil {
+		fmt.Printf("Dump:       %s\n", result.Dump)
+	}
+	if result.Offline {
+		fmt.Println("Restore:    -  (offline: parsed without PostgreSQL)")
+	} else {
+		fmt.Printf("Restore:    %s\n", boolToStatus(result.RestoreOK))
+	}
 	fmt.Printf("Integrity:  %s\n", boolToStatus(result.IntegrityOK))
+	if result.Migrations != nil {
+		fmt.Printf("Migrations: %s\n", result.Migrations)
+	}
 
 	if result.Error != "" {
 		fmt.Printf("Error:      %s\n", result.Error)
@@ -1307,16 +2329,17 @@ func printVerifyResult(result *VerifyResult, format string) {
 	if len(result.Checks) > 0 {
 		fmt.Println("\nIntegrity Checks:")
 		for _, check := range result.Checks {
-			status := "OK"
-			if !check.OK {
-				status = "FAIL"
-			}
-			fmt.Printf("  %-15s %s  %s\n", check.Name, status, check.Detail)
+			fmt.Printf("  %-15s %-4s  %s\n", check.Name, check.status(), check.Detail)
 		}
 	}
+	if result.Offline && result.Dump != nil && len(result.Dump.TableRows) > 0 {
+		printTableRows(result.Dump.TableRows)
+	}
 
 	fmt.Println()
-	if result.OK {
+	if result.OK && result.Offline {
+		fmt.Println("Dump is complete and has the Misskey tables (not restored; verify without --offline for a full check).")
+	} else if result.OK {
 		fmt.Println("Backup is valid and can be restored.")
 	} else {
 		fmt.Println("Backup verification failed.")
@@ -1338,18 +2361,71 @@ func printVerifyUsage() {
 	fmt.Println("Options:")
 	fmt.Println("  -l, --list       List available backups")
 	fmt.Println("  --latest         Verify the latest backup")
-	fmt.Println("  -s, --storage    Storage type: r2 or linode (default: r2)")
+	fmt.Println("  --at             Verify the newest backup taken at or before a time")
+	fmt.Println("  --since, --before")
+	fmt.Println("                   Only consider backups taken in this time range")
+	fmt.Println("  --db             Only consider backups of this database (from the file name)")
+	fmt.Println("  -s, --storage    Storage: r2, linode, local:/path, sftp://user@host/path,")
+	fmt.Println("                   s3://bucket/prefix (default: r2)")
 	fmt.Println("  -f, --file       Specific backup file to verify")
-	fmt.Println("  --local          Verify a local SQL file (skip download/extract)")
+	fmt.Println("  --local          Verify a local dump file or directory (skip download)")
+	fmt.Println("  --offline        Parse the dump instead of restoring it: no PostgreSQL needed")
+	fmt.Println("  --ephemeral      Restore into a private cluster (initdb + pg_ctl) instead of POSTGRES_HOST")
 	fmt.Println("  --format         Output format: text or json (default: text)")
+	fmt.Println("  --stream         Stream download → extract → psql without temporary files")
+	fmt.Println("  -j, --jobs       pg_restore parallel jobs for .dump/directory backups (default: CPUs)")
+	fmt.Println("  --password-file  File containing the 7z/age/GPG password of encrypted backups")
+	fmt.Println("  --age-identity   age identity file for .age backups")
+	fmt.Println("  --gpg-key        GPG private key file for .gpg backups")
+	fmt.Println("  --progress       Progress on stderr: text, ndjson or none (default: text)")
+	fmt.Println("  --misskey-url    Misskey whose /api/meta version the migrations are compared with")
+	fmt.Println("  --misskey-version Misskey version the migrations are compared with")
+	fmt.Println("  --no-cache       Delete the download afterwards instead of caching it")
+	fmt.Println("  --no-space-check Skip the free disk space check before downloading")
+	fmt.Println("")
+	fmt.Println("Times: 2025-01-01, \"2025-01-01 03:00\", RFC 3339, or an age such as 36h or 7d")
+	fmt.Println("")
+	fmt.Println("Offline:")
+	fmt.Println("  --offline reads the tables a dump creates and counts the COPY rows of each")
+	fmt.Println("  instead of restoring it, and runs the table, user and note checks on that.")
+	fmt.Println("  pg_dump archives are read through pg_restore -f -. The Misskey integrity")
+	fmt.Println("  rules and migrations need a restore and are not checked; the result is not")
+	fmt.Println("  recorded in storage.")
+	fmt.Println("")
+	fmt.Println("Integrity rules:")
+	fmt.Println("  meta_row, user_profile, user_keypair, note_reply, note_renote and")
+	fmt.Println("  following_users are errors: they fail the check, and a restore before the")
+	fmt.Println("  swap. orphan_notes and note_files (Misskey leaves these behind) only WARN.")
+	fmt.Println("")
+	fmt.Println("Ephemeral cluster:")
+	fmt.Println("  --ephemeral initdbs a throwaway cluster in WORK_DIR with POSTGRES_USER as its")
+	fmt.Println("  superuser, starts it without fsync on a unix socket in its private directory")
+	fmt.Println("  (no TCP), creates the roles and extensions the dump needs and removes it all")
+	fmt.Println("  afterwards. initdb and pg_ctl come from PG_BIN_DIR, PATH or")
+	fmt.Println("  /usr/lib/postgresql/<version>/bin; as root they run as the postgres user.")
+	fmt.Println("")
+	fmt.Println("Dump check:")
+	fmt.Println("  SQL dumps must have pg_dump's header and \"dump complete\" trailer, end every")
+	fmt.Println("  COPY block with \\. and come from a pg_dump no older than the server. Dumps on")
+	fmt.Println("  disk are checked before loading, streamed ones while they load.")
+	fmt.Println("")
+	fmt.Println("Progress:")
+	fmt.Println("  Progress and the output of psql/pg_restore go to stderr; stdout only has")
+	fmt.Println("  the result. --progress ndjson writes one JSON event per line, e.g.")
+	fmt.Println("  {\"type\":\"bytes\",\"step\":\"download\",\"bytes\":1048576,\"bytesTotal\":4194304,\"etaSeconds\":12}")
 	fmt.Println("")
 	fmt.Println("Environment variables: (same as restore command)")
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  yamisskey-doctor verify --latest")
+	fmt.Println("  yamisskey-doctor verify --latest --stream")
 	fmt.Println("  yamisskey-doctor verify --file mk1_2025-01-01_03-00.sql.7z")
 	fmt.Println("  yamisskey-doctor verify --local /path/to/backup.sql")
+	fmt.Println("  yamisskey-doctor verify --local /path/to/backup.dump --jobs 4")
+	fmt.Println("  yamisskey-doctor verify --local /path/to/backup.sql.gz --offline")
+	fmt.Println("  yamisskey-doctor verify --latest --ephemeral")
 	fmt.Println("  yamisskey-doctor verify --latest --format json")
+	fmt.Println("  yamisskey-doctor verify --latest --format json --progress ndjson 2>progress.ndjson")
 }
 
 // ===== Repair =====
@@ -1369,31 +2445,16 @@ type RepairCheck struct {
 	Error   string `json:"error,omitempty"`
 }
 
-// repairOrphanNotes finds and optionally deletes notes with missing users
-func repairOrphanNotes(cfg *RestoreConfig, dryRun bool) RepairCheck {
-	check := RepairCheck{Name: "orphan_notes"}
-
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
-	}
+// repairOrphans counts rows matched by countSQL and, unless dryRun, deletes them with deleteSQL
+func repairOrphans(ctx context.Context, conn *pgx.Conn, name, countSQL, deleteSQL string, dryRun bool) RepairCheck {
+	check := RepairCheck{Name: name}
 
-	// Count orphan notes
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
-		`SELECT COUNT(*) FROM note WHERE "userId" NOT IN (SELECT id FROM "user")`,
-	)
-	cmd.Env = env
-	output, err := cmd.Output()
+	found, err := queryCount(ctx, conn, countSQL)
 	if err != nil {
 		check.Error = fmt.Sprintf("failed to count: %v", err)
 		return check
 	}
-	fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &check.Found)
+	check.Found = found
 
 	if check.Found == 0 {
 		return check
@@ -1404,193 +2465,50 @@ func repairOrphanNotes(cfg *RestoreConfig, dryRun bool) RepairCheck {
 		return check
 	}
 
-	// Delete orphan notes
-	cmd = exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
-		`DELETE FROM note WHERE "userId" NOT IN (SELECT id FROM "user")`,
-	)
-	cmd.Env = env
-	_, err = cmd.Output()
+	tag, err := conn.Exec(ctx, deleteSQL)
 	if err != nil {
 		check.Error = fmt.Sprintf("failed to delete: %v", err)
 		return check
 	}
-	check.Fixed = check.Found
+	check.Fixed = int(tag.RowsAffected())
 
 	return check
 }
 
-// repairOrphanReactions finds and optionally deletes reactions with missing notes
-func repairOrphanReactions(cfg *RestoreConfig, dryRun bool) RepairCheck {
-	check := RepairCheck{Name: "orphan_reactions"}
-
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
-	}
+// repairOrphanNotes finds and optionally deletes notes with missing users
+func repairOrphanNotes(ctx context.Context, conn *pgx.Conn, dryRun bool) RepairCheck {
+	return repairOrphans(ctx, conn, "orphan_notes",
+		`SELECT COUNT(*) FROM note WHERE "userId" NOT IN (SELECT id FROM "user")`,
+		`DELETE FROM note WHERE "userId" NOT IN (SELECT id FROM "user")`,
+		dryRun)
+}
 
-	// Count orphan reactions
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
+// repairOrphanReactions finds and optionally deletes reactions with missing notes
+func repairOrphanReactions(ctx context.Context, conn *pgx.Conn, dryRun bool) RepairCheck {
+	return repairOrphans(ctx, conn, "orphan_reactions",
 		`SELECT COUNT(*) FROM note_reaction WHERE "noteId" NOT IN (SELECT id FROM note)`,
-	)
-	cmd.Env = env
-	output, err := cmd.Output()
-	if err != nil {
-		check.Error = fmt.Sprintf("failed to count: %v", err)
-		return check
-	}
-	fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &check.Found)
-
-	if check.Found == 0 {
-		return check
-	}
-
-	if dryRun {
-		check.Skipped = true
-		return check
-	}
-
-	// Delete orphan reactions
-	cmd = exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
 		`DELETE FROM note_reaction WHERE "noteId" NOT IN (SELECT id FROM note)`,
-	)
-	cmd.Env = env
-	_, err = cmd.Output()
-	if err != nil {
-		check.Error = fmt.Sprintf("failed to delete: %v", err)
-		return check
-	}
-	check.Fixed = check.Found
-
-	return check
+		dryRun)
 }
 
 // repairOrphanNotifications finds and optionally deletes notifications with missing users
-func repairOrphanNotifications(cfg *RestoreConfig, dryRun bool) RepairCheck {
-	check := RepairCheck{Name: "orphan_notifications"}
-
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
-	}
-
-	// Count orphan notifications
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
+func repairOrphanNotifications(ctx context.Context, conn *pgx.Conn, dryRun bool) RepairCheck {
+	return repairOrphans(ctx, conn, "orphan_notifications",
 		`SELECT COUNT(*) FROM notification WHERE "notifieeId" NOT IN (SELECT id FROM "user")`,
-	)
-	cmd.Env = env
-	output, err := cmd.Output()
-	if err != nil {
-		check.Error = fmt.Sprintf("failed to count: %v", err)
-		return check
-	}
-	fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &check.Found)
-
-	if check.Found == 0 {
-		return check
-	}
-
-	if dryRun {
-		check.Skipped = true
-		return check
-	}
-
-	// Delete orphan notifications
-	cmd = exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
 		`DELETE FROM notification WHERE "notifieeId" NOT IN (SELECT id FROM "user")`,
-	)
-	cmd.Env = env
-	_, err = cmd.Output()
-	if err != nil {
-		check.Error = fmt.Sprintf("failed to delete: %v", err)
-		return check
-	}
-	check.Fixed = check.Found
-
-	return check
+		dryRun)
 }
 
 // repairOrphanDriveFiles finds and optionally deletes drive files with missing users
-func repairOrphanDriveFiles(cfg *RestoreConfig, dryRun bool) RepairCheck {
-	check := RepairCheck{Name: "orphan_drive_files"}
-
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
-	}
-
-	// Count orphan drive files
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
+func repairOrphanDriveFiles(ctx context.Context, conn *pgx.Conn, dryRun bool) RepairCheck {
+	return repairOrphans(ctx, conn, "orphan_drive_files",
 		`SELECT COUNT(*) FROM drive_file WHERE "userId" IS NOT NULL AND "userId" NOT IN (SELECT id FROM "user")`,
-	)
-	cmd.Env = env
-	output, err := cmd.Output()
-	if err != nil {
-		check.Error = fmt.Sprintf("failed to count: %v", err)
-		return check
-	}
-	fmt.Sscanf(strings.TrimSpace(string(output)), "%d", &check.Found)
-
-	if check.Found == 0 {
-		return check
-	}
-
-	if dryRun {
-		check.Skipped = true
-		return check
-	}
-
-	// Delete orphan drive files
-	cmd = exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-t", "-c",
 		`DELETE FROM drive_file WHERE "userId" IS NOT NULL AND "userId" NOT IN (SELECT id FROM "user")`,
-	)
-	cmd.Env = env
-	_, err = cmd.Output()
-	if err != nil {
-		check.Error = fmt.Sprintf("failed to delete: %v", err)
-		return check
-	}
-	check.Fixed = check.Found
-
-	return check
+		dryRun)
 }
 
 // reindexDatabase runs REINDEX on the database
-func reindexDatabase(cfg *RestoreConfig, dryRun bool) RepairCheck {
+func reindexDatabase(ctx context.Context, conn *pgx.Conn, database string, dryRun bool) RepairCheck {
 	check := RepairCheck{Name: "reindex"}
 
 	if dryRun {
@@ -1599,33 +2517,10 @@ func reindexDatabase(cfg *RestoreConfig, dryRun bool) RepairCheck {
 		return check
 	}
 
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
-	}
-
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-c", "REINDEX DATABASE CONCURRENTLY "+cfg.PGDatabase,
-	)
-	cmd.Env = env
-	output, err := cmd.CombinedOutput()
-	if err != nil {
+	if _, err := conn.Exec(ctx, "REINDEX DATABASE CONCURRENTLY "+quoteIdent(database)); err != nil {
 		// REINDEX CONCURRENTLY requires PostgreSQL 12+, try without CONCURRENTLY
-		cmd = exec.Command("psql",
-			"-h", cfg.PGHost,
-			"-p", cfg.PGPort,
-			"-U", cfg.PGUser,
-			"-d", cfg.PGDatabase,
-			"-c", "REINDEX DATABASE "+cfg.PGDatabase,
-		)
-		cmd.Env = env
-		output, err = cmd.CombinedOutput()
-		if err != nil {
-			check.Error = fmt.Sprintf("failed: %s", string(output))
+		if _, err := conn.Exec(ctx, "REINDEX DATABASE "+quoteIdent(database)); err != nil {
+			check.Error = fmt.Sprintf("failed: %v", err)
 			return check
 		}
 	}
@@ -1636,7 +2531,7 @@ func reindexDatabase(cfg *RestoreConfig, dryRun bool) RepairCheck {
 }
 
 // vacuumAnalyze runs VACUUM ANALYZE on the database
-func vacuumAnalyze(cfg *RestoreConfig, dryRun bool) RepairCheck {
+func vacuumAnalyze(ctx context.Context, conn *pgx.Conn, dryRun bool) RepairCheck {
 	check := RepairCheck{Name: "vacuum_analyze"}
 
 	if dryRun {
@@ -1645,22 +2540,8 @@ func vacuumAnalyze(cfg *RestoreConfig, dryRun bool) RepairCheck {
 		return check
 	}
 
-	env := os.Environ()
-	if cfg.PGPassword != "" {
-		env = append(env, "PGPASSWORD="+cfg.PGPassword)
-	}
-
-	cmd := exec.Command("psql",
-		"-h", cfg.PGHost,
-		"-p", cfg.PGPort,
-		"-U", cfg.PGUser,
-		"-d", cfg.PGDatabase,
-		"-c", "VACUUM ANALYZE",
-	)
-	cmd.Env = env
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		check.Error = fmt.Sprintf("failed: %s", string(output))
+	if _, err := conn.Exec(ctx, "VACUUM ANALYZE"); err != nil {
+		check.Error = fmt.Sprintf("failed: %v", err)
 		return check
 	}
 	check.Found = 1
@@ -1670,15 +2551,19 @@ func vacuumAnalyze(cfg *RestoreConfig, dryRun bool) RepairCheck {
 }
 
 func cmdRepair(args []string) int {
-	cfg := loadRestoreConfigFromEnv()
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
 
 	// Parse arguments
 	var (
-		dryRun     bool
-		force      bool
-		format     string
-		reindex    bool
-		vacuum     bool
+		dryRun      bool
+		force       bool
+		format      string
+		reindex     bool
+		vacuum      bool
 		orphansOnly bool
 	)
 
@@ -1710,12 +2595,6 @@ func cmdRepair(args []string) int {
 		}
 	}
 
-	// Check required tools
-	if _, err := exec.LookPath("psql"); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: required tool 'psql' not found in PATH\n")
-		return 1
-	}
-
 	// Confirmation
 	if !force && !dryRun {
 		fmt.Printf("⚠️  WARNING: This will modify database '%s'\n", cfg.PGDatabase)
@@ -1733,6 +2612,14 @@ func cmdRepair(args []string) int {
 		}
 	}
 
+	ctx := context.Background()
+	conn, err := connectDB(ctx, cfg, cfg.PGDatabase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer conn.Close(ctx)
+
 	result := RepairResult{
 		DryRun: dryRun,
 	}
@@ -1748,19 +2635,19 @@ func cmdRepair(args []string) int {
 	if !reindex && !vacuum || orphansOnly {
 		fmt.Println("Checking orphan records...")
 
-		check := repairOrphanNotes(cfg, dryRun)
+		check := repairOrphanNotes(ctx, conn, dryRun)
 		result.Repairs = append(result.Repairs, check)
 		printRepairCheck(check, dryRun)
 
-		check = repairOrphanReactions(cfg, dryRun)
+		check = repairOrphanReactions(ctx, conn, dryRun)
 		result.Repairs = append(result.Repairs, check)
 		printRepairCheck(check, dryRun)
 
-		check = repairOrphanNotifications(cfg, dryRun)
+		check = repairOrphanNotifications(ctx, conn, dryRun)
 		result.Repairs = append(result.Repairs, check)
 		printRepairCheck(check, dryRun)
 
-		check = repairOrphanDriveFiles(cfg, dryRun)
+		check = repairOrphanDriveFiles(ctx, conn, dryRun)
 		result.Repairs = append(result.Repairs, check)
 		printRepairCheck(check, dryRun)
 	}
@@ -1768,7 +2655,7 @@ func cmdRepair(args []string) int {
 	// Reindex
 	if reindex || (!orphansOnly && !vacuum) {
 		fmt.Println("\nRebuilding indexes...")
-		check := reindexDatabase(cfg, dryRun)
+		check := reindexDatabase(ctx, conn, cfg.PGDatabase, dryRun)
 		result.Repairs = append(result.Repairs, check)
 		printRepairCheck(check, dryRun)
 	}
@@ -1776,7 +2663,7 @@ func cmdRepair(args []string) int {
 	// Vacuum
 	if vacuum || (!orphansOnly && !reindex) {
 		fmt.Println("\nRunning VACUUM ANALYZE...")
-		check := vacuumAnalyze(cfg, dryRun)
+		check := vacuumAnalyze(ctx, conn, dryRun)
 		result.Repairs = append(result.Repairs, check)
 		printRepairCheck(check, dryRun)
 	}
@@ -1905,15 +2792,21 @@ func printUsage() {
 	fmt.Println("")
 	fmt.Println("Commands:")
 	fmt.Println("  check    Check Misskey API/Streaming health")
+	fmt.Println("  backup   Dump, compress and upload the database")
 	fmt.Println("  restore  Restore database from backup")
 	fmt.Println("  verify   Verify backup can be restored")
 	fmt.Println("  repair   Repair database inconsistencies")
+	fmt.Println("  backups  Monitor backups in storage (backups status)")
+	fmt.Println("  prune    Delete old backups by retention rules")
+	fmt.Println("  wal-push   Archive a WAL file to storage (archive_command)")
+	fmt.Println("  wal-fetch  Fetch an archived WAL file (restore_command)")
 	fmt.Println("  version  Show version")
 	fmt.Println("")
 	fmt.Println("Examples:")
 	fmt.Println("  yamisskey-doctor check example.com")
 	fmt.Println("  yamisskey-doctor check --format json example.com")
 	fmt.Println("  MISSKEY_TOKEN=xxx yamisskey-doctor check example.com")
+	fmt.Println("  yamisskey-doctor backups status --rpo 13h")
 }
 
 func main() {
@@ -1936,6 +2829,16 @@ func main() {
 		exitCode = cmdVerify(args)
 	case "repair":
 		exitCode = cmdRepair(args)
+	case "backups":
+		exitCode = cmdBackups(args)
+	case "prune":
+		exitCode = cmdPrune(args)
+	case "backup":
+		exitCode = cmdBackup(args)
+	case "wal-push":
+		exitCode = cmdWALPush(args)
+	case "wal-fetch":
+		exitCode = cmdWALFetch(args)
 	case "version", "--version", "-v":
 		fmt.Println(version)
 		exitCode = 0
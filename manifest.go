@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ===== Checksum manifests =====
+
+// backupManifest describes the bytes a backup job uploaded. It is read from a
+// sidecar next to the backup: either <file>.manifest.json or a sha256sum style
+// <file>.sha256.
+type backupManifest struct {
+	File      string    `json:"file,omitempty"`
+	Size      int64     `json:"size,omitempty"`
+	SHA256    string    `json:"sha256"`
+	PGVersion string    `json:"pgVersion,omitempty"`
+	CreatedAt time.Time `json:"createdAt,omitempty"`
+
+	Source string `json:"-"` // sidecar file the manifest was read from
+}
+
+// manifestSuffixes lists sidecar suffixes in lookup order
+var manifestSuffixes = []string{".manifest.json", ".sha256"}
+
+// maxManifestSize bounds how much of a sidecar is read
+const maxManifestSize = 1 << 20
+
+// backupDigest is the hash of a backup and the manifest it was checked against.
+type backupDigest struct {
+	Size     int64
+	SHA256   string
+	Manifest *backupManifest // nil if the backup has no sidecar
+}
+
+// findManifest looks for a sidecar of backup name using read, which returns an
+// error matching os.ErrNotExist if the sidecar does not exist. It returns nil
+// if there is none; any other error is returned, so that a failing storage is
+// not taken for a backup without a manifest.
+func findManifest(name string, read func(string) ([]byte, error)) (*backupManifest, error) {
+	for _, suffix := range manifestSuffixes {
+		sidecar := name + suffix
+		data, err := read(sidecar)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read manifest %s: %w", sidecar, err)
+		}
+		m, err := parseManifest(path.Base(name), suffix, data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid manifest %s: %w", sidecar, err)
+		}
+		m.Source = sidecar
+		return m, nil
+	}
+	return nil, nil
+}
+
+// loadStoredManifest returns the sidecar manifest of a backup in storage, or nil
+func loadStoredManifest(ctx context.Context, store Storage, name string) (*backupManifest, error) {
+	return findManifest(name, func(sidecar string) ([]byte, error) {
+		if _, err := store.Stat(ctx, sidecar); err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if _, err := store.Download(ctx, sidecar, &limitedWriter{w: &buf, n: maxManifestSize}); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	})
+}
+
+// loadLocalManifest returns the sidecar manifest of a local dump file, or nil
+func loadLocalManifest(p string) (*backupManifest, error) {
+	return findManifest(p, os.ReadFile)
+}
+
+// parseManifest decodes a JSON manifest or a sha256sum line for file base
+func parseManifest(base, suffix string, data []byte) (*backupManifest, error) {
+	m := &backupManifest{}
+	if suffix == ".manifest.json" {
+		if err := json.Unmarshal(data, m); err != nil {
+			return nil, err
+		}
+	} else {
+		// "<hash>  <file>", "<hash> *<file>" or a bare hash
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) == 1 || path.Base(strings.TrimPrefix(fields[1], "*")) == base {
+				m.SHA256 = fields[0]
+				break
+			}
+		}
+	}
+
+	m.SHA256 = strings.ToLower(strings.TrimSpace(m.SHA256))
+	if _, err := hex.DecodeString(m.SHA256); err != nil || len(m.SHA256) != sha256.Size*2 {
+		return nil, fmt.Errorf("no valid sha256 for %s", base)
+	}
+	return m, nil
+}
+
+// check compares a backup's size and hash against the manifest
+func (m *backupManifest) check(size int64, sum string) error {
+	if m.Size > 0 && size != m.Size {
+		return fmt.Errorf("%w: size %d does not match manifest %s (%d)", errCorruptBackup, size, m.Source, m.Size)
+	}
+	if sum != m.SHA256 {
+		return fmt.Errorf("%w: sha256 %s does not match manifest %s (%s)", errCorruptBackup, sum, m.Source, m.SHA256)
+	}
+	return nil
+}
+
+// describe summarises the manifest for logs
+func (m *backupManifest) describe() string {
+	var parts []string
+	if m.PGVersion != "" {
+		parts = append(parts, "PostgreSQL "+m.PGVersion)
+	}
+	if !m.CreatedAt.IsZero() {
+		parts = append(parts, "created "+m.CreatedAt.Format(time.RFC3339))
+	}
+	if len(parts) == 0 {
+		return m.Source
+	}
+	return fmt.Sprintf("%s (%s)", m.Source, strings.Join(parts, ", "))
+}
+
+// hashLocalFile returns the sha256 of a local file and checks it against its
+// sidecar manifest if one exists.
+func hashLocalFile(p string) (*backupDigest, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash %s: %w", p, err)
+	}
+	digest := &backupDigest{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}
+
+	m, err := loadLocalManifest(p)
+	if err != nil || m == nil {
+		return digest, err
+	}
+	digest.Manifest = m
+	if err := m.check(n, digest.SHA256); err != nil {
+		return digest, err
+	}
+	return digest, nil
+}
+
+// limitedWriter fails once more than n bytes are written
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > l.n {
+		return 0, fmt.Errorf("manifest larger than %d bytes", maxManifestSize)
+	}
+	l.n -= int64(len(p))
+	return l.w.Write(p)
+}
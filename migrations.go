@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ===== Misskey migration state =====
+
+// Misskey has no list of the migrations each release ships, but it uses
+// calendar versions (2025.1.0, 2025.1.1-beta.2, 2025.4.0-yami-1.2.0) and names
+// migrations after the time they were written (Foo1736000000000). A backup
+// whose newest migration is well after the release month was taken by newer
+// code; one whose newest migration is months before it will be migrated when
+// Misskey starts.
+const (
+	migrationNewerGrace = 31 * 24 * time.Hour // patch releases of a month ship later
+	migrationOlderGrace = 92 * 24 * time.Hour // releases without migrations
+)
+
+// Migration states
+const (
+	migrationMatch   = "match"   // consistent with the Misskey version
+	migrationOlder   = "older"   // backup predates the running code
+	migrationNewer   = "newer"   // backup postdates the running code
+	migrationUnknown = "unknown" // no version to compare against
+	migrationMissing = "missing" // no migrations table in the backup
+)
+
+// MigrationState describes the TypeORM migrations table of a restored backup
+type MigrationState struct {
+	Count    int       `json:"count"`
+	Latest   string    `json:"latest,omitempty"`   // name of the newest applied migration
+	LatestAt time.Time `json:"latestAt,omitempty"` // when it was written, from its timestamp
+	Version  string    `json:"version,omitempty"`  // Misskey version compared against
+	Source   string    `json:"source,omitempty"`   // where Version came from: flag or the /api/meta URL
+	Status   string    `json:"status"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// ok reports whether the backup fits the Misskey version, or could not be compared
+func (m *MigrationState) ok() bool {
+	return m.Status == migrationMatch || m.Status == migrationUnknown
+}
+
+func (m *MigrationState) String() string {
+	status := "OK"
+	if !m.ok() {
+		status = "WARN"
+	}
+	if m.Latest == "" {
+		return fmt.Sprintf("%s  %s", status, m.Detail)
+	}
+	line := fmt.Sprintf("%s  %d applied, newest %s (%s)", status, m.Count, m.Latest, m.LatestAt.Format("2006-01-02"))
+	if m.Detail != "" {
+		line += "; " + m.Detail
+	}
+	return line
+}
+
+// resolveMisskeyVersion fills in cfg.MisskeyVersion from MISSKEY_URL's
+// /api/meta unless it was given. Call it before Misskey is stopped.
+func resolveMisskeyVersion(ctx context.Context, cfg *RestoreConfig) {
+	if cfg.MisskeyVersion != "" {
+		cfg.MisskeyVersionSource = "flag"
+		return
+	}
+	if cfg.MisskeyURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	meta, err := fetchMeta(ctx, strings.TrimRight(cfg.MisskeyURL, "/"))
+	if err != nil {
+		progress.printf("Warning: could not get the Misskey version from %s: %v", cfg.MisskeyURL, err)
+		return
+	}
+	cfg.MisskeyVersion = meta.Version
+	cfg.MisskeyVersionSource = cfg.MisskeyURL
+	progress.printf("Misskey version: %s (%s)", meta.Version, cfg.MisskeyURL)
+}
+
+// checkMigrations reads the migrations table of database and compares its
+// newest migration against cfg.MisskeyVersion
+func checkMigrations(ctx context.Context, cfg *RestoreConfig, database string) (*MigrationState, error) {
+	conn, err := connectDB(ctx, cfg, database)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	m := &MigrationState{Version: cfg.MisskeyVersion, Source: cfg.MisskeyVersionSource}
+	exists, err := tableExists(ctx, conn, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		m.Status = migrationMissing
+		m.Detail = "no migrations table; this does not look like a Misskey database"
+		return m, nil
+	}
+
+	var ts int64
+	err = conn.QueryRow(ctx,
+		`SELECT name, "timestamp", (SELECT COUNT(*) FROM migrations) FROM migrations ORDER BY "timestamp" DESC, id DESC LIMIT 1`,
+	).Scan(&m.Latest, &ts, &m.Count)
+	if errors.Is(err, pgx.ErrNoRows) {
+		m.Status = migrationMissing
+		m.Detail = "migrations table is empty"
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+	m.LatestAt = time.UnixMilli(ts).UTC()
+
+	m.compare()
+	return m, nil
+}
+
+// compare sets Status from the newest migration and the version's release month
+func (m *MigrationState) compare() {
+	if m.Version == "" {
+		m.Status = migrationUnknown
+		m.Detail = "no Misskey version to compare against (set MISSKEY_URL or --misskey-version)"
+		return
+	}
+	month, ok := versionMonth(m.Version)
+	if !ok {
+		m.Status = migrationUnknown
+		m.Detail = fmt.Sprintf("cannot compare against version %s", m.Version)
+		return
+	}
+
+	switch {
+	case m.LatestAt.After(month.AddDate(0, 1, 0).Add(migrationNewerGrace)):
+		m.Status = migrationNewer
+		m.Detail = fmt.Sprintf("backup postdates Misskey %s; upgrade Misskey before starting it on this database", m.Version)
+	case m.LatestAt.Before(month.Add(-migrationOlderGrace)):
+		m.Status = migrationOlder
+		m.Detail = fmt.Sprintf("backup likely predates Misskey %s; pending migrations will run when Misskey starts", m.Version)
+	default:
+		m.Status = migrationMatch
+		m.Detail = fmt.Sprintf("consistent with Misskey %s", m.Version)
+	}
+}
+
+var calendarVersion = regexp.MustCompile(`^(\d{4})\.(\d{1,2})\.`)
+
+// versionMonth returns the first day of the month a calendar version was released in
+func versionMonth(version string) (time.Time, bool) {
+	match := calendarVersion.FindStringSubmatch(version)
+	if match == nil {
+		return time.Time{}, false
+	}
+	year, _ := strconv.Atoi(match[1])
+	month, _ := strconv.Atoi(match[2])
+	if month < 1 || month > 12 {
+		return time.Time{}, false
+	}
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.UTC), true
+}
+
+// verifyMigrations checks the migrations of a verified backup; errors are
+// reported but do not fail the verification
+func verifyMigrations(ctx context.Context, cfg *RestoreConfig, database string) *MigrationState {
+	m, err := checkMigrations(ctx, cfg, database)
+	if err != nil {
+		progress.printf("Warning: failed to check migrations: %v", err)
+		return nil
+	}
+	progress.printf("      Migrations: %s", m)
+	return m
+}
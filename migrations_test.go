@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersionMonth(t *testing.T) {
+	tests := []struct {
+		version string
+		want    string // "" if unparsable
+	}{
+		{"2025.4.0", "2025-04"},
+		{"2025.4.0-beta.3", "2025-04"},
+		{"2025.12.1-yami-1.8.0", "2025-12"},
+		{"2024.11.0-alpha.2-yami-1.0.0", "2024-11"},
+		{"2025.13.0", ""},
+		{"2025.0.1", ""},
+		{"2025.4", ""},
+		{"12.119.2", ""},
+		{"latest", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		month, ok := versionMonth(tt.version)
+		got := ""
+		if ok {
+			got = month.Format("2006-01")
+		}
+		if got != tt.want {
+			t.Errorf("versionMonth(%q) = %q, want %q", tt.version, got, tt.want)
+		}
+	}
+}
+
+func TestMigrationStateCompare(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  string
+		latestAt string
+		want     string
+	}{
+		{"no version", "", "2025-04-10 00:00", migrationUnknown},
+		{"unparsable version", "12.119.2", "2025-04-10 00:00", migrationUnknown},
+		{"same month", "2025.4.0", "2025-04-10 00:00", migrationMatch},
+		{"beta", "2025.4.0-beta.3", "2025-03-20 00:00", migrationMatch},
+		{"yami fork", "2025.4.1-yami-1.2.0", "2025-04-30 23:59", migrationMatch},
+		{"newer grace ends", "2025.4.0", "2025-06-01 00:00", migrationMatch},
+		{"newer", "2025.4.0", "2025-06-01 00:01", migrationNewer},
+		{"newer across the year", "2024.12.0", "2025-02-01 00:01", migrationNewer},
+		{"december within grace", "2024.12.0", "2025-01-31 23:59", migrationMatch},
+		{"older grace ends", "2025.4.0", "2024-12-30 00:00", migrationMatch},
+		{"older", "2025.4.0", "2024-12-29 23:59", migrationOlder},
+		{"older across the year", "2025.1.0-yami-1.0.0", "2024-09-30 23:59", migrationOlder},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			latest, err := time.Parse("2006-01-02 15:04", tt.latestAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := &MigrationState{Version: tt.version, LatestAt: latest}
+			m.compare()
+			if m.Status != tt.want {
+				t.Errorf("status = %s (%s), want %s", m.Status, m.Detail, tt.want)
+			}
+		})
+	}
+}
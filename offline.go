@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// ===== Offline verification =====
+
+// offlineIntegrityChecks runs the checks of runIntegrityChecks that a parsed
+// dump can answer: the tables it creates and the rows it copies into them.
+// misskeyRules need the data itself and are left to a real restore.
+func offlineIntegrityChecks(c *DumpCheck) ([]VerifyCheck, int) {
+	var checks []VerifyCheck
+
+	tableCount := 0
+	for table := range c.TableRows {
+		if !strings.Contains(table, ".") {
+			tableCount++
+		}
+	}
+	checks = append(checks, VerifyCheck{
+		Name:     "table_count",
+		OK:       tableCount > 0,
+		Severity: severityError,
+		Detail:   fmt.Sprintf("%d tables", tableCount),
+	})
+
+	for _, table := range criticalTables {
+		_, exists := c.TableRows[table]
+		checks = append(checks, VerifyCheck{
+			Name:     fmt.Sprintf("table_%s", table),
+			OK:       exists,
+			Severity: severityError,
+			Detail:   fmt.Sprintf("table '%s' exists: %v", table, exists),
+		})
+	}
+
+	for _, count := range []struct{ name, table, unit string }{
+		{"user_count", "user", "users"},
+		{"note_count", "note", "notes"},
+	} {
+		rows, exists := c.TableRows[count.table]
+		if !exists {
+			checks = append(checks, VerifyCheck{
+				Name:   count.name,
+				Detail: fmt.Sprintf("table '%s' not in dump", count.table),
+			})
+			continue
+		}
+		checks = append(checks, VerifyCheck{
+			Name:   count.name,
+			OK:     true,
+			Detail: fmt.Sprintf("%d %s", rows, count.unit),
+		})
+	}
+
+	return checks, tableCount
+}
+
+// checkOffline parses dump instead of restoring it and runs the checks the
+// parse can answer
+func (r *VerifyResult) checkOffline(cfg *RestoreConfig, dump *dumpSource) error {
+	check, err := scanDump(cfg, dump)
+	if err != nil {
+		return err
+	}
+	r.Dump = check
+	r.DumpOK = check.OK
+	progress.printf("      Dump %s", check)
+
+	r.Checks, r.Tables = offlineIntegrityChecks(check)
+	r.IntegrityOK = integrityOK(r.Checks)
+	return nil
+}
+
+// offlineTools lists the external commands needed to parse filename: those of
+// a restore except psql, as nothing is loaded
+func offlineTools(cfg *RestoreConfig, filename string) []string {
+	var tools []string
+	for _, tool := range requiredTools(cfg, filename) {
+		if tool != "psql" {
+			tools = append(tools, tool)
+		}
+	}
+	return tools
+}
+
+// cmdVerifyOffline verifies a stored backup, or a local dump if store is nil,
+// by parsing the dump in place of restoring it. No PostgreSQL server is needed.
+func cmdVerifyOffline(ctx context.Context, cfg *RestoreConfig, store Storage, name string, format string) int {
+	result := VerifyResult{
+		BackupFile: name,
+		Offline:    true,
+	}
+	fail := func(stage string, err error) int {
+		result.Error = fmt.Sprintf("%s failed: %v", stage, err)
+		printVerifyResult(&result, format)
+		return 1
+	}
+
+	// Local dumps are recognised by their content, not by name
+	if store != nil {
+		for _, tool := range offlineTools(cfg, name) {
+			if _, err := exec.LookPath(tool); err != nil {
+				progress.errorf("required tool '%s' not found in PATH", tool)
+				return 1
+			}
+		}
+	}
+
+	progress.printf("Verifying backup offline (parsing the dump, no PostgreSQL): %s", name)
+
+	switch {
+	case store == nil:
+		if _, err := os.Stat(name); err != nil {
+			progress.errorf("file not found: %s", name)
+			return 1
+		}
+		result.DownloadOK = true // N/A for local
+		progress.stepf(1, 2, "extract", "Extracting dump...")
+		if kind, _ := detectFileFormat(name); kind != formatDirectory {
+			digest, err := hashLocalFile(name)
+			result.setDigest(digest)
+			if err != nil {
+				return fail("Checksum", err)
+			}
+		}
+		dump, err := prepareDump(cfg, name)
+		if err != nil {
+			return fail("Extract", err)
+		}
+		defer dump.Close()
+		result.ExtractOK = true
+
+		progress.stepf(2, 2, "parse", "Parsing dump...")
+		if err := result.checkOffline(cfg, dump); err != nil {
+			return fail("Parse", err)
+		}
+
+	case cfg.Stream:
+		progress.stepf(1, 1, "parse", "Streaming and parsing dump...")
+		digest, err := streamRestore(ctx, cfg, store, name, func(dump *dumpSource) error {
+			return result.checkOffline(cfg, dump)
+		})
+		result.setDigest(digest)
+		if err != nil && digest != nil {
+			return fail("Checksum", err)
+		}
+		if err != nil {
+			return fail("Parse", err)
+		}
+		result.DownloadOK = true
+		result.ExtractOK = true
+
+	default:
+		progress.stepf(1, 3, "download", "Downloading backup...")
+		archivePath, digest, err := downloadBackup(ctx, cfg, store, name)
+		result.setDigest(digest)
+		if err != nil {
+			return fail("Download", err)
+		}
+		defer discardDownload(cfg, archivePath)
+		result.DownloadOK = true
+
+		progress.stepf(2, 3, "extract", "Extracting archive...")
+		dump, err := prepareDump(cfg, archivePath)
+		if err != nil {
+			return fail("Extract", err)
+		}
+		defer dump.Close()
+		result.ExtractOK = true
+
+		progress.stepf(3, 3, "parse", "Parsing dump...")
+		if err := result.checkOffline(cfg, dump); err != nil {
+			return fail("Parse", err)
+		}
+	}
+
+	result.OK = result.DownloadOK && result.ExtractOK && result.DumpOK && result.IntegrityOK
+	printVerifyResult(&result, format)
+	if result.OK {
+		return 0
+	}
+	return 1
+}
+
+// largestTables is how many tables printTableRows lists
+const largestTables = 10
+
+// printTableRows lists the largest tables of a parsed dump by rows
+func printTableRows(rows map[string]int64) {
+	tables := make([]string, 0, len(rows))
+	for table := range rows {
+		tables = append(tables, table)
+	}
+	sort.Slice(tables, func(i, j int) bool {
+		if rows[tables[i]] != rows[tables[j]] {
+			return rows[tables[i]] > rows[tables[j]]
+		}
+		return tables[i] < tables[j]
+	})
+	fmt.Println("\nLargest tables (rows):")
+	for i, table := range tables {
+		if i == largestTables {
+			fmt.Printf("  ... %d more (see tableRows in --format json)\n", len(tables)-i)
+			break
+		}
+		fmt.Printf("  %-15s %d\n", table, rows[table])
+	}
+}
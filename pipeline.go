@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bodgit/sevenzip"
+)
+
+// ===== Streaming pipeline =====
+
+// streamStats counts bytes flowing through a backup stream.
+type streamStats struct {
+	Size         int64        // compressed size reported by storage
+	Downloaded   atomic.Int64 // compressed bytes read from storage
+	Decompressed atomic.Int64 // SQL bytes handed to the consumer
+
+	hashed *hashingReaderAt // sha256 of the stored bytes as they were read
+}
+
+// openBackupStream opens a backup in storage and returns its decompressed dump
+// without writing anything to disk. A 7z archive keeps its index at the end, so
+// it is read through ranged requests rather than a single sequential download.
+func openBackupStream(ctx context.Context, cfg *RestoreConfig, store Storage, name string) (*dumpSource, *streamStats, error) {
+	if formatFromName(name) == formatDirectory {
+		return nil, nil, fmt.Errorf("directory dumps cannot be streamed; restore without --stream")
+	}
+
+	info, err := store.Stat(ctx, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("backup not found: %w", err)
+	}
+
+	src, err := store.Open(ctx, name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open backup: %w", err)
+	}
+
+	stats := &streamStats{Size: info.Size, hashed: newHashingReaderAt(src)}
+	counted := &countingReaderAt{r: stats.hashed, n: &stats.Downloaded}
+
+	// The header is read with Read, not ReadAt: S3 objects move their Read
+	// offset on ReadAt, so the two must not be mixed on a sequential stream
+	header := make([]byte, sniffLen)
+	n, err := io.ReadFull(counted, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		src.Close()
+		return nil, nil, fmt.Errorf("failed to read backup header: %w", err)
+	}
+	header = header[:n]
+
+	var dump *dumpSource
+	if sniffFormat(header) == format7z {
+		archive, err := sevenzip.NewReaderWithPassword(counted, info.Size, cfg.BackupPassword)
+		if err != nil {
+			src.Close()
+			return nil, nil, classify7zReaderError(cfg, err)
+		}
+		entry := firstArchiveFile(archive.File)
+		if entry == nil {
+			src.Close()
+			return nil, nil, fmt.Errorf("archive %s is empty", name)
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			src.Close()
+			return nil, nil, classify7zReaderError(cfg, err)
+		}
+		dump, err = openDumpStream(cfg, &corruptOnError{r: rc}, src, rc)
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		// Compressed, encrypted or plain dump read sequentially
+		dump, err = openDumpStream(cfg, io.MultiReader(bytes.NewReader(header), counted), src)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	dump.Reader = &countingReader{r: dump.Reader, n: &stats.Decompressed}
+	return dump, stats, nil
+}
+
+// firstArchiveFile returns the first file of a 7z archive, the dump of a backup
+func firstArchiveFile(files []*sevenzip.File) *sevenzip.File {
+	for _, f := range files {
+		if !f.FileInfo().IsDir() {
+			return f
+		}
+	}
+	return nil
+}
+
+// classify7zReaderError labels a 7z decoding failure. 7z has no password check,
+// so with a password configured a bad key and a damaged archive look alike.
+func classify7zReaderError(cfg *RestoreConfig, err error) error {
+	if cfg.BackupPassword != "" {
+		return fmt.Errorf("%w (or the archive is corrupt): %v", errWrongKey, err)
+	}
+	return fmt.Errorf("%w (or encrypted; set BACKUP_PASSWORD): %v", errCorruptBackup, err)
+}
+
+// reportStreamProgress reports byte counters every interval until done is closed.
+func reportStreamProgress(stats *streamStats, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			progress.bytes(fmt.Sprintf("read from storage (%s decompressed)", formatBytes(stats.Decompressed.Load())),
+				stats.Downloaded.Load(), stats.Size)
+		}
+	}
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// countingReaderAt counts bytes read through it, sequentially or at offsets.
+type countingReaderAt struct {
+	r BackupReader
+	n *atomic.Int64
+}
+
+func (c *countingReaderAt) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// hashingReaderAt hashes a stored backup as it is read, so that its checksum
+// is of the very bytes that were restored. Reads may come at any offset (7z
+// reads its index at the end first); the hash takes in the contiguous prefix
+// read so far, and finish reads whatever the consumer left out.
+type hashingReaderAt struct {
+	r   BackupReader
+	mu  sync.Mutex
+	hw  *hashingWriter
+	off int64 // offset of the next Read
+}
+
+func newHashingReaderAt(r BackupReader) *hashingReaderAt {
+	return &hashingReaderAt{r: r, hw: newHashingWriter(io.Discard)}
+}
+
+func (h *hashingReaderAt) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.mu.Lock()
+	h.add(p[:n], h.off)
+	h.off += int64(n)
+	h.mu.Unlock()
+	return n, err
+}
+
+func (h *hashingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := h.r.ReadAt(p, off)
+	h.mu.Lock()
+	h.add(p[:n], off)
+	h.mu.Unlock()
+	return n, err
+}
+
+func (h *hashingReaderAt) Close() error {
+	return h.r.Close()
+}
+
+// add hashes the part of p, read at off, that extends the hashed prefix
+func (h *hashingReaderAt) add(p []byte, off int64) {
+	if off <= h.hw.n && off+int64(len(p)) > h.hw.n {
+		h.hw.Write(p[h.hw.n-off:])
+	}
+}
+
+// finish reads the rest of the object and returns its size and sha256
+func (h *hashingReaderAt) finish() (int64, string, error) {
+	buf := make([]byte, 1<<20)
+	for {
+		h.mu.Lock()
+		off := h.hw.n
+		h.mu.Unlock()
+		_, err := h.ReadAt(buf, off)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, "", fmt.Errorf("failed to read backup for checksum: %w", err)
+		}
+	}
+	return h.hw.n, h.hw.sum(), nil
+}
+
+// formatBytes renders a byte count with a binary unit suffix.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type memObject struct {
+	*bytes.Reader
+}
+
+func (memObject) Close() error { return nil }
+
+func TestHashingReaderAt(t *testing.T) {
+	data := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(1)).Read(data)
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	type read struct {
+		off int64 // -1 for a sequential Read
+		n   int
+	}
+	tests := []struct {
+		name  string
+		reads []read
+	}{
+		{"nothing read", nil},
+		{"sequential to the end", []read{{-1, len(data)}, {-1, 10}}},
+		{"sequential, stopped early", []read{{-1, 1000}, {-1, 5000}}},
+		{"index at the end first", []read{{int64(len(data)) - 100, 100}, {0, 32}, {32, 4096}, {4128, 1 << 20}}},
+		{"overlapping reads", []read{{0, 100}, {50, 100}, {10, 20}, {150, 50}}},
+		{"gap left open", []read{{0, 100}, {200, 100}}},
+		{"header read, then ReadAt", []read{{-1, 262}, {262, 1000}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHashingReaderAt(memObject{bytes.NewReader(data)})
+			for _, r := range tt.reads {
+				buf := make([]byte, r.n)
+				if r.off < 0 {
+					io.ReadFull(h, buf)
+				} else {
+					h.ReadAt(buf, r.off)
+				}
+			}
+			size, got, err := h.finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != int64(len(data)) || got != want {
+				t.Errorf("finish() = %d, %s; want %d, %s", size, got, len(data), want)
+			}
+		})
+	}
+}
+
+func TestStreamRestore(t *testing.T) {
+	sql := []byte("--\n-- PostgreSQL database dump\n--\nSELECT 1;\n")
+	var zst bytes.Buffer
+	zw, err := compress(formatZstd, &zst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(sql)
+	zw.Close()
+	sum := sha256.Sum256(zst.Bytes())
+	good := hex.EncodeToString(sum[:])
+	bad := hex.EncodeToString(make([]byte, sha256.Size))
+
+	readAll := func(dump *dumpSource) error {
+		got, err := io.ReadAll(dump.Reader)
+		if err == nil && !bytes.Equal(got, sql) {
+			err = fmt.Errorf("read %q", got)
+		}
+		return err
+	}
+	readSome := func(dump *dumpSource) error {
+		_, err := dump.Reader.Read(make([]byte, 4))
+		return err
+	}
+
+	tests := []struct {
+		name     string
+		manifest string // sha256 in the sidecar, "" for none
+		restore  func(*dumpSource) error
+		corrupt  bool
+	}{
+		{"no manifest", "", readAll, false},
+		{"matching manifest", good, readAll, false},
+		{"consumer stops early", good, readSome, false},
+		{"mismatch", bad, readAll, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := "mk1_2025-01-01_03-00.sql.zst"
+			if err := os.WriteFile(filepath.Join(dir, name), zst.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if tt.manifest != "" {
+				m := fmt.Sprintf(`{"sha256": %q, "size": %d}`, tt.manifest, zst.Len())
+				if err := os.WriteFile(filepath.Join(dir, name+".manifest.json"), []byte(m), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			store, err := newLocalStorage(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			digest, err := streamRestore(context.Background(), &RestoreConfig{}, store, name, tt.restore)
+			if tt.corrupt != errors.Is(err, errCorruptBackup) || (!tt.corrupt && err != nil) {
+				t.Fatalf("err = %v, want corrupt %v", err, tt.corrupt)
+			}
+			if digest == nil || digest.SHA256 != good || digest.Size != int64(zst.Len()) {
+				t.Fatalf("digest = %+v, want sha256 %s of %d bytes", digest, good, zst.Len())
+			}
+			if (digest.Manifest != nil) != (tt.manifest != "") {
+				t.Errorf("Manifest = %+v", digest.Manifest)
+			}
+		})
+	}
+}
+
+// failingStorage fails every read, so a test can tell that none was made
+type failingStorage struct{ Storage }
+
+func (failingStorage) Open(context.Context, string) (BackupReader, error) {
+	return nil, errors.New("unexpected Open")
+}
+
+func (failingStorage) Download(context.Context, string, io.Writer) (int64, error) {
+	return 0, errors.New("unexpected Download")
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	sum := sha256.Sum256(data)
+	want := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		part int  // bytes already in the .part file, -1 for none
+		read bool // whether the object is read from storage
+	}{
+		{"fresh", -1, true},
+		{"resumed", 1000, true},
+		{"complete part", len(data), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := t.TempDir()
+			if err := os.WriteFile(filepath.Join(src, "mk1.dump"), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			local, err := newLocalStorage(src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var store Storage = local
+			if !tt.read {
+				store = failingStorage{local}
+			}
+
+			dst := filepath.Join(t.TempDir(), "mk1.dump")
+			if tt.part >= 0 {
+				if err := os.WriteFile(dst+".part", data[:tt.part], 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			obj := BackupObject{Name: "mk1.dump", Size: int64(len(data))}
+			got, err := downloadFile(context.Background(), store, obj, dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("sha256 = %s, want %s", got, want)
+			}
+			if b, err := os.ReadFile(dst); err != nil || !bytes.Equal(b, data) {
+				t.Errorf("downloaded file differs (err %v)", err)
+			}
+			if _, err := os.Stat(dst + ".part"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf(".part left behind: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== Point-in-time recovery =====
+
+// Base backups (pg_basebackup tars) and the WAL archive live in the same
+// storage as the dumps:
+//
+//	basebackups/base_2025-01-01_03-00.tar.zst (+ .manifest.json)
+//	wal/000000010000000000000042.zst
+//
+// Neither looks like a dump, so the catalog, prune and dump restores ignore them.
+const (
+	baseBackupDir = "basebackups"
+	walArchiveDir = "wal"
+)
+
+// walFilePattern matches what archive_command is given: segments, partial
+// segments, backup history files and timeline histories
+var walFilePattern = regexp.MustCompile(`^([0-9A-F]{24}(\.partial|\.[0-9A-F]{8}\.backup)?|[0-9A-F]{8}\.history)$`)
+
+// walSuffixes are the compressions of archived WAL, in lookup order
+var walSuffixes = []string{".zst", ".gz", ""}
+
+// walObject is an archived WAL file
+type walObject struct {
+	File   string // name PostgreSQL knows it by
+	Object BackupObject
+}
+
+// listWAL returns the archived WAL files in storage
+func listWAL(objects []BackupObject) []walObject {
+	var wal []walObject
+	for _, obj := range objects {
+		rest, ok := strings.CutPrefix(obj.Name, walArchiveDir+"/")
+		if !ok {
+			continue
+		}
+		for _, suffix := range walSuffixes {
+			if file := strings.TrimSuffix(rest, suffix); walFilePattern.MatchString(file) {
+				wal = append(wal, walObject{File: file, Object: obj})
+				break
+			}
+		}
+	}
+	return wal
+}
+
+// listBaseBackups returns the base backups in storage, newest first. Timestamp
+// is when the backup started, from its name; ModTime when its upload finished.
+func listBaseBackups(objects []BackupObject) []Backup {
+	var backups []Backup
+	for _, obj := range objects {
+		if !strings.HasPrefix(obj.Name, baseBackupDir+"/") || !isTarName(obj.Name) {
+			continue
+		}
+		b := Backup{Name: obj.Name, Size: obj.Size, ModTime: obj.ModTime, Timestamp: obj.ModTime}
+		if _, ts, ok := parseBackupName(obj.Name); ok {
+			b.Timestamp = ts
+		}
+		backups = append(backups, b)
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].ModTime.After(backups[j].ModTime)
+	})
+	return backups
+}
+
+func isTarName(name string) bool {
+	return strings.HasSuffix(name, ".tar") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".tar.zst")
+}
+
+// baseBackupName names a new base backup
+func baseBackupName(ts time.Time) string {
+	return fmt.Sprintf("%s/base_%s.tar.zst", baseBackupDir, ts.Format("2006-01-02_15-04"))
+}
+
+// ===== Base backup and WAL archiving =====
+
+// runBaseBackup streams a pg_basebackup tar of the cluster, compressed with
+// zstd, into storage as name and uploads its manifest. WAL is left out
+// (-X none): recovery takes it from the archive wal-push fills.
+func runBaseBackup(ctx context.Context, cfg *RestoreConfig, store Storage, name string) (*backupManifest, error) {
+	createdAt := time.Now()
+
+	pgVersion, err := serverVersion(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	progress.printf("Taking base backup of %s:%s (PostgreSQL %s) to %s...", cfg.PGHost, cfg.PGPort, pgVersion, name)
+	pr, pw := io.Pipe()
+	hw := newHashingWriter(pw)
+
+	backupErr := make(chan error, 1)
+	go func() {
+		err := runPGBaseBackup(cfg, hw)
+		pw.CloseWithError(err)
+		backupErr <- err
+	}()
+
+	// A failed backup closes the pipe with an error, so Put aborts the upload
+	putErr := store.Put(ctx, name, pr, -1)
+	pr.CloseWithError(putErr)
+	if err := <-backupErr; err != nil {
+		return nil, err
+	}
+	if putErr != nil {
+		return nil, putErr
+	}
+	progress.printf("Uploaded: %s (%s, sha256 %s)", name, formatBytes(hw.n), hw.sum())
+
+	return uploadManifest(ctx, store, &backupManifest{
+		File:      name,
+		Size:      hw.n,
+		SHA256:    hw.sum(),
+		PGVersion: pgVersion,
+		CreatedAt: createdAt,
+	})
+}
+
+// runPGBaseBackup writes pg_basebackup's tar to w, compressed with zstd
+func runPGBaseBackup(cfg *RestoreConfig, w io.Writer) error {
+	zw, err := compress(formatZstd, w)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("pg_basebackup",
+		"-h", cfg.PGHost,
+		"-p", cfg.PGPort,
+		"-U", cfg.PGUser,
+		"-D", "-",
+		"-Ft",
+		"-X", "none",
+		"--checkpoint=fast",
+	)
+	cmd.Env = os.Environ()
+	if cfg.PGPassword != "" {
+		cmd.Env = append(cmd.Env, "PGPASSWORD="+cfg.PGPassword)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdout = zw
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("pg_basebackup failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress base backup: %w", err)
+	}
+	return nil
+}
+
+// walPush archives the WAL file at p as wal/<name>.zst. Archiving a file
+// again succeeds if the archived copy is identical and fails otherwise, as
+// PostgreSQL expects of an archive_command. Only a file that is not in the
+// archive is uploaded; if storage cannot tell, the push fails and is retried.
+func walPush(ctx context.Context, store Storage, p string) error {
+	file := filepath.Base(p)
+	if !walFilePattern.MatchString(file) {
+		return fmt.Errorf("%s is not a WAL file name", file)
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return err
+	}
+
+	name := walArchiveDir + "/" + file + ".zst"
+	_, err = store.Stat(ctx, name)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to check for archived %s: %w", name, err)
+	}
+	if err == nil {
+		var archived bytes.Buffer
+		if err := fetchWAL(ctx, store, name, &archived); err != nil {
+			return fmt.Errorf("failed to compare with archived %s: %w", name, err)
+		}
+		if !bytes.Equal(archived.Bytes(), data) {
+			return fmt.Errorf("%s is already archived with different content", file)
+		}
+		fmt.Printf("%s already archived\n", file)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw, err := compress(formatZstd, &buf)
+	if err != nil {
+		return err
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := store.Put(ctx, name, bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		return err
+	}
+	fmt.Printf("Archived %s (%s)\n", file, formatBytes(int64(buf.Len())))
+	return nil
+}
+
+// fetchWAL writes the decompressed content of an archived WAL object to w
+func fetchWAL(ctx context.Context, store Storage, name string, w io.Writer) error {
+	var format dumpFormat
+	switch {
+	case strings.HasSuffix(name, ".zst"):
+		format = formatZstd
+	case strings.HasSuffix(name, ".gz"):
+		format = formatGzip
+	default:
+		_, err := store.Download(ctx, name, w)
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		_, err := store.Download(ctx, name, pw)
+		pw.CloseWithError(err)
+	}()
+	dec, err := decompress(format, pr)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	_, err = io.Copy(w, dec)
+	return err
+}
+
+// writeWALFile fetches an archived WAL object into dest
+func writeWALFile(ctx context.Context, store Storage, name, dest string) error {
+	tmp := dest + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = fetchWAL(ctx, store, name, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to fetch %s: %w", name, err)
+	}
+	return nil
+}
+
+func cmdWALPush(args []string) int {
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	var file string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-s", "--storage":
+			if i+1 < len(args) {
+				cfg.StorageType = args[i+1]
+				i++
+			}
+		case "-h", "--help":
+			printWALUsage()
+			return 0
+		default:
+			file = args[i]
+		}
+	}
+	if file == "" {
+		printWALUsage()
+		return 2
+	}
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	if err := walPush(context.Background(), store, file); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: wal-push: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func cmdWALFetch(args []string) int {
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	var files []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-s", "--storage":
+			if i+1 < len(args) {
+				cfg.StorageType = args[i+1]
+				i++
+			}
+		case "-h", "--help":
+			printWALUsage()
+			return 0
+		default:
+			files = append(files, args[i])
+		}
+	}
+	if len(files) != 2 {
+		printWALUsage()
+		return 2
+	}
+	file, dest := files[0], files[1]
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+	for _, suffix := range walSuffixes {
+		name := walArchiveDir + "/" + file + suffix
+		if _, err := store.Stat(ctx, name); err != nil {
+			continue
+		}
+		if err := writeWALFile(ctx, store, name, dest); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: wal-fetch: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	// PostgreSQL asks for files that do not exist (the next timeline) as a matter of course
+	fmt.Fprintf(os.Stderr, "wal-fetch: %s not in archive\n", file)
+	return 1
+}
+
+func printWALUsage() {
+	fmt.Println("Usage:")
+	fmt.Println("  yamisskey-doctor wal-push [-s storage] <path>")
+	fmt.Println("  yamisskey-doctor wal-fetch [-s storage] <file> <path>")
+	fmt.Println("")
+	fmt.Println("Archive WAL to storage (wal/<file>.zst) and fetch it back. In postgresql.conf:")
+	fmt.Println("")
+	fmt.Println("  archive_mode = on")
+	fmt.Printf("  archive_command = 'yamisskey-doctor wal-push %%p'\n")
+	fmt.Println("  archive_timeout = 5min")
+	fmt.Println("")
+	fmt.Println("The storage is configured by the same environment variables as restore, which")
+	fmt.Println("the PostgreSQL server process must have. Together with base backups")
+	fmt.Println("(backup --base) this allows restore --target-time.")
+}
+
+// ===== Recovery =====
+
+// selectWAL picks the archived WAL recovery from the segment start to target
+// needs: every timeline history, and the segments from start on up to and
+// including the first archived after target, which holds the records at
+// target. complete is false if no segment was archived after target yet.
+func selectWAL(wal []walObject, start string, target time.Time) (files []walObject, complete bool) {
+	var segments []walObject
+	for _, w := range wal {
+		switch {
+		case strings.HasSuffix(w.File, ".history"):
+			files = append(files, w)
+		case len(w.File) == 24 && w.File[8:] >= start[8:]:
+			segments = append(segments, w)
+		}
+	}
+
+	// By position in the WAL (log and segment number), then timeline
+	sort.Slice(segments, func(i, j int) bool {
+		a, b := segments[i].File, segments[j].File
+		if a[8:] != b[8:] {
+			return a[8:] < b[8:]
+		}
+		return a[:8] < b[:8]
+	})
+	for _, s := range segments {
+		files = append(files, s)
+		if s.Object.ModTime.After(target) {
+			return files, true
+		}
+	}
+	return files, false
+}
+
+// backupLabelStart matches the first segment a base backup needs in its backup_label
+var backupLabelStart = regexp.MustCompile(`START WAL LOCATION: \S+ \(file ([0-9A-F]{24})\)`)
+
+// readBackupLabel returns the first WAL segment the base backup in dataDir needs
+func readBackupLabel(dataDir string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, "backup_label"))
+	if err != nil {
+		return "", fmt.Errorf("not a base backup: %w", err)
+	}
+	m := backupLabelStart.FindSubmatch(data)
+	if m == nil {
+		return "", fmt.Errorf("no START WAL LOCATION in backup_label")
+	}
+	return string(m[1]), nil
+}
+
+// extractTar unpacks a (gzip or zstd compressed) tar into dir
+func extractTar(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(io.TeeReader(f, &progressWriter{label: "extracted", total: info.Size()}))
+	header, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	var r io.Reader = br
+	if format := sniffFormat(header); format == formatGzip || format == formatZstd {
+		dec, err := decompress(format, br)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", errCorruptBackup, format, err)
+		}
+		defer dec.Close()
+		r = dec
+	}
+
+	root := filepath.Clean(dir)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", errCorruptBackup, err)
+		}
+
+		target := filepath.Join(root, filepath.FromSlash(hdr.Name))
+		if target != root && !strings.HasPrefix(target, root+string(os.PathSeparator)) {
+			return fmt.Errorf("refusing to extract %s outside %s", hdr.Name, dir)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return fmt.Errorf("failed to extract %s: %w", hdr.Name, err)
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// recoveryTargetActions are the values of recovery_target_action
+var recoveryTargetActions = []string{"promote", "pause", "shutdown"}
+
+// pitrWALDir is where restore --target-time puts the WAL, inside the data directory
+const pitrWALDir = "pitr_wal"
+
+// writeRecoveryConfig makes dataDir start in targeted recovery: recovery.signal
+// plus restore_command and recovery_target_* in postgresql.auto.conf.
+// restore_command runs in the data directory, so it names the WAL by a
+// relative path: the server may mount the data directory somewhere else than
+// this tool does.
+func writeRecoveryConfig(dataDir string, target time.Time, action string) ([]string, error) {
+	settings := []string{
+		fmt.Sprintf("restore_command = %s", quoteLiteral(`cp "`+pitrWALDir+`/%f" "%p"`)),
+		fmt.Sprintf("recovery_target_time = %s", quoteLiteral(target.Format("2006-01-02 15:04:05-07:00"))),
+		"recovery_target_inclusive = off",
+		fmt.Sprintf("recovery_target_action = %s", quoteLiteral(action)),
+		"recovery_target_timeline = 'latest'",
+	}
+
+	conf, err := os.OpenFile(filepath.Join(dataDir, "postgresql.auto.conf"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(conf, "\n# Point-in-time recovery prepared by yamisskey-doctor on %s\n", time.Now().Format(time.RFC3339))
+	for _, s := range settings {
+		fmt.Fprintln(conf, s)
+	}
+	if err := conf.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dataDir, "recovery.signal"), nil, 0600); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// emptyDir reports whether dir is missing or has no entries
+func emptyDir(dir string) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	return len(entries) == 0, err
+}
+
+// cmdRestorePITR prepares dataDir to recover the cluster to target: the
+// newest base backup finished before target, the archived WAL up to target
+// and a recovery configuration. PostgreSQL does the replay when started.
+func cmdRestorePITR(ctx context.Context, cfg *RestoreConfig, store Storage, target time.Time, dataDir, action string) int {
+	if dataDir == "" {
+		progress.errorf("--target-time requires --data-dir (or PGDATA): the data directory to recover into")
+		return 1
+	}
+	if !containsString(recoveryTargetActions, action) {
+		progress.errorf("unknown --target-action %q (expected %s)", action, strings.Join(recoveryTargetActions, ", "))
+		return 1
+	}
+	if empty, err := emptyDir(dataDir); err != nil || !empty {
+		if err == nil {
+			err = fmt.Errorf("%s is not empty; stop PostgreSQL and move the old data directory aside first", dataDir)
+		}
+		progress.errorf("%v", err)
+		return 1
+	}
+
+	progress.printf("Fetching base backups and WAL archive from %s...", cfg.StorageType)
+	objects, err := store.List(ctx)
+	if err != nil {
+		progress.errorf("failed to list storage: %v", err)
+		return 1
+	}
+	var base *Backup
+	bases := listBaseBackups(objects)
+	for i := range bases {
+		if cfg.BackupFile != "" && bases[i].Name != cfg.BackupFile {
+			continue
+		}
+		if !bases[i].ModTime.After(target) {
+			base = &bases[i]
+			break
+		}
+	}
+	if base == nil {
+		progress.errorf("no base backup in %s/ finished before %s (take one with backup --base)", baseBackupDir, target.Format(time.RFC3339))
+		return 1
+	}
+	wal := listWAL(objects)
+	var newest time.Time
+	for _, w := range wal {
+		if w.Object.ModTime.After(newest) {
+			newest = w.Object.ModTime
+		}
+	}
+
+	progress.printf("Point-in-time recovery to %s", target.Format("2006-01-02 15:04:05 -07:00"))
+	progress.printf("   Base backup: %s (%s, taken %s)", base.Name, formatBytes(base.Size), base.Timestamp.Format("2006-01-02 15:04"))
+	progress.printf("   WAL archive: %d files, newest archived %s", len(wal), newest.Format("2006-01-02 15:04:05"))
+	progress.printf("   Data directory: %s", dataDir)
+	if !newest.After(target) {
+		progress.printf("   Warning: no WAL archived after the target yet; recovery stops at the end of the archive")
+	}
+
+	if cfg.DryRun {
+		fmt.Println("\n[DRY RUN] Would execute:")
+		fmt.Printf("  1. Download and extract: %s → %s\n", base.Name, dataDir)
+		fmt.Printf("  2. Download WAL from the backup's start segment to %s → %s\n", target.Format("2006-01-02 15:04:05"), filepath.Join(dataDir, pitrWALDir))
+		fmt.Printf("  3. Write recovery.signal and recovery_target_time to postgresql.auto.conf (action: %s)\n", action)
+		return 0
+	}
+
+	if !cfg.Force {
+		fmt.Print("\nType 'yes' to continue: ")
+		input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(input) != "yes" {
+			fmt.Println("Cancelled.")
+			return 0
+		}
+	}
+
+	progress.stepf(1, 3, "download", "Downloading base backup...")
+	archivePath, _, err := downloadBackup(ctx, cfg, store, base.Name)
+	if err != nil {
+		progress.errorf("%v", err)
+		return 1
+	}
+	defer discardDownload(cfg, archivePath)
+
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		progress.errorf("%v", err)
+		return 1
+	}
+	progress.printf("Extracting into %s...", dataDir)
+	if err := extractTar(archivePath, dataDir); err != nil {
+		progress.errorf("failed to extract base backup: %v", err)
+		return 1
+	}
+	if err := os.Chmod(dataDir, 0700); err != nil {
+		progress.errorf("%v", err)
+		return 1
+	}
+	start, err := readBackupLabel(dataDir)
+	if err != nil {
+		progress.errorf("%v", err)
+		return 1
+	}
+
+	files, complete := selectWAL(wal, start, target)
+	walDir := filepath.Join(dataDir, pitrWALDir)
+	progress.stepf(2, 3, "wal", "Downloading %d WAL files from %s...", len(files), start)
+	if err := os.MkdirAll(walDir, 0700); err != nil {
+		progress.errorf("%v", err)
+		return 1
+	}
+	var walTotal, walDone int64
+	for _, w := range files {
+		walTotal += w.Object.Size
+	}
+	for _, w := range files {
+		if err := writeWALFile(ctx, store, w.Object.Name, filepath.Join(walDir, w.File)); err != nil {
+			progress.errorf("%v", err)
+			return 1
+		}
+		walDone += w.Object.Size
+		progress.bytes("fetched", walDone, walTotal)
+	}
+
+	progress.stepf(3, 3, "recovery", "Writing recovery configuration...")
+	settings, err := writeRecoveryConfig(dataDir, target, action)
+	if err != nil {
+		progress.errorf("failed to write recovery configuration: %v", err)
+		return 1
+	}
+
+	fmt.Printf("\n✅ %s is ready for recovery to %s\n", dataDir, target.Format("2006-01-02 15:04:05 -07:00"))
+	for _, s := range settings {
+		fmt.Printf("   %s\n", s)
+	}
+	if !complete {
+		fmt.Println("\n⚠️  The archive ends before the target; PostgreSQL will stop with an error once")
+		fmt.Println("   it runs out of WAL unless the missing segments are archived first.")
+	}
+	fmt.Println("\nNext steps:")
+	if os.Geteuid() == 0 {
+		fmt.Printf("  chown -R postgres:postgres %s\n", dataDir)
+	}
+	fmt.Printf("  Start PostgreSQL on %s (e.g. pg_ctl -D %s start, or the database container)\n", dataDir, dataDir)
+	fmt.Printf("  It replays WAL up to the target and then does: %s\n", action)
+	fmt.Printf("  Once recovery has finished, delete %s\n", walDir)
+	return 0
+}
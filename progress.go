@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ===== Progress reporting =====
+
+// Progress goes to stderr so that stdout only carries the result of a command
+// (the verify JSON, for example).
+const (
+	progressText   = "text"   // human-readable lines
+	progressNDJSON = "ndjson" // one ProgressEvent per line
+	progressNone   = "none"
+)
+
+// ProgressEvent is one line of --progress ndjson output
+type ProgressEvent struct {
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"` // step, message, bytes, log or error
+	Step       string    `json:"step,omitempty"`
+	Index      int       `json:"index,omitempty"` // step number, 1-based
+	Total      int       `json:"total,omitempty"` // number of steps
+	Message    string    `json:"message,omitempty"`
+	Bytes      int64     `json:"bytes,omitempty"`
+	BytesTotal int64     `json:"bytesTotal,omitempty"`
+	ETASeconds int64     `json:"etaSeconds,omitempty"`
+}
+
+// progressReporter writes progress events for the current command
+type progressReporter struct {
+	mu   sync.Mutex
+	mode string
+	w    io.Writer
+
+	step      string
+	index     int
+	total     int
+	stepStart time.Time
+	lastBytes time.Time
+}
+
+// progress is the reporter of the running command, set up from --progress
+var progress = newProgressReporter(progressText, os.Stderr)
+
+func newProgressReporter(mode string, w io.Writer) *progressReporter {
+	return &progressReporter{mode: mode, w: w, stepStart: time.Now()}
+}
+
+// setProgressMode switches the reporter to text, ndjson or none
+func setProgressMode(mode string) error {
+	switch mode {
+	case progressText, progressNDJSON, progressNone:
+	default:
+		return fmt.Errorf("unknown --progress %q (expected text, ndjson or none)", mode)
+	}
+	progress = newProgressReporter(mode, os.Stderr)
+	return nil
+}
+
+func (p *progressReporter) emit(ev ProgressEvent, text string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.mode {
+	case progressText:
+		fmt.Fprintln(p.w, text)
+	case progressNDJSON:
+		ev.Time = time.Now()
+		if ev.Step == "" {
+			ev.Step = p.step
+		}
+		data, _ := json.Marshal(ev)
+		p.w.Write(append(data, '\n'))
+	}
+}
+
+// stepf starts step index of total, named step (download, extract, ...)
+func (p *progressReporter) stepf(index, total int, step, format string, a ...any) {
+	p.mu.Lock()
+	p.step, p.index, p.total = step, index, total
+	p.stepStart = time.Now()
+	p.lastBytes = time.Time{}
+	p.mu.Unlock()
+
+	msg := fmt.Sprintf(format, a...)
+	p.emit(ProgressEvent{Type: "step", Step: step, Index: index, Total: total, Message: msg},
+		fmt.Sprintf("[%d/%d] %s", index, total, msg))
+}
+
+// printf reports a message within the current step
+func (p *progressReporter) printf(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	p.emit(ProgressEvent{Type: "message", Message: strings.TrimSpace(msg)}, strings.TrimRight(msg, "\n"))
+}
+
+// errorf reports a failure; in text mode as an "Error: ..." line
+func (p *progressReporter) errorf(format string, a ...any) {
+	msg := fmt.Sprintf(format, a...)
+	p.emit(ProgressEvent{Type: "error", Message: msg}, "Error: "+msg)
+}
+
+// bytes reports done of total bytes (total 0 if unknown), at most every 10s
+// in text mode and every second as NDJSON, with an ETA from the step's rate
+func (p *progressReporter) bytes(label string, done, total int64) {
+	interval := 10 * time.Second
+	if p.mode == progressNDJSON {
+		interval = time.Second
+	}
+
+	p.mu.Lock()
+	now := time.Now()
+	finished := total > 0 && done >= total
+	if !finished && now.Sub(p.lastBytes) < interval {
+		p.mu.Unlock()
+		return
+	}
+	p.lastBytes = now
+	elapsed := now.Sub(p.stepStart)
+	p.mu.Unlock()
+
+	var eta time.Duration
+	if total > 0 && done > 0 && done < total {
+		eta = time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+	}
+
+	text := fmt.Sprintf("      %s %s", label, formatBytes(done))
+	if total > 0 {
+		text += fmt.Sprintf(" / %s (%d%%)", formatBytes(total), done*100/total)
+	}
+	if eta > 0 {
+		text += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	p.emit(ProgressEvent{
+		Type:       "bytes",
+		Message:    label,
+		Bytes:      done,
+		BytesTotal: total,
+		ETASeconds: int64(eta.Seconds()),
+	}, text)
+}
+
+// writer returns where the output of child processes (psql, 7z, pg_restore)
+// goes: stderr as is, or one "log" event per line as NDJSON
+func (p *progressReporter) writer() io.Writer {
+	switch p.mode {
+	case progressNDJSON:
+		return &progressLogWriter{p: p}
+	case progressNone:
+		return io.Discard
+	}
+	return p.w
+}
+
+// progressLogWriter turns lines of tool output into log events
+type progressLogWriter struct {
+	p   *progressReporter
+	buf []byte
+}
+
+func (w *progressLogWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := strings.TrimRight(string(w.buf[:i]), "\r"); line != "" {
+			w.p.emit(ProgressEvent{Type: "log", Message: line}, line)
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// progressWriter reports bytes written through it
+type progressWriter struct {
+	label string
+	total int64
+	done  int64
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	w.done += int64(len(b))
+	progress.bytes(w.label, w.done, w.total)
+	return len(b), nil
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// ===== Verification markers =====
+
+// verificationRecord is stored next to a backup after verify succeeds.
+type verificationRecord struct {
+	VerifiedAt time.Time     `json:"verifiedAt"`
+	Version    string        `json:"version"`
+	Result     *VerifyResult `json:"result"`
+}
+
+// recordVerification leaves a marker in storage showing that backup passed
+// verify. prune never deletes the newest backup carrying one.
+func recordVerification(ctx context.Context, store Storage, backup string, result *VerifyResult) error {
+	data, err := json.MarshalIndent(verificationRecord{
+		VerifiedAt: time.Now(),
+		Version:    version,
+		Result:     result,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := sidecarName(backup, verifiedSuffix)
+	return store.Put(ctx, name, bytes.NewReader(data), int64(len(data)))
+}
+
+// ===== Prune =====
+
+// retentionPolicy keeps the newest backup of each of the last N hours, days,
+// ISO weeks and months (grandfather-father-son).
+type retentionPolicy struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+}
+
+func (p retentionPolicy) empty() bool {
+	return p.Last == 0 && p.Hourly == 0 && p.Daily == 0 && p.Weekly == 0 && p.Monthly == 0
+}
+
+// PruneDecision is what prune does with one backup.
+type PruneDecision struct {
+	Backup  Backup   `json:"backup"`
+	Keep    bool     `json:"keep"`
+	Reasons []string `json:"reasons,omitempty"` // why the backup is kept
+}
+
+// applyRetention decides which backups (newest first, one database) to keep.
+// The newest backup and the newest verified backup are always kept.
+func applyRetention(backups []Backup, policy retentionPolicy) []PruneDecision {
+	decisions := make([]PruneDecision, len(backups))
+	for i, b := range backups {
+		decisions[i].Backup = b
+	}
+	keep := func(i int, reason string) {
+		decisions[i].Keep = true
+		decisions[i].Reasons = append(decisions[i].Reasons, reason)
+	}
+
+	for i := 0; i < len(backups) && i < policy.Last; i++ {
+		keep(i, "last")
+	}
+
+	rules := []struct {
+		name  string
+		count int
+		key   func(time.Time) string
+	}{
+		{"hourly", policy.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15") }},
+		{"daily", policy.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", policy.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, rule := range rules {
+		seen := make(map[string]bool)
+		for i, b := range backups {
+			if len(seen) == rule.count {
+				break
+			}
+			k := rule.key(b.Timestamp)
+			if !seen[k] {
+				seen[k] = true
+				keep(i, rule.name+" "+k)
+			}
+		}
+	}
+
+	if len(backups) > 0 {
+		keep(0, "newest")
+	}
+	for i, b := range backups {
+		if b.Verified {
+			keep(i, "newest verified")
+			break
+		}
+	}
+	return decisions
+}
+
+// pruneBackup deletes a backup with its sidecars, and every file of a directory dump
+func pruneBackup(ctx context.Context, store Storage, objects []BackupObject, b Backup) error {
+	var names []string
+	if b.Format == formatDirectory {
+		for _, obj := range objects {
+			if strings.HasPrefix(obj.Name, b.Name) {
+				names = append(names, obj.Name)
+			}
+		}
+	} else {
+		names = append(names, b.Name)
+	}
+	// Sidecars last, so an interrupted prune never leaves a backup without its manifest
+	names = append(names, b.Sidecars...)
+
+	for _, name := range names {
+		if err := store.Delete(ctx, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdPrune(args []string) int {
+	cfg, err := loadRestoreConfigFromEnv()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	var (
+		policy   retentionPolicy
+		database string
+		execute  bool
+		format   string
+	)
+
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-s", "--storage":
+			if i+1 < len(args) {
+				cfg.StorageType = args[i+1]
+				i++
+			}
+		case "--db":
+			if i+1 < len(args) {
+				database = args[i+1]
+				i++
+			}
+		case "--keep-last":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &policy.Last)
+				i++
+			}
+		case "--keep-hourly":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &policy.Hourly)
+				i++
+			}
+		case "--keep-daily":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &policy.Daily)
+				i++
+			}
+		case "--keep-weekly":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &policy.Weekly)
+				i++
+			}
+		case "--keep-monthly":
+			if i+1 < len(args) {
+				fmt.Sscanf(args[i+1], "%d", &policy.Monthly)
+				i++
+			}
+		case "--execute":
+			execute = true
+		case "--force":
+			cfg.Force = true
+		case "--format":
+			if i+1 < len(args) {
+				format = args[i+1]
+				i++
+			}
+		case "-h", "--help":
+			printPruneUsage()
+			return 0
+		}
+	}
+
+	if policy.empty() {
+		fmt.Fprintln(os.Stderr, "Error: no retention rule given (use --keep-last/--keep-hourly/--keep-daily/--keep-weekly/--keep-monthly)")
+		return 2
+	}
+
+	store, err := newStorage(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+
+	ctx := context.Background()
+
+	objects, err := store.List(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: failed to list backups: %v\n", err)
+		return 1
+	}
+	backups := backupFilter{Database: database}.apply(newCatalog(objects))
+
+	// Retention applies to each database's backups separately
+	var decisions []PruneDecision
+	var order []string
+	groups := make(map[string][]Backup)
+	for _, b := range backups {
+		if _, ok := groups[b.Database]; !ok {
+			order = append(order, b.Database)
+		}
+		groups[b.Database] = append(groups[b.Database], b)
+	}
+	for _, db := range order {
+		decisions = append(decisions, applyRetention(groups[db], policy)...)
+	}
+
+	var doomed []PruneDecision
+	var freed int64
+	for _, d := range decisions {
+		if !d.Keep {
+			doomed = append(doomed, d)
+			freed += d.Backup.Size
+		}
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(decisions)
+	} else {
+		for _, d := range decisions {
+			if d.Keep {
+				fmt.Printf("keep    %-40s %10s  %s\n", d.Backup.Name, formatBytes(d.Backup.Size), strings.Join(d.Reasons, ", "))
+			} else {
+				fmt.Printf("delete  %-40s %10s\n", d.Backup.Name, formatBytes(d.Backup.Size))
+			}
+		}
+		fmt.Printf("\n%d backups, %d to delete (%s)\n", len(decisions), len(doomed), formatBytes(freed))
+		if !hasVerified(backups) {
+			fmt.Println("Note: no backup has passed verify yet; only the newest backup is protected")
+		}
+	}
+
+	if len(doomed) == 0 {
+		return 0
+	}
+	if !execute {
+		if format != "json" {
+			fmt.Println("\n[DRY RUN] Nothing was deleted. Run with --execute to delete.")
+		}
+		return 0
+	}
+
+	if !cfg.Force {
+		fmt.Printf("\n⚠️  WARNING: This will permanently delete %d backups from %s\n", len(doomed), cfg.StorageType)
+		fmt.Print("\nType 'yes' to continue: ")
+
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+
+		if input != "yes" {
+			fmt.Println("Cancelled.")
+			return 0
+		}
+	}
+
+	failed := 0
+	for _, d := range doomed {
+		if err := pruneBackup(ctx, store, objects, d.Backup); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			failed++
+			continue
+		}
+		fmt.Printf("Deleted %s\n", d.Backup.Name)
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "\n%d of %d backups could not be deleted\n", failed, len(doomed))
+		return 1
+	}
+	fmt.Printf("\n✅ Pruned %d backups (%s)\n", len(doomed), formatBytes(freed))
+	return 0
+}
+
+func hasVerified(backups []Backup) bool {
+	for _, b := range backups {
+		if b.Verified {
+			return true
+		}
+	}
+	return false
+}
+
+func printPruneUsage() {
+	fmt.Println("Usage: yamisskey-doctor prune [options]")
+	fmt.Println("")
+	fmt.Println("Delete old backups from storage by grandfather-father-son retention.")
+	fmt.Println("Without --execute only the plan is shown.")
+	fmt.Println("")
+	fmt.Println("Options:")
+	fmt.Println("  -s, --storage    Storage (same values as restore, default: r2)")
+	fmt.Println("  --db             Only prune backups of this database")
+	fmt.Println("  --keep-last      Keep the N newest backups")
+	fmt.Println("  --keep-hourly    Keep the newest backup of each of the last N hours")
+	fmt.Println("  --keep-daily     Keep the newest backup of each of the last N days")
+	fmt.Println("  --keep-weekly    Keep the newest backup of each of the last N weeks")
+	fmt.Println("  --keep-monthly   Keep the newest backup of each of the last N months")
+	fmt.Println("  --execute        Actually delete backups")
+	fmt.Println("  --force          Skip confirmation prompt")
+	fmt.Println("  --format         Output format: text or json (default: text)")
+	fmt.Println("")
+	fmt.Println("The newest backup and the newest backup that passed verify are always kept.")
+	fmt.Println("Retention is applied to each database's backups separately.")
+	fmt.Println("")
+	fmt.Println("Examples:")
+	fmt.Println("  yamisskey-doctor prune --keep-daily 7 --keep-weekly 4 --keep-monthly 6")
+	fmt.Println("  yamisskey-doctor prune --storage linode --keep-daily 14 --execute")
+}
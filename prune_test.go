@@ -0,0 +1,183 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// backupsAt builds a newest-first catalog from UTC times; names ending in
+// "*" are verified
+func backupsAt(t *testing.T, stamps ...string) []Backup {
+	t.Helper()
+	var backups []Backup
+	for _, s := range stamps {
+		verified := false
+		if s[len(s)-1] == '*' {
+			verified, s = true, s[:len(s)-1]
+		}
+		ts, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backups = append(backups, Backup{Name: s, Timestamp: ts, Verified: verified})
+	}
+	return backups
+}
+
+func TestApplyRetention(t *testing.T) {
+	tests := []struct {
+		name    string
+		backups []string
+		policy  retentionPolicy
+		want    map[string][]string // kept backup -> reasons
+	}{
+		{
+			name:    "empty",
+			backups: nil,
+			policy:  retentionPolicy{Daily: 7},
+			want:    map[string][]string{},
+		},
+		{
+			name:    "newest kept without a policy",
+			backups: []string{"2025-01-03 03:00", "2025-01-02 03:00"},
+			want:    map[string][]string{"2025-01-03 03:00": {"newest"}},
+		},
+		{
+			name:    "last",
+			backups: []string{"2025-01-03 03:00", "2025-01-02 03:00", "2025-01-01 03:00"},
+			policy:  retentionPolicy{Last: 2},
+			want: map[string][]string{
+				"2025-01-03 03:00": {"last", "newest"},
+				"2025-01-02 03:00": {"last"},
+			},
+		},
+		{
+			name: "daily keeps the newest of each day",
+			backups: []string{
+				"2025-01-02 15:00", "2025-01-02 03:00",
+				"2025-01-01 15:00", "2025-01-01 03:00",
+				"2024-12-31 15:00",
+			},
+			policy: retentionPolicy{Daily: 2},
+			want: map[string][]string{
+				"2025-01-02 15:00": {"daily 2025-01-02", "newest"},
+				"2025-01-01 15:00": {"daily 2025-01-01"},
+			},
+		},
+		{
+			name:    "hourly",
+			backups: []string{"2025-01-01 04:30", "2025-01-01 04:00", "2025-01-01 03:45", "2025-01-01 02:59"},
+			policy:  retentionPolicy{Hourly: 2},
+			want: map[string][]string{
+				"2025-01-01 04:30": {"hourly 2025-01-01 04", "newest"},
+				"2025-01-01 03:45": {"hourly 2025-01-01 03"},
+			},
+		},
+		{
+			// Mon 2024-12-30 starts ISO week 2025-W01; Sun 2024-12-29 ends 2024-W52
+			name: "weekly across the ISO year boundary",
+			backups: []string{
+				"2025-01-06 03:00", // 2025-W02
+				"2025-01-05 03:00", // 2025-W01
+				"2025-01-01 03:00", // 2025-W01
+				"2024-12-30 03:00", // 2025-W01
+				"2024-12-29 03:00", // 2024-W52
+				"2024-12-23 03:00", // 2024-W52
+				"2024-12-22 03:00", // 2024-W51
+			},
+			policy: retentionPolicy{Weekly: 3},
+			want: map[string][]string{
+				"2025-01-06 03:00": {"weekly 2025-W02", "newest"},
+				"2025-01-05 03:00": {"weekly 2025-W01"},
+				"2024-12-29 03:00": {"weekly 2024-W52"},
+			},
+		},
+		{
+			// 2020-12-31 is in ISO week 2020-W53, 2021-01-03 too
+			name:    "weekly in a 53-week year",
+			backups: []string{"2021-01-04 03:00", "2021-01-03 03:00", "2020-12-31 03:00", "2020-12-27 03:00"},
+			policy:  retentionPolicy{Weekly: 3},
+			want: map[string][]string{
+				"2021-01-04 03:00": {"weekly 2021-W01", "newest"},
+				"2021-01-03 03:00": {"weekly 2020-W53"},
+				"2020-12-27 03:00": {"weekly 2020-W52"},
+			},
+		},
+		{
+			name: "monthly across month and year boundaries",
+			backups: []string{
+				"2025-02-01 00:00",
+				"2025-01-31 23:59",
+				"2025-01-01 00:00",
+				"2024-12-31 23:59",
+				"2024-12-01 00:00",
+				"2024-11-30 23:59",
+			},
+			policy: retentionPolicy{Monthly: 3},
+			want: map[string][]string{
+				"2025-02-01 00:00": {"monthly 2025-02", "newest"},
+				"2025-01-31 23:59": {"monthly 2025-01"},
+				"2024-12-31 23:59": {"monthly 2024-12"},
+			},
+		},
+		{
+			name: "rules combine",
+			backups: []string{
+				"2025-03-02 03:00",
+				"2025-03-01 03:00",
+				"2025-02-28 03:00",
+				"2025-02-15 03:00",
+				"2025-01-20 03:00",
+			},
+			policy: retentionPolicy{Daily: 2, Monthly: 3},
+			want: map[string][]string{
+				"2025-03-02 03:00": {"daily 2025-03-02", "monthly 2025-03", "newest"},
+				"2025-03-01 03:00": {"daily 2025-03-01"},
+				"2025-02-28 03:00": {"monthly 2025-02"},
+				"2025-01-20 03:00": {"monthly 2025-01"},
+			},
+		},
+		{
+			name:    "newest verified backup is protected",
+			backups: []string{"2025-01-04 03:00", "2025-01-03 03:00", "2025-01-02 03:00*", "2025-01-01 03:00*"},
+			policy:  retentionPolicy{Last: 1},
+			want: map[string][]string{
+				"2025-01-04 03:00": {"last", "newest"},
+				"2025-01-02 03:00": {"newest verified"},
+			},
+		},
+		{
+			name:    "verified newest backup",
+			backups: []string{"2025-01-02 03:00*", "2025-01-01 03:00*"},
+			policy:  retentionPolicy{},
+			want: map[string][]string{
+				"2025-01-02 03:00": {"newest", "newest verified"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backups := backupsAt(t, tt.backups...)
+			decisions := applyRetention(backups, tt.policy)
+			if len(decisions) != len(backups) {
+				t.Fatalf("got %d decisions for %d backups", len(decisions), len(backups))
+			}
+			got := map[string][]string{}
+			for i, d := range decisions {
+				if d.Backup.Name != backups[i].Name {
+					t.Errorf("decision %d is for %s, want %s", i, d.Backup.Name, backups[i].Name)
+				}
+				if d.Keep {
+					got[d.Backup.Name] = d.Reasons
+				} else if len(d.Reasons) > 0 {
+					t.Errorf("%s is deleted with reasons %v", d.Backup.Name, d.Reasons)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept:\n got %v\nwant %v", got, tt.want)
+			}
+		})
+	}
+}
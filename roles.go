@@ -0,0 +1,595 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ===== Roles, ownership and extensions =====
+
+// RoleSetup records how ownership was handled and what was created before
+// loading a dump
+type RoleSetup struct {
+	NoOwner           bool              `json:"noOwner,omitempty"`
+	RoleMap           map[string]string `json:"roleMap,omitempty"`
+	RolesCreated      []string          `json:"rolesCreated,omitempty"`
+	ExtensionsCreated []string          `json:"extensionsCreated,omitempty"`
+	Warnings          []string          `json:"warnings,omitempty"`
+}
+
+// print lists what was created, for the end of a restore
+func (s *RoleSetup) print() {
+	if s == nil || len(s.RolesCreated)+len(s.ExtensionsCreated)+len(s.Warnings) == 0 {
+		return
+	}
+	fmt.Println("\nRoles and extensions:")
+	for _, r := range s.RolesCreated {
+		fmt.Printf("  created role %s\n", r)
+	}
+	for _, e := range s.ExtensionsCreated {
+		fmt.Printf("  created extension %s\n", e)
+	}
+	for _, w := range s.Warnings {
+		fmt.Printf("  warning: %s\n", w)
+	}
+}
+
+// parseRoleMap adds old=new pairs (comma-separated) to m
+func parseRoleMap(arg string, m map[string]string) error {
+	for _, pair := range splitList(arg) {
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid --role-map %q (expected old=new)", pair)
+		}
+		m[from] = to
+	}
+	return nil
+}
+
+// mapRole returns the role that objects of role end up owned by
+func (cfg *RestoreConfig) mapRole(role string) string {
+	if to, ok := cfg.RoleMap[role]; ok {
+		return to
+	}
+	return role
+}
+
+// dumpRequirements are the roles a dump needs to exist (owners, grantees) and
+// the extensions it creates
+type dumpRequirements struct {
+	Roles      []string
+	Extensions []string
+	Warnings   []string // why the lists may be incomplete
+
+	GrantsUnread bool // the grantees of a streamed script come after its data
+}
+
+// maxStreamedSchema bounds how much of a streamed SQL script is held in memory
+// to find its roles and extensions before loading starts
+const maxStreamedSchema = 64 << 20
+
+var (
+	tocExtension  = regexp.MustCompile(`^\d+; \d+ \d+ EXTENSION - (\S+)`)
+	tocACL        = regexp.MustCompile(`^\d+; \d+ \d+ (?:DEFAULT )?ACL `)
+	tocOwned      = regexp.MustCompile(`^\d+; \d+ \d+ (?:TABLE|SEQUENCE|VIEW|MATERIALIZED VIEW|FUNCTION|PROCEDURE|AGGREGATE|TYPE|DOMAIN|SCHEMA) .* (\S+)$`)
+	sqlExtension  = regexp.MustCompile(`^CREATE EXTENSION (?:IF NOT EXISTS )?("?[^\s";]+"?)`)
+	sqlOwner      = regexp.MustCompile(`^(ALTER .* OWNER TO )(.+?)(;\s*)$`)
+	sqlGrant      = regexp.MustCompile(`^((?:GRANT|REVOKE) .* (?:TO|FROM) )(.+?)((?: WITH GRANT OPTION)?;\s*)$`)
+	sqlDefaultACL = regexp.MustCompile(`^(ALTER DEFAULT PRIVILEGES FOR ROLE )(\S+)( (?:IN SCHEMA \S+ )?)((?:GRANT|REVOKE) .*\n?)$`)
+	sqlSessionRol = regexp.MustCompile(`^(SET SESSION AUTHORIZATION )'([^']+)'(;\s*)$`)
+)
+
+// scanDumpRequirements finds the roles and extensions a dump needs: from the
+// table of contents and the ACL entries of pg_dump archives, or from the
+// statements of a SQL script. The schema section of a streamed script (up to
+// its first COPY) is read ahead and put back in front of dump.Reader; its
+// grants come after the data and are only warned about, as is a streamed
+// archive, which cannot be listed without consuming it.
+func scanDumpRequirements(dump *dumpSource) (*dumpRequirements, error) {
+	reqs := &dumpRequirements{}
+	roles := map[string]bool{}
+	extensions := map[string]bool{}
+	switch {
+	case dump.Path == "" && dump.Format != formatPlain:
+		reqs.Warnings = append(reqs.Warnings,
+			"the roles and extensions of a streamed pg_dump archive cannot be listed before loading it; "+
+				"create them first, use --no-owner, or restore without --stream")
+		return reqs, nil
+
+	case dump.Path == "":
+		schema, err := readSchema(dump)
+		if err != nil {
+			return nil, err
+		}
+		if len(schema) >= maxStreamedSchema {
+			reqs.Warnings = append(reqs.Warnings, fmt.Sprintf(
+				"only the first %s of the streamed dump were searched for roles and extensions", formatBytes(maxStreamedSchema)))
+		}
+		scanScript(bytes.NewReader(schema), roles, extensions, true)
+		reqs.GrantsUnread = true
+
+	case dump.Format == formatCustom, dump.Format == formatDirectory:
+		args := []string{"-l", dump.Path}
+		if dump.Format == formatDirectory {
+			args = []string{"-l", "-Fd", dump.Path}
+		}
+		out, err := exec.Command("pg_restore", args...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", dump.Path, err)
+		}
+		var acls []string
+		for _, line := range strings.Split(string(out), "\n") {
+			if m := tocExtension.FindStringSubmatch(line); m != nil {
+				extensions[m[1]] = true
+			} else if m := tocOwned.FindStringSubmatch(line); m != nil {
+				roles[m[1]] = true
+			} else if tocACL.MatchString(line) {
+				acls = append(acls, line)
+			}
+		}
+		if err := scanArchiveGrants(dump, acls, roles); err != nil {
+			return nil, err
+		}
+	case dump.Format == formatPlain:
+		f, err := os.Open(dump.Path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if err := scanScript(f, roles, extensions, false); err != nil {
+			return nil, fmt.Errorf("failed to scan %s: %w", dump.Path, err)
+		}
+	}
+
+	for r := range roles {
+		reqs.Roles = append(reqs.Roles, r)
+	}
+	for e := range extensions {
+		reqs.Extensions = append(reqs.Extensions, e)
+	}
+	sort.Strings(reqs.Roles)
+	sort.Strings(reqs.Extensions)
+	return reqs, nil
+}
+
+// scanScript collects the roles and extensions of a SQL script, skipping COPY
+// data. With schemaOnly it stops at the first COPY.
+func scanScript(r io.Reader, roles, extensions map[string]bool, schemaOnly bool) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	inCopy := false
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Only data and function bodies run this long; skip the rest
+			for err == bufio.ErrBufferFull {
+				_, err = br.ReadSlice('\n')
+			}
+			line = nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		text := strings.TrimRight(string(line), "\r\n")
+		switch {
+		case inCopy:
+			inCopy = text != `\.`
+		case strings.HasPrefix(text, "COPY "):
+			if schemaOnly {
+				return nil
+			}
+			inCopy = true
+		default:
+			if m := sqlExtension.FindStringSubmatch(text); m != nil {
+				extensions[unquoteIdent(m[1])] = true
+			} else {
+				statementRoles(text, roles)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// statementRoles adds the roles a SQL statement fails without: owners,
+// grantees, the role of default privileges and session authorization
+func statementRoles(line string, roles map[string]bool) {
+	if m := sqlDefaultACL.FindStringSubmatch(line); m != nil {
+		roles[unquoteIdent(m[2])] = true
+		line = m[4]
+	}
+	if m := sqlSessionRol.FindStringSubmatch(line); m != nil {
+		roles[m[2]] = true
+	} else if m := sqlOwner.FindStringSubmatch(line); m != nil {
+		roles[unquoteIdent(m[2])] = true
+	} else if m := sqlGrant.FindStringSubmatch(line); m != nil {
+		for _, r := range strings.Split(m[2], ",") {
+			roles[unquoteIdent(strings.TrimSpace(r))] = true
+		}
+	}
+}
+
+// scanArchiveGrants collects the grantees of the ACL entries of an archive.
+// The table of contents only names the owner, so pg_restore writes the
+// entries out as SQL.
+func scanArchiveGrants(dump *dumpSource, acls []string, roles map[string]bool) error {
+	if len(acls) == 0 {
+		return nil
+	}
+	list, err := os.CreateTemp("", "yd-acl-*.list")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	_, err = list.WriteString(strings.Join(acls, "\n") + "\n")
+	if cerr := list.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-L", list.Name(), "-f", "-", dump.Path}
+	if dump.Format == formatDirectory {
+		args = append([]string{"-Fd"}, args...)
+	}
+	out, err := exec.Command("pg_restore", args...).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the grants of %s: %w", dump.Path, err)
+	}
+	return scanScript(bytes.NewReader(out), roles, map[string]bool{}, false)
+}
+
+// readSchema reads a streamed SQL script up to and including its first COPY
+// line, or maxStreamedSchema bytes, and makes dump.Reader replay it
+func readSchema(dump *dumpSource) ([]byte, error) {
+	var schema bytes.Buffer
+	r := bufio.NewReaderSize(dump.Reader, 1<<20)
+	for schema.Len() < maxStreamedSchema {
+		line, err := r.ReadSlice('\n')
+		schema.Write(line)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF || bytes.HasPrefix(line, []byte("COPY ")) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dump: %w", err)
+		}
+	}
+	dump.Reader = io.MultiReader(bytes.NewReader(schema.Bytes()), r)
+	return schema.Bytes(), nil
+}
+
+// prepareRoles creates the roles and extensions dump needs in database and
+// returns the dump to load: with --no-owner or --role-map, owner and grant
+// statements are stripped or rewritten. Close the returned dump; it does not
+// close dump.
+func prepareRoles(ctx context.Context, cfg *RestoreConfig, database string, dump *dumpSource) (*RoleSetup, *dumpSource, error) {
+	setup := &RoleSetup{NoOwner: cfg.NoOwner, RoleMap: cfg.RoleMap}
+
+	reqs, err := scanDumpRequirements(dump)
+	if err != nil {
+		return setup, nil, err
+	}
+	if reqs.GrantsUnread && !cfg.NoOwner {
+		reqs.Warnings = append(reqs.Warnings,
+			"the grants of a streamed SQL dump follow its data and cannot be read ahead; "+
+				"roles only named in them must exist (or use --no-owner, or restore without --stream)")
+	}
+	for _, w := range reqs.Warnings {
+		progress.printf("Warning: %s", w)
+		setup.Warnings = append(setup.Warnings, w)
+	}
+
+	// Roles objects will be owned by or granted to
+	var roles []string
+	if !cfg.NoOwner {
+		for _, r := range reqs.Roles {
+			roles = append(roles, cfg.mapRole(r))
+		}
+		for _, to := range cfg.RoleMap {
+			roles = append(roles, to)
+		}
+	}
+	if err := createRoles(ctx, cfg, roles, setup); err != nil {
+		return setup, nil, err
+	}
+	if err := createExtensions(ctx, cfg, database, reqs.Extensions, setup); err != nil {
+		return setup, nil, err
+	}
+
+	loaded, err := rewriteOwnership(cfg, dump)
+	return setup, loaded, err
+}
+
+// createRoles creates the roles that do not exist yet as NOLOGIN roles.
+// Failing to create one is a warning: its objects then belong to POSTGRES_USER.
+func createRoles(ctx context.Context, cfg *RestoreConfig, roles []string, setup *RoleSetup) error {
+	if len(roles) == 0 {
+		return nil
+	}
+	conn, err := connectDB(ctx, cfg, "postgres")
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	seen := map[string]bool{}
+	for _, role := range roles {
+		if seen[role] || strings.HasPrefix(role, "pg_") || strings.EqualFold(role, "PUBLIC") {
+			continue
+		}
+		seen[role] = true
+
+		var exists bool
+		if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_roles WHERE rolname = $1)", role).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to look up role %s: %w", role, err)
+		}
+		if exists {
+			continue
+		}
+		progress.printf("Creating role %s...", role)
+		if _, err := conn.Exec(ctx, "CREATE ROLE "+quoteIdent(role)+" NOLOGIN"); err != nil {
+			msg := fmt.Sprintf("could not create role %s: %v (use --no-owner or --role-map %s=%s)", role, err, role, cfg.PGUser)
+			progress.printf("Warning: %s", msg)
+			setup.Warnings = append(setup.Warnings, msg)
+			continue
+		}
+		setup.RolesCreated = append(setup.RolesCreated, role)
+	}
+	return nil
+}
+
+// createExtensions creates the extensions the dump uses in database before it
+// is loaded, so that a server missing one (pgroonga, say) fails up front
+func createExtensions(ctx context.Context, cfg *RestoreConfig, database string, extensions []string, setup *RoleSetup) error {
+	if len(extensions) == 0 {
+		return nil
+	}
+	conn, err := connectDB(ctx, cfg, database)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	for _, ext := range extensions {
+		var installed, available bool
+		err := conn.QueryRow(ctx,
+			`SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = $1),
+			        EXISTS (SELECT 1 FROM pg_available_extensions WHERE name = $1)`, ext,
+		).Scan(&installed, &available)
+		if err != nil {
+			return fmt.Errorf("failed to look up extension %s: %w", ext, err)
+		}
+		if installed {
+			continue
+		}
+		if !available {
+			return fmt.Errorf("the backup uses extension %s, which is not installed on %s:%s", ext, cfg.PGHost, cfg.PGPort)
+		}
+		progress.printf("Creating extension %s...", ext)
+		if _, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS "+quoteIdent(ext)); err != nil {
+			return fmt.Errorf("failed to create extension %s: %w", ext, err)
+		}
+		setup.ExtensionsCreated = append(setup.ExtensionsCreated, ext)
+	}
+	return nil
+}
+
+// rewriteOwnership returns dump as it should be loaded. SQL scripts, and
+// archives with --role-map (turned into a script by pg_restore -f -), go
+// through an ownershipFilter. --no-owner on archives is left to pg_restore.
+func rewriteOwnership(cfg *RestoreConfig, dump *dumpSource) (*dumpSource, error) {
+	if !cfg.NoOwner && len(cfg.RoleMap) == 0 {
+		return &dumpSource{Format: dump.Format, Path: dump.Path, Reader: dump.Reader}, nil
+	}
+	if dump.Format != formatPlain && len(cfg.RoleMap) == 0 {
+		return &dumpSource{Format: dump.Format, Path: dump.Path, Reader: dump.Reader}, nil
+	}
+
+	out := &dumpSource{Format: formatPlain}
+	var src io.Reader
+	switch dump.Format {
+	case formatPlain:
+		if dump.Path == "" {
+			src = dump.Reader
+			break
+		}
+		f, err := os.Open(dump.Path)
+		if err != nil {
+			return nil, err
+		}
+		out.closers = append(out.closers, f)
+		src = f
+	default:
+		script, err := archiveScript(cfg, dump)
+		if err != nil {
+			return nil, err
+		}
+		out.closers = append(out.closers, script)
+		src = script
+	}
+	if cfg.NoOwner {
+		progress.printf("Stripping owners and grants from the dump")
+	} else {
+		progress.printf("Mapping roles in the dump: %s", describeRoleMap(cfg.RoleMap))
+	}
+	if dump.Format != formatPlain && cfg.Jobs > 1 {
+		progress.printf("Note: with --role-map the archive is loaded as a script through psql, without -j %d", cfg.Jobs)
+	}
+	out.Reader = &ownershipFilter{cfg: cfg, r: bufio.NewReaderSize(src, 1<<20)}
+	return out, nil
+}
+
+func describeRoleMap(m map[string]string) string {
+	var pairs []string
+	for from, to := range m {
+		pairs = append(pairs, from+"="+to)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
+
+// scriptReader is the SQL script pg_restore writes for an archive. Reading
+// past its end waits for pg_restore and reports its failure, so that a broken
+// archive does not look like a short script.
+type scriptReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+// archiveScript starts pg_restore -f - on an archive
+func archiveScript(cfg *RestoreConfig, dump *dumpSource) (*scriptReader, error) {
+	args := []string{"-f", "-"}
+	if dump.Format == formatDirectory {
+		args = append(args, "-Fd")
+	}
+	if dump.Path != "" {
+		args = append(args, dump.Path)
+	}
+	s := &scriptReader{cmd: exec.Command("pg_restore", args...)}
+	if dump.Path == "" {
+		s.cmd.Stdin = dump.Reader
+	}
+	s.cmd.Stderr = &s.stderr
+	stdout, err := s.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	s.stdout = stdout
+	if err := s.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start pg_restore: %w", err)
+	}
+	return s, nil
+}
+
+func (s *scriptReader) Read(p []byte) (int, error) {
+	n, err := s.stdout.Read(p)
+	if err == io.EOF && !s.done {
+		s.done = true
+		if werr := s.cmd.Wait(); werr != nil {
+			return n, fmt.Errorf("pg_restore: %v: %s", werr, strings.TrimSpace(s.stderr.String()))
+		}
+	}
+	return n, err
+}
+
+func (s *scriptReader) Close() error {
+	if s.done {
+		return nil
+	}
+	s.done = true
+	s.stdout.Close()
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+	return nil
+}
+
+// ownershipFilter rewrites the owner and grant statements of a SQL script for
+// --no-owner (dropped) and --role-map (roles replaced). COPY data is passed
+// through untouched.
+type ownershipFilter struct {
+	cfg    *RestoreConfig
+	r      *bufio.Reader
+	buf    []byte
+	inCopy bool
+	err    error
+}
+
+func (f *ownershipFilter) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		line, err := f.r.ReadBytes('\n')
+		f.err = err
+		f.buf = f.filter(line)
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+// filter returns line as it should be loaded, or nil to drop it
+func (f *ownershipFilter) filter(line []byte) []byte {
+	if f.inCopy {
+		if bytes.Equal(bytes.TrimRight(line, "\r\n"), []byte(`\.`)) {
+			f.inCopy = false
+		}
+		return line
+	}
+	if bytes.HasPrefix(line, []byte("COPY ")) && bytes.HasSuffix(bytes.TrimRight(line, "\r\n"), []byte("FROM stdin;")) {
+		f.inCopy = true
+		return line
+	}
+
+	s := string(line)
+	if m := sqlDefaultACL.FindStringSubmatch(s); m != nil {
+		if f.cfg.NoOwner {
+			return nil
+		}
+		// The role the defaults are for, then the grantees
+		return []byte(m[1] + f.mapRoles(m[2]) + m[3] + f.mapGrant(m[4]))
+	}
+	if m := sqlSessionRol.FindStringSubmatch(s); m != nil {
+		if f.cfg.NoOwner {
+			return nil
+		}
+		return []byte(m[1] + quoteLiteral(f.cfg.mapRole(m[2])) + m[3])
+	}
+	if sqlOwner.MatchString(s) || sqlGrant.MatchString(s) {
+		if f.cfg.NoOwner {
+			return nil
+		}
+		if m := sqlOwner.FindStringSubmatch(s); m != nil {
+			return []byte(m[1] + f.mapRoles(m[2]) + m[3])
+		}
+		return []byte(f.mapGrant(s))
+	}
+	return line
+}
+
+// mapGrant maps the grantees of a GRANT or REVOKE statement
+func (f *ownershipFilter) mapGrant(s string) string {
+	m := sqlGrant.FindStringSubmatch(s)
+	if m == nil {
+		return s
+	}
+	return m[1] + f.mapRoles(m[2]) + m[3]
+}
+
+// mapRoles maps a comma-separated list of role names as written by pg_dump
+func (f *ownershipFilter) mapRoles(list string) string {
+	parts := strings.Split(list, ",")
+	for i, part := range parts {
+		name := unquoteIdent(strings.TrimSpace(part))
+		if to, ok := f.cfg.RoleMap[name]; ok {
+			parts[i] = quoteIdent(to)
+		} else {
+			parts[i] = strings.TrimSpace(part)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// unquoteIdent turns a possibly double-quoted SQL identifier into its name
+func unquoteIdent(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		return strings.ReplaceAll(s[1:len(s)-1], `""`, `"`)
+	}
+	return s
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestOwnershipFilter(t *testing.T) {
+	roleMap := &RestoreConfig{RoleMap: map[string]string{"misskey": "staging", "Old Role": "new"}}
+	noOwner := &RestoreConfig{NoOwner: true}
+
+	tests := []struct {
+		line    string
+		mapped  string // with roleMap
+		noOwner string // with --no-owner; "" drops the line
+	}{
+		{
+			"ALTER TABLE public.note OWNER TO misskey;\n",
+			`ALTER TABLE public.note OWNER TO "staging";` + "\n",
+			"",
+		},
+		{
+			`ALTER SCHEMA public OWNER TO "Old Role";` + "\n",
+			`ALTER SCHEMA public OWNER TO "new";` + "\n",
+			"",
+		},
+		{
+			"ALTER TABLE public.note OWNER TO other;\n",
+			"ALTER TABLE public.note OWNER TO other;\n",
+			"",
+		},
+		{
+			"GRANT SELECT ON TABLE public.note TO misskey, reader;\n",
+			`GRANT SELECT ON TABLE public.note TO "staging", reader;` + "\n",
+			"",
+		},
+		{
+			"GRANT ALL ON SCHEMA public TO misskey WITH GRANT OPTION;\n",
+			`GRANT ALL ON SCHEMA public TO "staging" WITH GRANT OPTION;` + "\n",
+			"",
+		},
+		{
+			"REVOKE ALL ON SCHEMA public FROM PUBLIC;\n",
+			"REVOKE ALL ON SCHEMA public FROM PUBLIC;\n",
+			"",
+		},
+		{
+			"ALTER DEFAULT PRIVILEGES FOR ROLE misskey IN SCHEMA public GRANT SELECT ON TABLES TO misskey;\n",
+			`ALTER DEFAULT PRIVILEGES FOR ROLE "staging" IN SCHEMA public GRANT SELECT ON TABLES TO "staging";` + "\n",
+			"",
+		},
+		{
+			"SET SESSION AUTHORIZATION 'misskey';\n",
+			"SET SESSION AUTHORIZATION 'staging';\n",
+			"",
+		},
+		{
+			"CREATE TABLE public.note (\n",
+			"CREATE TABLE public.note (\n",
+			"CREATE TABLE public.note (\n",
+		},
+		{
+			"SET default_tablespace = '';\n",
+			"SET default_tablespace = '';\n",
+			"SET default_tablespace = '';\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(strings.TrimSpace(tt.line), func(t *testing.T) {
+			f := &ownershipFilter{cfg: roleMap}
+			if got := string(f.filter([]byte(tt.line))); got != tt.mapped {
+				t.Errorf("role map:\n got %q\nwant %q", got, tt.mapped)
+			}
+			f = &ownershipFilter{cfg: noOwner}
+			if got := string(f.filter([]byte(tt.line))); got != tt.noOwner {
+				t.Errorf("no owner:\n got %q\nwant %q", got, tt.noOwner)
+			}
+		})
+	}
+}
+
+// COPY data that looks like a statement is passed through as it is
+func TestOwnershipFilterCopyData(t *testing.T) {
+	script := strings.Join([]string{
+		"ALTER TABLE public.note OWNER TO misskey;",
+		"COPY public.note (id, text) FROM stdin;",
+		"n1\tALTER TABLE public.note OWNER TO misskey;",
+		"n2\tGRANT ALL ON SCHEMA public TO misskey;",
+		`\.`,
+		"GRANT SELECT ON TABLE public.note TO misskey;",
+		"",
+	}, "\n")
+	want := strings.Join([]string{
+		`ALTER TABLE public.note OWNER TO "staging";`,
+		"COPY public.note (id, text) FROM stdin;",
+		"n1\tALTER TABLE public.note OWNER TO misskey;",
+		"n2\tGRANT ALL ON SCHEMA public TO misskey;",
+		`\.`,
+		`GRANT SELECT ON TABLE public.note TO "staging";`,
+		"",
+	}, "\n")
+
+	cfg := &RestoreConfig{RoleMap: map[string]string{"misskey": "staging"}}
+	f := &ownershipFilter{cfg: cfg, r: bufio.NewReaderSize(strings.NewReader(script), 16)}
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("filtered:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestScanScript(t *testing.T) {
+	script := strings.Join([]string{
+		"SET SESSION AUTHORIZATION 'builder';",
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm WITH SCHEMA public;`,
+		`CREATE EXTENSION "pgroonga";`,
+		"ALTER TABLE public.note OWNER TO misskey;",
+		`ALTER SCHEMA app OWNER TO "App Owner";`,
+		"COPY public.note (id, text) FROM stdin;",
+		"n1\tGRANT ALL ON TABLE public.note TO intruder;",
+		"n2\tALTER TABLE public.note OWNER TO intruder;",
+		`\.`,
+		"REVOKE ALL ON SCHEMA public FROM PUBLIC;",
+		`GRANT SELECT ON TABLE public.note TO reader, "Report Role";`,
+		"ALTER DEFAULT PRIVILEGES FOR ROLE misskey IN SCHEMA public GRANT SELECT ON TABLES TO auditor;",
+		"",
+	}, "\n")
+
+	tests := []struct {
+		name       string
+		schemaOnly bool
+		roles      []string
+		extensions []string
+	}{
+		{
+			name:       "whole script",
+			roles:      []string{"App Owner", "PUBLIC", "Report Role", "auditor", "builder", "misskey", "reader"},
+			extensions: []string{"pg_trgm", "pgroonga"},
+		},
+		{
+			name:       "schema only",
+			schemaOnly: true,
+			roles:      []string{"App Owner", "builder", "misskey"},
+			extensions: []string{"pg_trgm", "pgroonga"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			roles, extensions := map[string]bool{}, map[string]bool{}
+			if err := scanScript(strings.NewReader(script), roles, extensions, tt.schemaOnly); err != nil {
+				t.Fatal(err)
+			}
+			if got := sortedKeys(roles); !reflect.DeepEqual(got, tt.roles) {
+				t.Errorf("roles = %q, want %q", got, tt.roles)
+			}
+			if got := sortedKeys(extensions); !reflect.DeepEqual(got, tt.extensions) {
+				t.Errorf("extensions = %q, want %q", got, tt.extensions)
+			}
+		})
+	}
+}
+
+// A data line longer than the read buffer does not end the scan
+func TestScanScriptLongLine(t *testing.T) {
+	script := "COPY public.drive_file (id, blob) FROM stdin;\n" +
+		"f1\t" + strings.Repeat("x", 3<<20) + "\n" +
+		"\\.\n" +
+		"GRANT SELECT ON TABLE public.drive_file TO reader;\n"
+	roles := map[string]bool{}
+	if err := scanScript(strings.NewReader(script), roles, map[string]bool{}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !roles["reader"] {
+		t.Errorf("roles = %v, want reader", roles)
+	}
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ===== Selective restore =====
+
+// tableSelection picks rows of one table out of the restored backup
+type tableSelection struct {
+	Table string
+	Where string // filter on the restored database; $user is the selected user id
+
+	// Columns that must point at rows present in the live database (or in
+	// this batch); rows that do not are skipped rather than failing the copy
+	Refs []tableRef
+
+	// Columns pointing at rows copied later in the batch. They are inserted
+	// as NULL and set once every table is copied, if the row they point at
+	// exists by then. The table must be keyed by id.
+	Deferred []tableRef
+}
+
+type tableRef struct {
+	Column string
+	Table  string
+}
+
+// userSelections are the rows copied by restore --user, parents first. The
+// avatar and banner of a user are drive files, which belong to the user, so
+// they are set after the files are copied.
+var userSelections = []tableSelection{
+	{Table: "user", Where: `id = $user`,
+		Deferred: []tableRef{{"avatarId", "drive_file"}, {"bannerId", "drive_file"}}},
+	{Table: "user_keypair", Where: `"userId" = $user`},
+	{Table: "drive_folder", Where: `"userId" = $user`,
+		Refs: []tableRef{{"parentId", "drive_folder"}}},
+	{Table: "drive_file", Where: `"userId" = $user`,
+		Refs: []tableRef{{"folderId", "drive_folder"}}},
+	{Table: "page", Where: `"userId" = $user`,
+		Refs: []tableRef{{"eyeCatchingImageId", "drive_file"}}},
+	{Table: "user_profile", Where: `"userId" = $user`,
+		Refs: []tableRef{{"pinnedPageId", "page"}}},
+	{Table: "note", Where: `"userId" = $user`,
+		Refs: []tableRef{{"replyId", "note"}, {"renoteId", "note"}, {"channelId", "channel"}}},
+	{Table: "note_reaction", Where: `"userId" = $user OR "noteId" IN (SELECT id FROM note WHERE "userId" = $user)`,
+		Refs: []tableRef{{"userId", "user"}, {"noteId", "note"}}},
+	{Table: "following", Where: `"followerId" = $user OR "followeeId" = $user`,
+		Refs: []tableRef{{"followerId", "user"}, {"followeeId", "user"}}},
+}
+
+// TableCopy reports how the rows of one table were copied into the live database
+type TableCopy struct {
+	Table       string `json:"table"`
+	Rows        int64  `json:"rows"`        // rows selected from the backup
+	Inserted    int64  `json:"inserted"`    // rows added to the live database
+	Conflicts   int64  `json:"conflicts"`   // rows already present (same key), left unchanged
+	MissingRefs int64  `json:"missingRefs"` // rows skipped because what they reference is gone
+	Skipped     string `json:"skipped,omitempty"`
+}
+
+// SelectiveResult is the outcome of restore --table / --user
+type SelectiveResult struct {
+	Backup    string      `json:"backup"`
+	Database  string      `json:"database"`
+	Selection string      `json:"selection"`
+	User      string      `json:"userId,omitempty"`
+	OK        bool        `json:"ok"`
+	Error     string      `json:"error,omitempty"`
+	Tables    []TableCopy `json:"tables,omitempty"`
+	Roles     *RoleSetup  `json:"roles,omitempty"`
+}
+
+// findUser resolves a user id, username or @username@host in the restored database
+func findUser(ctx context.Context, conn *pgx.Conn, user string) (string, error) {
+	name, host, _ := strings.Cut(strings.TrimPrefix(user, "@"), "@")
+
+	var id string
+	var err error
+	if host == "" {
+		err = conn.QueryRow(ctx,
+			`SELECT id FROM "user" WHERE id = $1 OR ("usernameLower" = lower($1) AND host IS NULL) ORDER BY id = $1 DESC LIMIT 1`,
+			name,
+		).Scan(&id)
+	} else {
+		err = conn.QueryRow(ctx,
+			`SELECT id FROM "user" WHERE "usernameLower" = lower($1) AND host = lower($2)`,
+			name, host,
+		).Scan(&id)
+	}
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", fmt.Errorf("user %s not found in the backup", user)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to look up user %s: %w", user, err)
+	}
+	return id, nil
+}
+
+// tableColumns lists the columns of a public table in order, or nil if it does not exist
+func tableColumns(ctx context.Context, conn *pgx.Conn, table string) ([]string, error) {
+	rows, err := conn.Query(ctx,
+		`SELECT column_name FROM information_schema.columns
+		 WHERE table_schema = 'public' AND table_name = $1 ORDER BY ordinal_position`,
+		table,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// copySelections copies the selected rows from the restored database src into
+// the live database dst in one transaction. Rows that already exist are left
+// alone and counted as conflicts; nothing is overwritten or deleted.
+func copySelections(ctx context.Context, src, dst *pgx.Conn, selections []tableSelection, userID string) ([]TableCopy, error) {
+	type plan struct {
+		sel     tableSelection
+		columns []string
+	}
+	var plans []plan
+	var copies []TableCopy
+
+	for _, sel := range selections {
+		srcCols, err := tableColumns(ctx, src, sel.Table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s in the backup: %w", sel.Table, err)
+		}
+		dstCols, err := tableColumns(ctx, dst, sel.Table)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s: %w", sel.Table, err)
+		}
+		if len(srcCols) == 0 {
+			copies = append(copies, TableCopy{Table: sel.Table, Skipped: "not in backup"})
+			continue
+		}
+		if len(dstCols) == 0 {
+			copies = append(copies, TableCopy{Table: sel.Table, Skipped: "not in live database"})
+			continue
+		}
+
+		// Columns added or dropped by migrations since the backup are left out
+		inSrc := map[string]bool{}
+		for _, c := range srcCols {
+			inSrc[c] = true
+		}
+		var columns []string
+		for _, c := range dstCols {
+			if inSrc[c] {
+				columns = append(columns, c)
+			}
+		}
+		plans = append(plans, plan{sel, columns})
+	}
+
+	tx, err := dst.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, p := range plans {
+		progress.printf("Copying %s...", p.sel.Table)
+		c, err := copyTable(ctx, src, tx, p.sel, p.columns, userID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %s: %w", p.sel.Table, err)
+		}
+		progress.printf("  %d rows: %d inserted, %d conflicts, %d missing references",
+			c.Rows, c.Inserted, c.Conflicts, c.MissingRefs)
+		copies = append(copies, *c)
+	}
+
+	for _, p := range plans {
+		if err := setDeferred(ctx, tx, p.sel, p.columns); err != nil {
+			return nil, fmt.Errorf("failed to set references of %s: %w", p.sel.Table, err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return copies, nil
+}
+
+// copyTable streams the selected rows into a temporary table on the live
+// side with COPY, then inserts those that fit with ON CONFLICT DO NOTHING
+func copyTable(ctx context.Context, src *pgx.Conn, tx pgx.Tx, sel tableSelection, columns []string, userID string) (*TableCopy, error) {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = quoteIdent(c)
+	}
+	cols := strings.Join(quoted, ", ")
+	table := quoteIdent(sel.Table)
+	stage := quoteIdent("restore_" + sel.Table)
+	deferred := deferredColumns(sel, columns)
+
+	// COPY takes no parameters, so the user id goes in as a literal
+	where := "TRUE"
+	if sel.Where != "" {
+		where = strings.ReplaceAll(sel.Where, "$user", quoteLiteral(userID))
+	}
+
+	if _, err := tx.Exec(ctx, fmt.Sprintf(
+		"CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT %s FROM %s WITH NO DATA", stage, cols, table)); err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	srcErr := make(chan error, 1)
+	go func() {
+		_, err := src.PgConn().CopyTo(ctx, pw, fmt.Sprintf("COPY (SELECT %s FROM %s WHERE %s) TO STDOUT", cols, table, where))
+		pw.CloseWithError(err)
+		srcErr <- err
+	}()
+	tag, err := tx.Conn().PgConn().CopyFrom(ctx, pr, fmt.Sprintf("COPY %s (%s) FROM STDIN", stage, cols))
+	pr.CloseWithError(err)
+	readErr := <-srcErr
+	if err != nil {
+		return nil, err
+	}
+	if readErr != nil {
+		return nil, fmt.Errorf("failed to read from backup: %w", readErr)
+	}
+	result := &TableCopy{Table: sel.Table, Rows: tag.RowsAffected()}
+
+	// A reference is satisfied if the row exists live or is part of this batch
+	var conds []string
+	for _, ref := range sel.Refs {
+		if !containsString(columns, ref.Column) {
+			continue
+		}
+		col := "s." + quoteIdent(ref.Column)
+		cond := fmt.Sprintf("(%s IS NULL OR EXISTS (SELECT 1 FROM %s r WHERE r.id = %s)", col, quoteIdent(ref.Table), col)
+		if ref.Table == sel.Table {
+			cond += fmt.Sprintf(" OR EXISTS (SELECT 1 FROM %s b WHERE b.id = %s)", stage, col)
+		}
+		conds = append(conds, cond+")")
+	}
+	filter := "TRUE"
+	if len(conds) > 0 {
+		filter = strings.Join(conds, " AND ")
+		if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(*) FROM %s s WHERE NOT (%s)", stage, filter)).Scan(&result.MissingRefs); err != nil {
+			return nil, err
+		}
+	}
+
+	sCols := make([]string, len(quoted))
+	for i, c := range quoted {
+		sCols[i] = "s." + c
+		if containsString(deferred, columns[i]) {
+			sCols[i] = "NULL"
+		}
+	}
+	insert := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s s WHERE %s ON CONFLICT DO NOTHING",
+		table, cols, strings.Join(sCols, ", "), stage, filter)
+	if len(deferred) > 0 {
+		// Remember which rows are new so setDeferred leaves existing ones alone
+		ids := quoteIdent("restore_" + sel.Table + "_ids")
+		if _, err := tx.Exec(ctx, fmt.Sprintf(
+			"CREATE TEMP TABLE %s ON COMMIT DROP AS SELECT id FROM %s WITH NO DATA", ids, table)); err != nil {
+			return nil, err
+		}
+		insert = fmt.Sprintf("WITH inserted AS (%s RETURNING id) INSERT INTO %s SELECT id FROM inserted", insert, ids)
+	}
+	tag, err = tx.Exec(ctx, insert)
+	if err != nil {
+		return nil, err
+	}
+	result.Inserted = tag.RowsAffected()
+	result.Conflicts = result.Rows - result.MissingRefs - result.Inserted
+	return result, nil
+}
+
+// deferredColumns lists the Deferred columns of sel that are being copied
+func deferredColumns(sel tableSelection, columns []string) []string {
+	var deferred []string
+	for _, ref := range sel.Deferred {
+		if containsString(columns, ref.Column) {
+			deferred = append(deferred, ref.Column)
+		}
+	}
+	return deferred
+}
+
+// setDeferred fills in the Deferred columns of the rows copyTable inserted,
+// where the row they point at is now in the live database
+func setDeferred(ctx context.Context, tx pgx.Tx, sel tableSelection, columns []string) error {
+	table := quoteIdent(sel.Table)
+	stage := quoteIdent("restore_" + sel.Table)
+	ids := quoteIdent("restore_" + sel.Table + "_ids")
+
+	for _, ref := range sel.Deferred {
+		if !containsString(columns, ref.Column) {
+			continue
+		}
+		col := quoteIdent(ref.Column)
+		from := fmt.Sprintf("FROM %s s WHERE s.id IN (SELECT id FROM %s) AND s.%s IS NOT NULL", stage, ids, col)
+		exists := fmt.Sprintf("EXISTS (SELECT 1 FROM %s r WHERE r.id = s.%s)", quoteIdent(ref.Table), col)
+
+		var missing int64
+		if err := tx.QueryRow(ctx, fmt.Sprintf("SELECT COUNT(*) %s AND NOT %s", from, exists)).Scan(&missing); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, fmt.Sprintf("UPDATE %s t SET %s = s.%s %s AND t.id = s.id AND %s",
+			table, col, col, from, exists)); err != nil {
+			return err
+		}
+		if missing > 0 {
+			progress.printf("  %s.%s of %d rows left empty: the %s row no longer exists", sel.Table, ref.Column, missing, ref.Table)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreSelective loads backup into a temporary database and copies the
+// selected tables, or one user's rows, into cfg.PGDatabase
+func restoreSelective(ctx context.Context, cfg *RestoreConfig, store Storage, backup string, tables []string, user string, result *SelectiveResult) error {
+	tempDBName := fmt.Sprintf("%s_selective_%s", cfg.PGDatabase, time.Now().Format("20060102_150405"))
+
+	progress.printf("Creating temp database %s...", tempDBName)
+	if err := createTempDatabase(ctx, cfg, tempDBName); err != nil {
+		return err
+	}
+	defer func() {
+		progress.printf("Cleaning up temp database %s...", tempDBName)
+		dropTempDatabase(ctx, cfg, tempDBName)
+	}()
+
+	err := loadBackup(ctx, cfg, store, backup, func(dump *dumpSource) error {
+		setup, dump, err := prepareRoles(ctx, cfg, tempDBName, dump)
+		result.Roles = setup
+		if err != nil {
+			return err
+		}
+		defer dump.Close()
+		progress.printf("Restoring to temp database %s...", tempDBName)
+		return restoreToTempDatabase(cfg, tempDBName, dump)
+	})
+	if err != nil {
+		return err
+	}
+
+	src, err := connectDB(ctx, cfg, tempDBName)
+	if err != nil {
+		return err
+	}
+	defer src.Close(ctx)
+	dst, err := connectDB(ctx, cfg, cfg.PGDatabase)
+	if err != nil {
+		return err
+	}
+	defer dst.Close(ctx)
+
+	var selections []tableSelection
+	if user != "" {
+		id, err := findUser(ctx, src, user)
+		if err != nil {
+			return err
+		}
+		result.User = id
+		progress.printf("User %s: %s", user, id)
+		selections = userSelections
+	}
+	for _, t := range tables {
+		selections = append(selections, tableSelection{Table: t})
+	}
+
+	copies, err := copySelections(ctx, src, dst, selections, result.User)
+	result.Tables = copies
+	return err
+}
+
+func printSelectiveResult(result *SelectiveResult, format string) {
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(result)
+		return
+	}
+
+	fmt.Println()
+
+	status := "OK"
+	if !result.OK {
+		status = "FAIL"
+	}
+	fmt.Printf("=== Selective Restore: %s ===\n", status)
+	fmt.Printf("Backup:     %s\n", result.Backup)
+	fmt.Printf("Database:   %s\n", result.Database)
+	fmt.Printf("Selection:  %s\n", result.Selection)
+	if result.Error != "" {
+		fmt.Printf("Error:      %s\n", result.Error)
+	}
+
+	if len(result.Tables) > 0 {
+		fmt.Printf("\n  %-16s %8s %8s %9s %8s\n", "TABLE", "ROWS", "INSERTED", "CONFLICTS", "MISSING")
+		for _, t := range result.Tables {
+			if t.Skipped != "" {
+				fmt.Printf("  %-16s skipped: %s\n", t.Table, t.Skipped)
+				continue
+			}
+			fmt.Printf("  %-16s %8d %8d %9d %8d\n", t.Table, t.Rows, t.Inserted, t.Conflicts, t.MissingRefs)
+		}
+	}
+
+	var conflicts, missing int64
+	for _, t := range result.Tables {
+		conflicts += t.Conflicts
+		missing += t.MissingRefs
+	}
+	if conflicts > 0 {
+		fmt.Printf("\n%d rows already exist in %s and were left unchanged.\n", conflicts, result.Database)
+	}
+	if missing > 0 {
+		fmt.Printf("%d rows were skipped because the rows they reference no longer exist.\n", missing)
+	}
+}
+
+// selectiveSteps describes what restore --table / --user does, for --dry-run
+func selectiveSteps(cfg *RestoreConfig, backup string, tables []string, user string) []string {
+	steps := []string{
+		fmt.Sprintf("Create temp database: %s_selective_<timestamp>", cfg.PGDatabase),
+		fmt.Sprintf("Restore %s into it", backup),
+	}
+	if user != "" {
+		var names []string
+		for _, sel := range userSelections {
+			names = append(names, sel.Table)
+		}
+		steps = append(steps, fmt.Sprintf("Copy the rows of user %s (%s) into %s", user, strings.Join(names, ", "), cfg.PGDatabase))
+	}
+	if len(tables) > 0 {
+		steps = append(steps, fmt.Sprintf("Copy tables %s into %s", strings.Join(tables, ", "), cfg.PGDatabase))
+	}
+	return append(steps, "Drop the temp database")
+}
+
+// cmdRestoreSelective runs restore --table / --user for the selected backup
+func cmdRestoreSelective(ctx context.Context, cfg *RestoreConfig, store Storage, backup string, tables []string, user, format string) int {
+	var parts []string
+	if user != "" {
+		parts = append(parts, "user "+user)
+	}
+	if len(tables) > 0 {
+		parts = append(parts, "tables "+strings.Join(tables, ", "))
+	}
+	result := &SelectiveResult{Backup: backup, Database: cfg.PGDatabase, Selection: strings.Join(parts, "; ")}
+
+	if cfg.DryRun {
+		fmt.Println("\n[DRY RUN] Would execute:")
+		for i, step := range selectiveSteps(cfg, backup, tables, user) {
+			fmt.Printf("  %d. %s\n", i+1, step)
+		}
+		return 0
+	}
+
+	if !cfg.Force {
+		fmt.Printf("\n⚠️  WARNING: This will add rows from the backup to database '%s'\n", cfg.PGDatabase)
+		fmt.Printf("   Backup: %s\n", backup)
+		fmt.Printf("   Selection: %s\n", result.Selection)
+		fmt.Printf("   Host: %s:%s\n", cfg.PGHost, cfg.PGPort)
+		fmt.Println("   Existing rows are left unchanged; nothing is deleted.")
+		fmt.Print("\nType 'yes' to continue: ")
+
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+
+		if input != "yes" {
+			fmt.Println("Cancelled.")
+			return 0
+		}
+	}
+
+	err := restoreSelective(ctx, cfg, store, backup, tables, user, result)
+	result.OK = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	printSelectiveResult(result, format)
+
+	if !result.OK {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func selectionIndex(table string) int {
+	for i, sel := range userSelections {
+		if sel.Table == table {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasRef(refs []tableRef, ref tableRef) bool {
+	for _, r := range refs {
+		if r == ref {
+			return true
+		}
+	}
+	return false
+}
+
+// Every foreign key of the copied tables must point at a row inserted
+// earlier, be checked as a reference, or be set after the batch
+func TestUserSelectionsForeignKeys(t *testing.T) {
+	tests := []struct {
+		table  string
+		column string
+		ref    string
+	}{
+		{"user", "avatarId", "drive_file"},
+		{"user", "bannerId", "drive_file"},
+		{"user_keypair", "userId", "user"},
+		{"drive_folder", "userId", "user"},
+		{"drive_folder", "parentId", "drive_folder"},
+		{"drive_file", "userId", "user"},
+		{"drive_file", "folderId", "drive_folder"},
+		{"page", "userId", "user"},
+		{"page", "eyeCatchingImageId", "drive_file"},
+		{"user_profile", "userId", "user"},
+		{"user_profile", "pinnedPageId", "page"},
+		{"note", "userId", "user"},
+		{"note", "replyId", "note"},
+		{"note", "renoteId", "note"},
+		{"note", "channelId", "channel"},
+		{"note_reaction", "userId", "user"},
+		{"note_reaction", "noteId", "note"},
+		{"following", "followerId", "user"},
+		{"following", "followeeId", "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table+"."+tt.column, func(t *testing.T) {
+			i := selectionIndex(tt.table)
+			if i < 0 {
+				t.Fatalf("%s is not copied", tt.table)
+			}
+			sel := userSelections[i]
+			ref := tableRef{tt.column, tt.ref}
+			j := selectionIndex(tt.ref)
+
+			switch {
+			case hasRef(sel.Deferred, ref):
+				if j < 0 {
+					t.Errorf("deferred %s.%s points at %s, which is not copied", tt.table, tt.column, tt.ref)
+				}
+			case hasRef(sel.Refs, ref):
+				if j > i {
+					t.Errorf("%s.%s is checked against %s, which is copied later", tt.table, tt.column, tt.ref)
+				}
+			case j < 0 || j >= i:
+				t.Errorf("%s.%s points at %s, which is not copied before it", tt.table, tt.column, tt.ref)
+			}
+		})
+	}
+}
+
+func TestDeferredColumns(t *testing.T) {
+	sel := tableSelection{Table: "user", Deferred: []tableRef{{"avatarId", "drive_file"}, {"bannerId", "drive_file"}}}
+	tests := []struct {
+		columns []string
+		want    []string
+	}{
+		{[]string{"id", "avatarId", "bannerId"}, []string{"avatarId", "bannerId"}},
+		// A column dropped by a migration is not copied, so not deferred either
+		{[]string{"id", "avatarId"}, []string{"avatarId"}},
+		{[]string{"id"}, nil},
+	}
+	for _, tt := range tests {
+		if got := deferredColumns(sel, tt.columns); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("deferredColumns(%v) = %v, want %v", tt.columns, got, tt.want)
+		}
+	}
+}
+
+func TestSelectiveSteps(t *testing.T) {
+	cfg := &RestoreConfig{PGDatabase: "mk1"}
+	tests := []struct {
+		name   string
+		tables []string
+		user   string
+		want   []string // prefix of each step
+	}{
+		{"user", nil, "alice", []string{"Create", "Restore", "Copy the rows of user alice", "Drop"}},
+		{"tables", []string{"meta"}, "", []string{"Create", "Restore", "Copy tables meta", "Drop"}},
+		{"user and tables", []string{"meta", "emoji"}, "alice",
+			[]string{"Create", "Restore", "Copy the rows of user alice", "Copy tables meta, emoji", "Drop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := selectiveSteps(cfg, "mk1_2025-01-01_03-00.sql.7z", tt.tables, tt.user)
+			if len(steps) != len(tt.want) {
+				t.Fatalf("steps = %q, want %d", steps, len(tt.want))
+			}
+			for i, step := range steps {
+				if !strings.HasPrefix(step, tt.want[i]) {
+					t.Errorf("step %d = %q, want it to start with %q", i+1, step, tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ===== Misskey service orchestration =====
+
+// dockerStopTimeout is how long Docker waits for a container to exit before
+// killing it
+const dockerStopTimeout = 30
+
+// ServiceStep records one hook run or container stop/start around a restore
+type ServiceStep struct {
+	Action string `json:"action"` // pre-hook, stop, start or post-hook
+	Target string `json:"target"` // container name or hook command
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+	Ms     int64  `json:"ms"`
+}
+
+func (s ServiceStep) String() string {
+	line := fmt.Sprintf("%s %s %s (%dms)", boolToStatus(s.OK), s.Action, s.Target, s.Ms)
+	if s.Detail != "" {
+		line += ": " + s.Detail
+	}
+	return line
+}
+
+// dockerClient talks to the Docker Engine API over its unix socket
+type dockerClient struct {
+	http *http.Client
+}
+
+type dockerContainer struct {
+	ID     string            `json:"Id"`
+	Names  []string          `json:"Names"`
+	State  string            `json:"State"`
+	Labels map[string]string `json:"Labels"`
+}
+
+// name returns the container name without Docker's leading slash
+func (c dockerContainer) name() string {
+	if len(c.Names) == 0 {
+		return c.ID[:12]
+	}
+	return strings.TrimPrefix(c.Names[0], "/")
+}
+
+func newDockerClient(socket string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{http: &http.Client{Transport: transport}}
+}
+
+// do sends a request to the engine; the host part of the URL is ignored
+func (d *dockerClient) do(ctx context.Context, method, path string, query url.Values) (*http.Response, error) {
+	u := "http://docker" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return d.http.Do(req)
+}
+
+// apiError turns an error response into an error with the engine's message
+func (d *dockerClient) apiError(resp *http.Response) error {
+	var body struct {
+		Message string `json:"message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && body.Message != "" {
+		return fmt.Errorf("docker: %s", body.Message)
+	}
+	return fmt.Errorf("docker: status %d", resp.StatusCode)
+}
+
+// list returns all containers, running or not, matching the label filters
+func (d *dockerClient) list(ctx context.Context, labels []string) ([]dockerContainer, error) {
+	query := url.Values{"all": {"1"}}
+	if len(labels) > 0 {
+		filters, _ := json.Marshal(map[string][]string{"label": labels})
+		query.Set("filters", string(filters))
+	}
+	resp, err := d.do(ctx, http.MethodGet, "/containers/json", query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, d.apiError(resp)
+	}
+
+	var containers []dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+	return containers, nil
+}
+
+// post runs a container action (stop, start); 304 means it was already done
+func (d *dockerClient) post(ctx context.Context, id, action string, query url.Values) error {
+	resp, err := d.do(ctx, http.MethodPost, "/containers/"+url.PathEscape(id)+"/"+action, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent, http.StatusNotModified:
+		return nil
+	}
+	return d.apiError(resp)
+}
+
+func (d *dockerClient) stop(ctx context.Context, id string) error {
+	return d.post(ctx, id, "stop", url.Values{"t": {fmt.Sprint(dockerStopTimeout)}})
+}
+
+func (d *dockerClient) start(ctx context.Context, id string) error {
+	return d.post(ctx, id, "start", nil)
+}
+
+// serviceControl stops Misskey before a restore and starts it again afterwards,
+// using the Docker API (MISSKEY_CONTAINERS or MISSKEY_COMPOSE_PROJECT) and/or
+// the PRE_RESTORE_HOOK / POST_RESTORE_HOOK shell commands
+type serviceControl struct {
+	cfg     *RestoreConfig
+	backup  string
+	docker  *dockerClient
+	stopped []dockerContainer
+	Steps   []ServiceStep
+}
+
+func newServiceControl(cfg *RestoreConfig, backup string) *serviceControl {
+	s := &serviceControl{cfg: cfg, backup: backup}
+	if cfg.StopMisskey {
+		s.docker = newDockerClient(cfg.DockerSocket)
+	}
+	return s
+}
+
+// enabled reports whether anything runs around the restore
+func (s *serviceControl) enabled() bool {
+	return s.docker != nil || s.cfg.PreRestoreHook != "" || s.cfg.PostRestoreHook != ""
+}
+
+// containers looks up the configured Misskey containers
+func (s *serviceControl) containers(ctx context.Context) ([]dockerContainer, error) {
+	names := splitList(s.cfg.MisskeyContainers)
+	project := s.cfg.ComposeProject
+	if len(names) == 0 && project == "" {
+		return nil, fmt.Errorf("--stop-misskey requires MISSKEY_CONTAINERS or MISSKEY_COMPOSE_PROJECT")
+	}
+
+	var labels []string
+	if len(names) == 0 {
+		labels = []string{"com.docker.compose.project=" + project}
+	}
+	all, err := s.docker.list(ctx, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []dockerContainer
+	if len(names) > 0 {
+		for _, name := range names {
+			found := false
+			for _, c := range all {
+				if c.name() == name {
+					matched = append(matched, c)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("container %s not found", name)
+			}
+		}
+		return matched, nil
+	}
+
+	// Only the Misskey services, never the database the restore needs
+	services := splitList(s.cfg.ComposeServices)
+	for _, c := range all {
+		for _, svc := range services {
+			if c.Labels["com.docker.compose.service"] == svc {
+				matched = append(matched, c)
+				break
+			}
+		}
+	}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("no containers of services %s in compose project %s", strings.Join(services, ", "), project)
+	}
+	return matched, nil
+}
+
+// describe lists what would be stopped, for the confirmation prompt and --dry-run
+func (s *serviceControl) describe(ctx context.Context) []string {
+	var lines []string
+	if s.cfg.PreRestoreHook != "" {
+		lines = append(lines, "Run pre-restore hook: "+s.cfg.PreRestoreHook)
+	}
+	if s.docker != nil {
+		containers, err := s.containers(ctx)
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("Stop Misskey containers (lookup failed: %v)", err))
+		} else {
+			var names []string
+			for _, c := range containers {
+				names = append(names, fmt.Sprintf("%s [%s]", c.name(), c.State))
+			}
+			lines = append(lines, "Stop Misskey containers: "+strings.Join(names, ", "))
+		}
+	}
+	return lines
+}
+
+// stop runs the pre-restore hook and stops the running Misskey containers.
+// On error the restore must not go ahead; call start to undo what was done.
+func (s *serviceControl) stop(ctx context.Context) error {
+	if s.cfg.PreRestoreHook != "" {
+		if err := s.runHook(ctx, "pre-hook", s.cfg.PreRestoreHook, nil); err != nil {
+			return fmt.Errorf("pre-restore hook failed: %w", err)
+		}
+	}
+	if s.docker == nil {
+		return nil
+	}
+
+	containers, err := s.containers(ctx)
+	if err != nil {
+		s.record("stop", "misskey", time.Now(), err)
+		return err
+	}
+	for _, c := range containers {
+		if c.State != "running" {
+			progress.printf("Container %s is %s, leaving it", c.name(), c.State)
+			continue
+		}
+		progress.printf("Stopping container %s...", c.name())
+		start := time.Now()
+		err := s.docker.stop(ctx, c.ID)
+		s.record("stop", c.name(), start, err)
+		if err != nil {
+			return fmt.Errorf("failed to stop %s: %w", c.name(), err)
+		}
+		s.stopped = append(s.stopped, c)
+	}
+	return nil
+}
+
+// start starts the containers stop stopped, in reverse order, and runs the
+// post-restore hook with RESTORE_OK set from restoreErr
+func (s *serviceControl) start(ctx context.Context, restoreErr error) error {
+	var errs []string
+	for i := len(s.stopped) - 1; i >= 0; i-- {
+		c := s.stopped[i]
+		progress.printf("Starting container %s...", c.name())
+		start := time.Now()
+		err := s.docker.start(ctx, c.ID)
+		s.record("start", c.name(), start, err)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("failed to start %s: %v", c.name(), err))
+		}
+	}
+	s.stopped = nil
+
+	if s.cfg.PostRestoreHook != "" {
+		ok := "1"
+		if restoreErr != nil {
+			ok = "0"
+		}
+		if err := s.runHook(ctx, "post-hook", s.cfg.PostRestoreHook, []string{"RESTORE_OK=" + ok}); err != nil {
+			errs = append(errs, fmt.Sprintf("post-restore hook failed: %v", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// runHook runs a hook with sh -c; the restore is described in RESTORE_* variables
+func (s *serviceControl) runHook(ctx context.Context, action, command string, env []string) error {
+	progress.printf("Running %s: %s", action, command)
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Env = append(os.Environ(),
+		"RESTORE_BACKUP="+s.backup,
+		"RESTORE_DATABASE="+s.cfg.PGDatabase,
+		"RESTORE_HOST="+s.cfg.PGHost,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	out := progress.writer()
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	start := time.Now()
+	err := cmd.Run()
+	s.record(action, command, start, err)
+	return err
+}
+
+func (s *serviceControl) record(action, target string, start time.Time, err error) {
+	step := ServiceStep{
+		Action: action,
+		Target: target,
+		OK:     err == nil,
+		Ms:     time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		step.Detail = err.Error()
+	}
+	s.Steps = append(s.Steps, step)
+}
+
+// splitList splits a comma-separated setting, dropping empty elements
+func splitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// printServiceSteps prints the outcome of each step around the restore
+func printServiceSteps(steps []ServiceStep) {
+	if len(steps) == 0 {
+		return
+	}
+	fmt.Println("\nServices:")
+	for _, step := range steps {
+		fmt.Printf("  %s\n", step)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ===== Pre-restore snapshots =====
+
+const (
+	snapshotDump = "dump" // pg_dump -Fc of the target into WORK_DIR/snapshots
+	snapshotCopy = "copy" // CREATE DATABASE ... TEMPLATE target
+	snapshotNone = "none"
+)
+
+// Snapshot is a copy of the target database taken before a restore.
+type Snapshot struct {
+	Kind      string    `json:"kind"`     // snapshotDump or snapshotCopy
+	Location  string    `json:"location"` // dump file path or database name
+	Size      int64     `json:"size,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// RestoreReport records a restore so that it can be rolled back.
+type RestoreReport struct {
+	ID         string    `json:"id"`
+	Backup     string    `json:"backup"`
+	Database   string    `json:"database"`
+	Host       string    `json:"host"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+	OK         bool      `json:"ok"`
+	Error      string    `json:"error,omitempty"`
+	Snapshot   *Snapshot `json:"snapshot,omitempty"`
+	Staging    string    `json:"staging,omitempty"`  // database the backup was loaded into
+	Previous   string    `json:"previous,omitempty"` // the replaced database, renamed aside
+	RolledBack time.Time `json:"rolledBack,omitempty"`
+
+	// Hooks and containers stopped/started around the restore
+	Services []ServiceStep `json:"services,omitempty"`
+
+	// How ownership was handled, and roles/extensions created for the backup
+	Roles *RoleSetup `json:"roles,omitempty"`
+
+	// Applied migrations of the restored database compared with the Misskey version
+	Migrations *MigrationState `json:"migrations,omitempty"`
+
+	path string
+}
+
+func newRestoreReport(cfg *RestoreConfig, backup string) *RestoreReport {
+	now := time.Now()
+	return &RestoreReport{
+		ID:        now.Format("20060102-150405"),
+		Backup:    backup,
+		Database:  cfg.PGDatabase,
+		Host:      fmt.Sprintf("%s:%s", cfg.PGHost, cfg.PGPort),
+		StartedAt: now,
+	}
+}
+
+func reportsDir(cfg *RestoreConfig) string {
+	return filepath.Join(cfg.WorkDir, "reports")
+}
+
+// save writes the report to WORK_DIR/reports/restore-<id>.json
+func (r *RestoreReport) save(cfg *RestoreConfig) error {
+	if r.path == "" {
+		if err := os.MkdirAll(reportsDir(cfg), 0755); err != nil {
+			return fmt.Errorf("failed to create reports directory: %w", err)
+		}
+		r.path = filepath.Join(reportsDir(cfg), "restore-"+r.ID+".json")
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.path, data, 0644)
+}
+
+// latestRollbackReport finds the newest restore of database whose snapshot has
+// not been rolled back yet. Restores that failed before the swap left the
+// target as it was and are skipped.
+func latestRollbackReport(cfg *RestoreConfig, database string) (*RestoreReport, error) {
+	paths, err := filepath.Glob(filepath.Join(reportsDir(cfg), "restore-*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		var r RestoreReport
+		if err := json.Unmarshal(data, &r); err != nil {
+			continue
+		}
+		if !r.OK && r.Previous == "" {
+			continue
+		}
+		if r.Database == database && r.Snapshot != nil && r.RolledBack.IsZero() {
+			r.path = p
+			return &r, nil
+		}
+	}
+	return nil, fmt.Errorf("no restore of %s with a snapshot found in %s", database, reportsDir(cfg))
+}
+
+// beginRestore starts the report of a restore of backup and snapshots the
+// target first, unless kind is none or the target does not exist yet.
+func beginRestore(ctx context.Context, cfg *RestoreConfig, backup, kind string) (*RestoreReport, error) {
+	report := newRestoreReport(cfg, backup)
+
+	if kind != snapshotNone {
+		exists, err := databaseExists(ctx, cfg, cfg.PGDatabase)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			snap, err := takeSnapshot(ctx, cfg, kind)
+			if err != nil {
+				return nil, err
+			}
+			report.Snapshot = snap
+		} else {
+			progress.printf("Database %s does not exist yet, skipping snapshot", cfg.PGDatabase)
+		}
+	}
+
+	if err := report.save(cfg); err != nil {
+		return nil, fmt.Errorf("failed to save restore report: %w", err)
+	}
+	return report, nil
+}
+
+// finish records the outcome of the restore and prints where the report is
+func (r *RestoreReport) finish(cfg *RestoreConfig, restoreErr error) {
+	r.FinishedAt = time.Now()
+	r.OK = restoreErr == nil
+	if restoreErr != nil {
+		r.Error = restoreErr.Error()
+	}
+	if err := r.save(cfg); err != nil {
+		progress.printf("Warning: failed to save restore report: %v", err)
+		return
+	}
+
+	r.Roles.print()
+	printServiceSteps(r.Services)
+	if r.Migrations != nil {
+		fmt.Printf("\nMigrations: %s\n", r.Migrations)
+	}
+	fmt.Printf("\nRestore report: %s\n", r.path)
+	if r.Snapshot != nil {
+		fmt.Printf("Snapshot: %s %s\n", r.Snapshot.Kind, r.Snapshot.Location)
+		fmt.Printf("To undo: yamisskey-doctor restore --rollback -d %s\n", r.Database)
+	}
+}
+
+// databaseExists reports whether database exists on the server
+func databaseExists(ctx context.Context, cfg *RestoreConfig, database string) (bool, error) {
+	conn, err := connectDB(ctx, cfg, "postgres")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close(ctx)
+
+	var exists bool
+	err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", database).Scan(&exists)
+	return exists, err
+}
+
+// takeSnapshot copies the target database before it is overwritten
+func takeSnapshot(ctx context.Context, cfg *RestoreConfig, kind string) (*Snapshot, error) {
+	ts := time.Now()
+	snap := &Snapshot{Kind: kind, CreatedAt: ts}
+
+	switch kind {
+	case snapshotDump:
+		dir := filepath.Join(cfg.WorkDir, "snapshots")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create snapshot directory: %w", err)
+		}
+		snap.Location = filepath.Join(dir, fmt.Sprintf("%s_pre-restore_%s.dump", cfg.PGDatabase, ts.Format("2006-01-02_15-04-05")))
+		progress.printf("Snapshotting %s to %s...", cfg.PGDatabase, snap.Location)
+
+		f, err := os.Create(snap.Location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create snapshot: %w", err)
+		}
+		cmd := pgDumpCommand(cfg, true)
+		cmd.Stdout = f
+		cmd.Stderr = progress.writer()
+		err = cmd.Run()
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(snap.Location)
+			return nil, fmt.Errorf("failed to snapshot %s: %w", cfg.PGDatabase, err)
+		}
+		if info, err := os.Stat(snap.Location); err == nil {
+			snap.Size = info.Size()
+		}
+
+	case snapshotCopy:
+		snap.Location = fmt.Sprintf("%s_pre_restore_%s", cfg.PGDatabase, ts.Format("20060102_150405"))
+		progress.printf("Snapshotting %s to database %s...", cfg.PGDatabase, snap.Location)
+
+		conn, err := connectDB(ctx, cfg, "postgres")
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close(ctx)
+
+		// TEMPLATE needs the source to have no other sessions
+		_, err = conn.Exec(ctx, fmt.Sprintf("CREATE DATABASE %s TEMPLATE %s",
+			quoteIdent(snap.Location), quoteIdent(cfg.PGDatabase)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to copy %s (stop Misskey first with --stop-misskey, or use --snapshot dump): %w", cfg.PGDatabase, err)
+		}
+
+	default:
+		return nil, fmt.Errorf("unknown snapshot kind %q (expected dump, copy or none)", kind)
+	}
+
+	return snap, nil
+}
+
+// checkSnapshot reports an error if the snapshot is gone
+func checkSnapshot(ctx context.Context, cfg *RestoreConfig, snap *Snapshot) error {
+	switch snap.Kind {
+	case snapshotDump:
+		if _, err := os.Stat(snap.Location); err != nil {
+			return fmt.Errorf("snapshot not found: %w", err)
+		}
+	case snapshotCopy:
+		exists, err := databaseExists(ctx, cfg, snap.Location)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("snapshot database %s not found", snap.Location)
+		}
+	default:
+		return fmt.Errorf("unknown snapshot kind %q", snap.Kind)
+	}
+	return nil
+}
+
+// rollbackSnapshot swaps the snapshot into place of the target database, which
+// is kept as <db>_rolledback_<ts>. A dump snapshot is first restored into a
+// staging database with the target's owner, encoding and locale, so the
+// target is untouched until the snapshot is a complete database. It returns
+// the name the target was kept under, or "" if it did not exist.
+func rollbackSnapshot(ctx context.Context, cfg *RestoreConfig, snap *Snapshot) (string, error) {
+	ts := time.Now().Format("20060102_150405")
+	replaced := fmt.Sprintf("%s_rolledback_%s", cfg.PGDatabase, ts)
+
+	staging := snap.Location
+	if snap.Kind == snapshotDump {
+		target, err := inspectTarget(ctx, cfg)
+		if err != nil {
+			return "", err
+		}
+		staging = fmt.Sprintf("%s_rollback_%s", cfg.PGDatabase, ts)
+		progress.printf("Restoring snapshot %s into %s...", snap.Location, staging)
+		if err := createStagingDatabase(ctx, cfg, staging, target); err != nil {
+			return "", err
+		}
+		if err := loadSnapshot(cfg, staging, snap); err != nil {
+			dropTempDatabase(ctx, cfg, staging)
+			return "", err
+		}
+	}
+
+	progress.printf("Swapping %s into place...", staging)
+	previous, err := swapDatabase(ctx, cfg, staging, replaced)
+	if err != nil {
+		if snap.Kind == snapshotDump {
+			dropTempDatabase(ctx, cfg, staging)
+		}
+		return "", err
+	}
+	return previous, nil
+}
+
+// loadSnapshot restores a dump snapshot into database
+func loadSnapshot(cfg *RestoreConfig, database string, snap *Snapshot) error {
+	cmd, err := dumpLoadCommand(cfg, database, &dumpSource{Format: formatCustom, Path: snap.Location}, true)
+	if err != nil {
+		return err
+	}
+	out := progress.writer()
+	cmd.Stdout = out
+	cmd.Stderr = out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to restore snapshot %s: %w", snap.Location, err)
+	}
+	return nil
+}
+
+// cmdRollback reinstates the snapshot taken before the last restore of cfg.PGDatabase
+func cmdRollback(cfg *RestoreConfig) int {
+	ctx := context.Background()
+
+	report, err := latestRollbackReport(cfg, cfg.PGDatabase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	snap := report.Snapshot
+
+	// Nothing is touched unless the snapshot can replace the target
+	if err := checkSnapshot(ctx, cfg, snap); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Restore %s: %s into %s (%s)\n", report.ID, report.Backup, report.Database, report.StartedAt.Format("2006-01-02 15:04"))
+	fmt.Printf("Snapshot: %s %s\n", snap.Kind, snap.Location)
+
+	if cfg.DryRun {
+		fmt.Println("\n[DRY RUN] Would execute:")
+		step := 1
+		staging := snap.Location
+		if snap.Kind == snapshotDump {
+			staging = cfg.PGDatabase + "_rollback_<timestamp>"
+			fmt.Printf("  %d. Restore snapshot: %s → %s@%s:%s/%s\n", step, snap.Location, cfg.PGUser, cfg.PGHost, cfg.PGPort, staging)
+			step++
+		}
+		fmt.Printf("  %d. Swap: %s → %s_rolledback_<timestamp>, %s → %s\n",
+			step, cfg.PGDatabase, cfg.PGDatabase, staging, cfg.PGDatabase)
+		return 0
+	}
+
+	if !cfg.Force {
+		fmt.Printf("\n⚠️  WARNING: This will replace database '%s' with the snapshot\n", cfg.PGDatabase)
+		fmt.Printf("   Host: %s:%s\n", cfg.PGHost, cfg.PGPort)
+		fmt.Print("\nType 'yes' to continue: ")
+
+		reader := bufio.NewReader(os.Stdin)
+		input, _ := reader.ReadString('\n')
+		input = strings.TrimSpace(input)
+
+		if input != "yes" {
+			fmt.Println("Cancelled.")
+			return 0
+		}
+	}
+
+	fmt.Println()
+	replaced, err := rollbackSnapshot(ctx, cfg, snap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	if replaced != "" {
+		fmt.Printf("Replaced database kept as %s (drop it once the rollback is confirmed)\n", replaced)
+	}
+
+	report.RolledBack = time.Now()
+	if err := report.save(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to update restore report: %v\n", err)
+	}
+
+	fmt.Println("\n✅ Rollback completed successfully!")
+	return 0
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// ===== Restore target =====
+
+// targetDatabase describes the database a restore would replace
+type targetDatabase struct {
+	Name     string
+	Exists   bool
+	Owner    string
+	Encoding string
+	Collate  string
+	CType    string
+	Size     int64
+	Tables   int
+	Rows     int64 // estimated from pg_stat_user_tables
+}
+
+// inspectTarget looks up the restore target's settings and contents
+func inspectTarget(ctx context.Context, cfg *RestoreConfig) (*targetDatabase, error) {
+	t := &targetDatabase{Name: cfg.PGDatabase}
+
+	conn, err := connectDB(ctx, cfg, "postgres")
+	if err != nil {
+		return nil, err
+	}
+	err = conn.QueryRow(ctx,
+		`SELECT pg_get_userbyid(datdba), pg_encoding_to_char(encoding), datcollate, datctype, pg_database_size(oid)
+		 FROM pg_database WHERE datname = $1`,
+		cfg.PGDatabase,
+	).Scan(&t.Owner, &t.Encoding, &t.Collate, &t.CType, &t.Size)
+	conn.Close(ctx)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect %s: %w", cfg.PGDatabase, err)
+	}
+	t.Exists = true
+
+	conn, err = connectDB(ctx, cfg, cfg.PGDatabase)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	err = conn.QueryRow(ctx,
+		"SELECT COUNT(*), COALESCE(SUM(n_live_tup), 0) FROM pg_stat_user_tables",
+	).Scan(&t.Tables, &t.Rows)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count tables in %s: %w", cfg.PGDatabase, err)
+	}
+	return t, nil
+}
+
+// empty reports whether restoring over the target cannot lose data
+func (t *targetDatabase) empty() bool {
+	return !t.Exists || t.Tables == 0
+}
+
+func (t *targetDatabase) String() string {
+	if !t.Exists {
+		return fmt.Sprintf("%s (does not exist, will be created)", t.Name)
+	}
+	if t.Tables == 0 {
+		return fmt.Sprintf("%s (empty, owner %s, %s)", t.Name, t.Owner, t.Encoding)
+	}
+	return fmt.Sprintf("%s (%d tables, ~%d rows, %s, owner %s, %s)",
+		t.Name, t.Tables, t.Rows, formatBytes(t.Size), t.Owner, t.Encoding)
+}
+
+// createStagingDatabase creates the database a backup is loaded into, with
+// the owner, encoding and locale of the database it will replace
+func createStagingDatabase(ctx context.Context, cfg *RestoreConfig, name string, target *targetDatabase) error {
+	if target == nil || !target.Exists {
+		return createTempDatabase(ctx, cfg, name)
+	}
+
+	conn, err := connectDB(ctx, cfg, "postgres")
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	// template0, since template1 may have a different encoding or locale
+	sql := fmt.Sprintf("CREATE DATABASE %s OWNER %s ENCODING %s LC_COLLATE %s LC_CTYPE %s TEMPLATE template0",
+		quoteIdent(name), quoteIdent(target.Owner), quoteLiteral(target.Encoding),
+		quoteLiteral(target.Collate), quoteLiteral(target.CType))
+	if _, err := conn.Exec(ctx, sql); err != nil {
+		return fmt.Errorf("failed to create staging database: %w", err)
+	}
+	return nil
+}
+
+// quoteLiteral quotes a string for use as a literal in SQL text
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// ===== Staging restore =====
+
+// swapAttempts bounds how often the swap is retried when clients reconnect
+// to the target between terminating their sessions and renaming it
+const swapAttempts = 5
+
+// restoreViaStaging loads a backup into a fresh <db>_restore_<ts> database,
+// runs the integrity checks on it and only then swaps it into place. The
+// previous database is kept as <db>_old_<ts>. If anything fails before the
+// swap the target is untouched and the staging database is dropped.
+func restoreViaStaging(ctx context.Context, cfg *RestoreConfig, report *RestoreReport, target *targetDatabase, load func(database string) error) error {
+	ts := time.Now().Format("20060102_150405")
+	staging := fmt.Sprintf("%s_restore_%s", cfg.PGDatabase, ts)
+	old := fmt.Sprintf("%s_old_%s", cfg.PGDatabase, ts)
+	report.Staging = staging
+
+	progress.printf("Creating staging database %s...", staging)
+	if err := createStagingDatabase(ctx, cfg, staging, target); err != nil {
+		return err
+	}
+	swapped := false
+	defer func() {
+		if !swapped {
+			progress.printf("Dropping staging database %s...", staging)
+			dropTempDatabase(ctx, cfg, staging)
+		}
+	}()
+
+	if err := load(staging); err != nil {
+		return err
+	}
+
+	progress.printf("Running integrity checks...")
+	checks, _, err := runIntegrityChecks(ctx, cfg, staging)
+	if err != nil {
+		return fmt.Errorf("integrity checks failed: %w", err)
+	}
+	var failed []string
+	for _, c := range checks {
+		progress.printf("  %s %s: %s", c.status(), c.Name, c.Detail)
+		if !c.OK && c.Severity == severityError {
+			failed = append(failed, c.Name)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("integrity checks failed (%s); %s was not changed", strings.Join(failed, ", "), cfg.PGDatabase)
+	}
+
+	// A mismatch only warns: the operator may be about to up- or downgrade Misskey
+	if m, err := checkMigrations(ctx, cfg, staging); err != nil {
+		progress.printf("Warning: failed to check migrations: %v", err)
+	} else {
+		report.Migrations = m
+		progress.printf("  Migrations: %s", m)
+	}
+
+	progress.printf("Swapping %s into place...", staging)
+	previous, err := swapDatabase(ctx, cfg, staging, old)
+	if err != nil {
+		return err
+	}
+	swapped = true
+
+	if previous != "" {
+		report.Previous = previous
+		progress.printf("Previous database kept as %s", previous)
+		// The old database doubles as a snapshot when none was taken
+		if report.Snapshot == nil {
+			report.Snapshot = &Snapshot{Kind: snapshotCopy, Location: previous, CreatedAt: time.Now()}
+		}
+		// A rollback looks for these even if the restore fails from here on
+		if err := report.save(cfg); err != nil {
+			progress.printf("Warning: failed to save restore report: %v", err)
+		}
+	}
+	return nil
+}
+
+// swapDatabase renames the target to old and staging to the target in one
+// transaction. It returns old, or "" if the target did not exist.
+func swapDatabase(ctx context.Context, cfg *RestoreConfig, staging, old string) (string, error) {
+	conn, err := connectDB(ctx, cfg, "postgres")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close(ctx)
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)", cfg.PGDatabase).Scan(&exists); err != nil {
+		return "", fmt.Errorf("failed to look up %s: %w", cfg.PGDatabase, err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = func() error {
+			// Outside the transaction: a failure here would abort it
+			if exists {
+				if _, err := conn.Exec(ctx,
+					"SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1 AND pid <> pg_backend_pid()",
+					cfg.PGDatabase,
+				); err != nil {
+					return fmt.Errorf("failed to disconnect clients of %s: %w", cfg.PGDatabase, err)
+				}
+			}
+
+			tx, err := conn.Begin(ctx)
+			if err != nil {
+				return err
+			}
+			defer tx.Rollback(ctx)
+
+			if exists {
+				if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", quoteIdent(cfg.PGDatabase), quoteIdent(old))); err != nil {
+					return err
+				}
+			}
+			if _, err := tx.Exec(ctx, fmt.Sprintf("ALTER DATABASE %s RENAME TO %s", quoteIdent(staging), quoteIdent(cfg.PGDatabase))); err != nil {
+				return err
+			}
+			return tx.Commit(ctx)
+		}()
+		if err == nil {
+			break
+		}
+
+		// 55006: a client reconnected before the rename
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "55006" || attempt == swapAttempts {
+			return "", fmt.Errorf("failed to swap %s into place: %w", staging, err)
+		}
+		progress.printf("%s is still in use, retrying (%d/%d)...", cfg.PGDatabase, attempt, swapAttempts)
+		time.Sleep(time.Second)
+	}
+
+	if !exists {
+		return "", nil
+	}
+	return old, nil
+}
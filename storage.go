@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ===== Storage =====
+
+// BackupObject is a file stored in a backup storage backend.
+type BackupObject struct {
+	Name    string    `json:"name"` // path relative to the storage prefix
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Storage is a backend holding backup files.
+type Storage interface {
+	// List returns every object below the configured prefix.
+	List(ctx context.Context) ([]BackupObject, error)
+	// Stat returns metadata for a single object, or an error matching
+	// os.ErrNotExist if there is no such object.
+	Stat(ctx context.Context, name string) (*BackupObject, error)
+	// Download writes the object's content to w and returns the bytes written.
+	Download(ctx context.Context, name string, w io.Writer) (int64, error)
+	// Open returns a reader over the object supporting random access.
+	Open(ctx context.Context, name string) (BackupReader, error)
+	// Put stores the content of r as name. size is -1 if unknown.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Delete removes a single object.
+	Delete(ctx context.Context, name string) error
+	// Close releases connections held by the backend.
+	Close() error
+}
+
+// BackupReader reads a stored object either sequentially or at arbitrary offsets.
+type BackupReader interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+}
+
+const storageTypesHelp = "r2, linode, local:/path, sftp://user@host[:port]/path or s3://bucket/prefix"
+
+// newStorage returns the storage backend selected by cfg.StorageType.
+func newStorage(cfg *RestoreConfig) (Storage, error) {
+	switch {
+	case cfg.StorageType == "r2":
+		endpoint := cfg.R2Endpoint
+		if endpoint == "" && cfg.R2AccountID != "" {
+			endpoint = fmt.Sprintf("https://%s.r2.cloudflarestorage.com", cfg.R2AccountID)
+		}
+		if endpoint == "" {
+			return nil, fmt.Errorf("r2 storage requires R2_ENDPOINT or R2_ACCOUNT_ID")
+		}
+		// R2_PREFIX historically held the rclone path "bucket[/prefix]"
+		bucket, prefix := cfg.R2Bucket, cfg.R2Prefix
+		if bucket == "" {
+			bucket, prefix, _ = strings.Cut(cfg.R2Prefix, "/")
+		}
+		return newS3Storage(s3Options{
+			Endpoint:  endpoint,
+			Region:    "auto",
+			Bucket:    bucket,
+			Prefix:    prefix,
+			AccessKey: cfg.R2AccessKey,
+			SecretKey: cfg.R2SecretKey,
+		})
+
+	case cfg.StorageType == "linode":
+		if cfg.LinodeEndpoint == "" {
+			return nil, fmt.Errorf("linode storage requires LINODE_ENDPOINT")
+		}
+		return newS3Storage(s3Options{
+			Endpoint:  cfg.LinodeEndpoint,
+			Bucket:    cfg.LinodeBucket,
+			Prefix:    cfg.LinodePrefix,
+			AccessKey: cfg.LinodeAccessKey,
+			SecretKey: cfg.LinodeSecretKey,
+		})
+
+	case strings.HasPrefix(cfg.StorageType, "local:"):
+		dir := strings.TrimPrefix(cfg.StorageType, "local:")
+		if dir == "" {
+			return nil, fmt.Errorf("local storage requires a directory (local:/path)")
+		}
+		return newLocalStorage(dir)
+
+	case strings.HasPrefix(cfg.StorageType, "s3://"):
+		u, err := url.Parse(cfg.StorageType)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid s3 storage %q (expected s3://bucket/prefix)", cfg.StorageType)
+		}
+		if cfg.S3Endpoint == "" {
+			return nil, fmt.Errorf("s3 storage requires S3_ENDPOINT")
+		}
+		return newS3Storage(s3Options{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    u.Host,
+			Prefix:    u.Path,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+		})
+
+	case strings.HasPrefix(cfg.StorageType, "sftp://"):
+		u, err := url.Parse(cfg.StorageType)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid sftp storage %q (expected sftp://user@host[:port]/path)", cfg.StorageType)
+		}
+		return newSFTPStorage(u, cfg)
+
+	default:
+		return nil, fmt.Errorf("unknown storage type %q (expected %s)", cfg.StorageType, storageTypesHelp)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ===== Local directory storage =====
+
+// localStorage serves backups from a directory, e.g. a NAS mount.
+type localStorage struct {
+	dir string
+}
+
+func newLocalStorage(dir string) (*localStorage, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, fmt.Errorf("local storage: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("local storage: %s is not a directory", dir)
+	}
+	return &localStorage{dir: dir}, nil
+}
+
+func (s *localStorage) List(ctx context.Context) ([]BackupObject, error) {
+	var objects []BackupObject
+	err := filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, BackupObject{
+			Name:    filepath.ToSlash(rel),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", s.dir, err)
+	}
+	return objects, nil
+}
+
+func (s *localStorage) Stat(ctx context.Context, name string) (*BackupObject, error) {
+	info, err := os.Stat(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+	return &BackupObject{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *localStorage) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return n, fmt.Errorf("failed to copy %s: %w", name, err)
+	}
+	return n, nil
+}
+
+func (s *localStorage) Open(ctx context.Context, name string) (BackupReader, error) {
+	f, err := os.Open(s.path(name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put writes to a temporary file first so a failed upload leaves no partial backup
+func (s *localStorage) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	dst := s.path(name)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(dst), ".upload-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	_, err = io.Copy(f, r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *localStorage) Delete(ctx context.Context, name string) error {
+	if err := os.Remove(s.path(name)); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *localStorage) Close() error {
+	return nil
+}
+
+func (s *localStorage) path(name string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(name))
+}
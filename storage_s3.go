@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// ===== S3-compatible storage =====
+
+type s3Options struct {
+	Endpoint  string // host[:port] or URL; "http://" disables TLS (e.g. local MinIO)
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+}
+
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Storage(opts s3Options) (*s3Storage, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage requires a bucket")
+	}
+	if opts.AccessKey == "" || opts.SecretKey == "" {
+		return nil, fmt.Errorf("s3 storage requires an access key and secret key")
+	}
+
+	host, secure := opts.Endpoint, true
+	if strings.Contains(opts.Endpoint, "://") {
+		u, err := url.Parse(opts.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %q: %w", opts.Endpoint, err)
+		}
+		host, secure = u.Host, u.Scheme != "http"
+	}
+
+	client, err := minio.New(host, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: secure,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create s3 client: %w", err)
+	}
+
+	return &s3Storage{
+		client: client,
+		bucket: opts.Bucket,
+		prefix: strings.Trim(opts.Prefix, "/"),
+	}, nil
+}
+
+func (s *s3Storage) key(name string) string {
+	if s.prefix == "" {
+		return name
+	}
+	return path.Join(s.prefix, name)
+}
+
+func (s *s3Storage) List(ctx context.Context) ([]BackupObject, error) {
+	listPrefix := ""
+	if s.prefix != "" {
+		listPrefix = s.prefix + "/"
+	}
+
+	var objects []BackupObject
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{
+		Prefix:    listPrefix,
+		Recursive: true,
+	}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", s.bucket, listPrefix, obj.Err)
+		}
+		objects = append(objects, BackupObject{
+			Name:    strings.TrimPrefix(obj.Key, listPrefix),
+			Size:    obj.Size,
+			ModTime: obj.LastModified,
+		})
+	}
+	return objects, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, name string) (*BackupObject, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+	if err != nil {
+		if resp := minio.ToErrorResponse(err); resp.StatusCode == http.StatusNotFound || resp.Code == "NoSuchKey" {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+	return &BackupObject{Name: name, Size: info.Size, ModTime: info.LastModified}, nil
+}
+
+func (s *s3Storage) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get %s: %w", name, err)
+	}
+	defer obj.Close()
+
+	n, err := io.Copy(w, obj)
+	if err != nil {
+		return n, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	return n, nil
+}
+
+func (s *s3Storage) Open(ctx context.Context, name string) (BackupReader, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", name, err)
+	}
+	return obj, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	opts := minio.PutObjectOptions{}
+	if size < 0 {
+		// Bound the multipart buffer; the default for unknown sizes is ~512MiB
+		opts.PartSize = 64 << 20
+	}
+	_, err := s.client.PutObject(ctx, s.bucket, s.key(name), r, size, opts)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, name string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Close() error {
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// ===== SFTP storage =====
+
+type sftpStorage struct {
+	ssh    *ssh.Client
+	client *sftp.Client
+	dir    string
+}
+
+// newSFTPStorage connects to sftp://user@host[:port]/path. Authentication uses
+// SFTP_PASSWORD or the private key in SFTP_KEY_FILE, and the host key is
+// checked against SFTP_KNOWN_HOSTS.
+func newSFTPStorage(u *url.URL, cfg *RestoreConfig) (*sftpStorage, error) {
+	user := u.User.Username()
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	var auth []ssh.AuthMethod
+	if cfg.SFTPKeyFile != "" {
+		key, err := os.ReadFile(cfg.SFTPKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SFTP key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse SFTP key %s: %w", cfg.SFTPKeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password, ok := u.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	} else if cfg.SFTPPassword != "" {
+		auth = append(auth, ssh.Password(cfg.SFTPPassword))
+	}
+	if len(auth) == 0 {
+		return nil, fmt.Errorf("sftp storage requires SFTP_KEY_FILE or SFTP_PASSWORD")
+	}
+
+	hostKeyCallback, err := knownhosts.New(cfg.SFTPKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known hosts %s: %w", cfg.SFTPKnownHosts, err)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	sshClient, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, fmt.Errorf("failed to start sftp session: %w", err)
+	}
+
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+
+	return &sftpStorage{ssh: sshClient, client: client, dir: dir}, nil
+}
+
+func (s *sftpStorage) List(ctx context.Context) ([]BackupObject, error) {
+	var objects []BackupObject
+	walker := s.client.Walk(s.dir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", s.dir, err)
+		}
+		info := walker.Stat()
+		if info.IsDir() {
+			continue
+		}
+		objects = append(objects, BackupObject{
+			Name:    strings.TrimPrefix(strings.TrimPrefix(walker.Path(), s.dir), "/"),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	return objects, nil
+}
+
+func (s *sftpStorage) Stat(ctx context.Context, name string) (*BackupObject, error) {
+	info, err := s.client.Stat(path.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &BackupObject{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (s *sftpStorage) Download(ctx context.Context, name string, w io.Writer) (int64, error) {
+	f, err := s.client.Open(path.Join(s.dir, name))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	n, err := f.WriteTo(w)
+	if err != nil {
+		return n, fmt.Errorf("failed to download %s: %w", name, err)
+	}
+	return n, nil
+}
+
+func (s *sftpStorage) Open(ctx context.Context, name string) (BackupReader, error) {
+	f, err := s.client.Open(path.Join(s.dir, name))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Put uploads to a temporary name first so a failed upload leaves no partial backup
+func (s *sftpStorage) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	dst := path.Join(s.dir, name)
+	if err := s.client.MkdirAll(path.Dir(dst)); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp := dst + ".upload"
+	f, err := s.client.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	_, err = f.ReadFrom(r)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.client.PosixRename(tmp, dst)
+	}
+	if err != nil {
+		s.client.Remove(tmp)
+		return fmt.Errorf("failed to upload %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *sftpStorage) Delete(ctx context.Context, name string) error {
+	if err := s.client.Remove(path.Join(s.dir, name)); err != nil {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+func (s *sftpStorage) Close() error {
+	s.client.Close()
+	return s.ssh.Close()
+}